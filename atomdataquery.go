@@ -1,130 +1,425 @@
 package esatomdatapg
 
 import (
+	"context"
+	"crypto/sha1"
 	"database/sql"
+	"errors"
+	"fmt"
+	"math"
 	"time"
 
 	"github.com/xtracdev/goes"
 )
 
 const (
-	sqlSelectRecent       = `select event_time, aggregate_id, version, typecode, payload from t_aeae_atom_event where feedid is null order by id desc`
-	sqlSelectForFeed      = `select event_time, aggregate_id, version, typecode, payload from t_aeae_atom_event where feedid = $1 order by id desc`
-	sqlSelectPreviousFeed = `select previous from t_aefd_feed where feedid = $1`
-	sqlSelectNextFeed     = `select feedid from t_aefd_feed where previous = $1`
-	sqlSelectEvent        = `select event_time, typecode, payload from t_aeae_atom_event where aggregate_id = $1 and version = $2`
+	sqlSelectRecent       = `select event_time, aggregate_id, version, typecode, payload from t_aeae_atom_event where tenant = $1 and feed_name = $2 and feedid is null order by id desc`
+	sqlSelectForFeed      = `select event_time, aggregate_id, version, typecode, payload from t_aeae_atom_event where tenant = $1 and feedid = $2 order by id desc`
+	sqlSelectPreviousFeed = `select previous from t_aefd_feed where tenant = $1 and feedid = $2`
+	sqlSelectNextFeed     = `select feedid from t_aefd_feed where tenant = $1 and previous = $2`
+	sqlSelectRecentPage   = `select id, event_time, aggregate_id, version, typecode, payload from t_aeae_atom_event where tenant = $1 and feed_name = $2 and feedid is null and id < $3 order by id desc limit $4`
+	sqlSelectFeedPage     = `select id, event_time, aggregate_id, version, typecode, payload from t_aeae_atom_event where tenant = $1 and feedid = $2 and id < $3 order by id desc limit $4`
+	sqlSelectEvent        = `select event_time, typecode, payload from t_aeae_atom_event where tenant = $1 and aggregate_id = $2 and version = $3`
+
+	//When the recent page is empty it was last modified when the latest feed was created
+	sqlSelectRecentMetadata = `select count(*), coalesce(max(id), 0),
+		coalesce(max(event_time), (select max(event_time) from t_aefd_feed where tenant = $1 and feed_name = $2), 'epoch'::timestamp),
+		coalesce((select feedid from t_aefd_feed where id = (select max(id) from t_aefd_feed where tenant = $1 and feed_name = $2)), '')
+		from t_aeae_atom_event where tenant = $1 and feed_name = $2 and feedid is null`
+	sqlSelectArchiveMetadata = `select count(e.id), coalesce(max(e.id), 0), greatest(f.event_time, max(e.event_time)), f.feed_name,
+		coalesce((select n.feedid from t_aefd_feed n where n.tenant = f.tenant and n.previous = f.feedid), '')
+		from t_aefd_feed f left join t_aeae_atom_event e on e.tenant = f.tenant and e.feedid = f.feedid
+		where f.tenant = $1 and f.feedid = $2 group by f.tenant, f.feedid, f.event_time, f.feed_name`
 )
 
+// queryer is satisfied by *sql.DB and *sql.Tx, so the queries can run in the
+// transaction of a tenant scoped Store
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
 type TimestampedEvent struct {
 	goes.Event
 	Timestamp time.Time
 }
 
+// FeedMetadata describes a feed page for the purpose of HTTP caching. The events
+// of an archived page never change once the feed id has been assigned, but the
+// latest archived page gains a next page at the following rollover. The recent
+// page changes with every event written and with every rollover. FeedName is the
+// named feed the page belongs to.
+type FeedMetadata struct {
+	FeedName     string
+	FeedID       string
+	Archived     bool
+	LastModified time.Time
+	ETag         string
+
+	//PreviousFeedID is the latest archived page the recent page follows, and
+	//NextFeedID the page archived after an archived page. Empty if there is none,
+	//and each is only set for the kind of page it applies to. Both are part of the
+	//ETag, as the links of the page change with them.
+	PreviousFeedID string
+	NextFeedID     string
+}
+
+// Final reports whether the page will never change: it is archived and another
+// page has been archived after it.
+func (fm *FeedMetadata) Final() bool {
+	return fm.Archived && fm.NextFeedID != ""
+}
+
+// EventPage is a page of events returned by a keyset paged query. Pass NextCursor
+// to the next call to continue where this page left off; a zero NextCursor means
+// there are no more events.
+type EventPage struct {
+	Events     []TimestampedEvent
+	NextCursor int64
+}
+
+// EventIterator streams events from a query without materializing the result set.
+// Callers must Close the iterator when done.
+type EventIterator struct {
+	rows  *sql.Rows
+	event TimestampedEvent
+	err   error
+
+	//tx, if set, is the read transaction the query runs in, ended by Close
+	tx *sql.Tx
+}
+
+// ErrInvalidPageLimit is returned by the paged queries when the limit is not positive
+var ErrInvalidPageLimit = errors.New("Page limit must be greater than zero")
+
 func RetrieveRecent(db *sql.DB) ([]TimestampedEvent, error) {
-	return retrieveEvents(db, sqlSelectRecent, "")
+	return retrieveEvents(context.Background(), db, sqlSelectRecent, DefaultTenant, DefaultFeed)
 }
 
 func RetrieveArchive(db *sql.DB, feedid string) ([]TimestampedEvent, error) {
-	return retrieveEvents(db, sqlSelectForFeed, feedid)
+	return retrieveEvents(context.Background(), db, sqlSelectForFeed, DefaultTenant, feedid)
 }
 
-func retrieveEvents(db *sql.DB, query string, feedid string) ([]TimestampedEvent, error) {
+func retrieveEvents(ctx context.Context, q queryer, query string, args ...interface{}) ([]TimestampedEvent, error) {
 	var events []TimestampedEvent
 
-	var rows *sql.Rows
-	var err error
-	if feedid == "" {
-		rows, err = db.Query(query)
-	} else {
-		rows, err = db.Query(query, feedid)
-	}
-
+	rows, err := q.QueryContext(ctx, query, args...)
 	if err != nil {
-		return events, err
+		return events, classifyDBError(err)
 	}
 
 	defer rows.Close()
 
+	for rows.Next() {
+		event, err := scanEvent(rows)
+		if err != nil {
+			return events, classifyDBError(err)
+		}
+
+		events = append(events, event)
+	}
+
+	if err = rows.Err(); err != nil {
+		return events, classifyDBError(err)
+	}
+
+	return events, nil
+}
+
+func scanEvent(rows *sql.Rows, dest ...interface{}) (TimestampedEvent, error) {
 	var eventTime time.Time
 	var aggregateId, typecode string
 	var version int
 	var payload []byte
 
+	dest = append(dest, &eventTime, &aggregateId, &version, &typecode, &payload)
+	if err := rows.Scan(dest...); err != nil {
+		return TimestampedEvent{}, err
+	}
+
+	return TimestampedEvent{
+		Event: goes.Event{
+			Source:   aggregateId,
+			Version:  version,
+			Payload:  payload,
+			TypeCode: typecode,
+		},
+		Timestamp: eventTime,
+	}, nil
+}
+
+// RetrieveRecentPage returns up to limit recent events, newest first, starting after
+// cursor. Use a zero cursor to start with the newest event.
+func RetrieveRecentPage(db *sql.DB, cursor int64, limit int) (EventPage, error) {
+	return retrieveRecentPage(context.Background(), db, DefaultTenant, DefaultFeed, cursor, limit)
+}
+
+func retrieveRecentPage(ctx context.Context, q queryer, tenant, feed string, cursor int64, limit int) (EventPage, error) {
+	if limit <= 0 {
+		return EventPage{}, ErrInvalidPageLimit
+	}
+
+	rows, err := q.QueryContext(ctx, sqlSelectRecentPage, tenant, feed, startCursor(cursor), limit+1)
+	if err != nil {
+		return EventPage{}, classifyDBError(err)
+	}
+
+	return retrievePage(rows, limit)
+}
+
+// RetrieveArchivePage returns up to limit events from an archived feed, newest first,
+// starting after cursor. Use a zero cursor to start with the newest event.
+func RetrieveArchivePage(db *sql.DB, feedid string, cursor int64, limit int) (EventPage, error) {
+	return retrieveArchivePage(context.Background(), db, DefaultTenant, feedid, cursor, limit)
+}
+
+func retrieveArchivePage(ctx context.Context, q queryer, tenant, feedid string, cursor int64, limit int) (EventPage, error) {
+	if limit <= 0 {
+		return EventPage{}, ErrInvalidPageLimit
+	}
+
+	rows, err := q.QueryContext(ctx, sqlSelectFeedPage, tenant, feedid, startCursor(cursor), limit+1)
+	if err != nil {
+		return EventPage{}, classifyDBError(err)
+	}
+
+	return retrievePage(rows, limit)
+}
+
+// startCursor maps the zero cursor to an id greater than any stored event
+func startCursor(cursor int64) int64 {
+	if cursor <= 0 {
+		return math.MaxInt64
+	}
+	return cursor
+}
+
+// retrievePage reads up to limit events from rows. The queries ask for one more row
+// than the limit so we know whether another page follows without an extra round trip.
+func retrievePage(rows *sql.Rows, limit int) (EventPage, error) {
+	defer rows.Close()
+
+	var page EventPage
+	var lastId int64
 	for rows.Next() {
-		err := rows.Scan(&eventTime, &aggregateId, &version, &typecode, &payload)
+		if len(page.Events) == limit {
+			page.NextCursor = lastId
+			break
+		}
+
+		var id int64
+		event, err := scanEvent(rows, &id)
 		if err != nil {
-			return events, err
+			return EventPage{}, classifyDBError(err)
 		}
 
-		event := TimestampedEvent{
-			Event: goes.Event{
-				Source:   aggregateId,
-				Version:  version,
-				Payload:  payload,
-				TypeCode: typecode,
-			},
-			Timestamp: eventTime,
+		lastId = id
+		page.Events = append(page.Events, event)
+	}
+
+	if err := rows.Err(); err != nil {
+		return EventPage{}, classifyDBError(err)
+	}
+
+	return page, nil
+}
+
+// IterateRecent returns an iterator over the recent events, newest first.
+func IterateRecent(db *sql.DB) (*EventIterator, error) {
+	return iterateRecent(context.Background(), db, DefaultTenant, DefaultFeed)
+}
+
+func iterateRecent(ctx context.Context, q queryer, tenant, feed string) (*EventIterator, error) {
+	rows, err := q.QueryContext(ctx, sqlSelectRecent, tenant, feed)
+	if err != nil {
+		return nil, classifyDBError(err)
+	}
+
+	return &EventIterator{rows: rows}, nil
+}
+
+// IterateArchive returns an iterator over the events in an archived feed, newest first.
+func IterateArchive(db *sql.DB, feedid string) (*EventIterator, error) {
+	return iterateArchive(context.Background(), db, DefaultTenant, feedid)
+}
+
+func iterateArchive(ctx context.Context, q queryer, tenant, feedid string) (*EventIterator, error) {
+	rows, err := q.QueryContext(ctx, sqlSelectForFeed, tenant, feedid)
+	if err != nil {
+		return nil, classifyDBError(err)
+	}
+
+	return &EventIterator{rows: rows}, nil
+}
+
+// Next advances to the next event, returning false when there are no more events
+// or an error occurred. Check Err after Next returns false.
+func (it *EventIterator) Next() bool {
+	if it.err != nil || !it.rows.Next() {
+		return false
+	}
+
+	it.event, it.err = scanEvent(it.rows)
+	return it.err == nil
+}
+
+// Event returns the current event
+func (it *EventIterator) Event() TimestampedEvent {
+	return it.event
+}
+
+// Err returns the error, if any, encountered during iteration
+func (it *EventIterator) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	return it.rows.Err()
+}
+
+// Close releases the underlying result set
+func (it *EventIterator) Close() error {
+	err := it.rows.Close()
+	if it.tx != nil {
+		if commitErr := it.tx.Commit(); err == nil {
+			err = commitErr
 		}
+	}
+	return err
+}
 
-		events = append(events, event)
+// RetrieveRecentMetadata returns the cache metadata for the recent page.
+func RetrieveRecentMetadata(db *sql.DB) (FeedMetadata, error) {
+	return retrieveRecentMetadata(context.Background(), db, DefaultTenant, DefaultFeed)
+}
+
+func retrieveRecentMetadata(ctx context.Context, q queryer, tenant, feed string) (FeedMetadata, error) {
+	var count, maxID int64
+	var lastModified time.Time
+	var previous string
+
+	err := q.QueryRowContext(ctx, sqlSelectRecentMetadata, tenant, feed).Scan(&count, &maxID, &lastModified, &previous)
+	if err != nil {
+		return FeedMetadata{}, classifyDBError(err)
 	}
 
-	if err = rows.Err(); err != nil {
-		return events, err
+	//The default feed always exists; a named feed only once it has been written to
+	if feed != DefaultFeed && count == 0 && previous == "" {
+		return FeedMetadata{}, wrapError(ErrFeedNotFound, fmt.Errorf("Feed %s has no events", feed))
 	}
 
-	return events, nil
+	return FeedMetadata{
+		FeedName:       feed,
+		LastModified:   lastModified,
+		ETag:           pageETag("", previous, count, maxID),
+		PreviousFeedID: previous,
+	}, nil
+}
+
+// RetrieveArchiveMetadata returns the cache metadata for an archived page. If the
+// feed does not exist ErrFeedNotFound is returned.
+func RetrieveArchiveMetadata(db *sql.DB, feedid string) (FeedMetadata, error) {
+	return retrieveArchiveMetadata(context.Background(), db, DefaultTenant, feedid)
+}
+
+func retrieveArchiveMetadata(ctx context.Context, q queryer, tenant, feedid string) (FeedMetadata, error) {
+	var count, maxID int64
+	var lastModified time.Time
+	var feed, next string
+
+	err := q.QueryRowContext(ctx, sqlSelectArchiveMetadata, tenant, feedid).Scan(&count, &maxID, &lastModified, &feed, &next)
+	if err == sql.ErrNoRows {
+		return FeedMetadata{}, wrapError(ErrFeedNotFound, err)
+	} else if err != nil {
+		return FeedMetadata{}, classifyDBError(err)
+	}
+
+	return FeedMetadata{
+		FeedName:     feed,
+		FeedID:       feedid,
+		Archived:     true,
+		LastModified: lastModified,
+		ETag:         pageETag(feedid, next, count, maxID),
+		NextFeedID:   next,
+	}, nil
+}
+
+// pageETag derives a strong entity tag for a page. Event ids only ever increase, so
+// the count and max id identify the page events: every insert raises the max id,
+// and a rollover empties the recent page. The linked feed id, the previous page of
+// the recent page or the next page of an archived page, changes at a rollover even
+// when the events do not, such as when the recent page was already empty.
+func pageETag(feedid, linked string, count, maxID int64) string {
+	sum := sha1.Sum([]byte(fmt.Sprintf("%s:%s:%d:%d", feedid, linked, count, maxID)))
+	return fmt.Sprintf(`"%x"`, sum)
 }
 
 func RetrieveLastFeed(db *sql.DB) (string, error) {
+	return retrieveLastFeed(context.Background(), db, DefaultTenant, DefaultFeed)
+}
+
+func retrieveLastFeed(ctx context.Context, q queryer, tenant, feed string) (string, error) {
 	var feedid string
 
-	err := db.QueryRow(sqlLatestFeedId).Scan(&feedid)
+	err := q.QueryRowContext(ctx, sqlLatestFeedId, tenant, feed).Scan(&feedid)
 	if err == sql.ErrNoRows {
 		return "", nil
 	} else if err != nil {
-		return "", err
+		return "", classifyDBError(err)
 	}
 
 	return feedid, nil
 }
 
 func RetrievePreviousFeed(db *sql.DB, id string) (sql.NullString, error) {
+	return retrievePreviousFeed(context.Background(), db, DefaultTenant, id)
+}
+
+func retrievePreviousFeed(ctx context.Context, q queryer, tenant, id string) (sql.NullString, error) {
 	var feedid sql.NullString
 
-	err := db.QueryRow(sqlSelectPreviousFeed, id).Scan(&feedid)
+	err := q.QueryRowContext(ctx, sqlSelectPreviousFeed, tenant, id).Scan(&feedid)
 	if err == sql.ErrNoRows {
 		return feedid, nil
 	} else if err != nil {
-		return feedid, err
+		return feedid, classifyDBError(err)
 	}
 
 	return feedid, nil
 }
 
 func RetrieveNextFeed(db *sql.DB, feedId string) (sql.NullString, error) {
+	return retrieveNextFeed(context.Background(), db, DefaultTenant, feedId)
+}
+
+func retrieveNextFeed(ctx context.Context, q queryer, tenant, feedId string) (sql.NullString, error) {
 	var previous sql.NullString
 
-	err := db.QueryRow(sqlSelectNextFeed, feedId).Scan(&previous)
+	err := q.QueryRowContext(ctx, sqlSelectNextFeed, tenant, feedId).Scan(&previous)
 	if err == sql.ErrNoRows {
 		return previous, nil
 	} else if err != nil {
-		return previous, err
+		return previous, classifyDBError(err)
 	}
 
 	return previous, nil
 }
 
 func RetrieveEvent(db *sql.DB, aggID string, version int) (TimestampedEvent, error) {
+	return retrieveEvent(context.Background(), db, DefaultTenant, aggID, version)
+}
+
+func retrieveEvent(ctx context.Context, q queryer, tenant, aggID string, version int) (TimestampedEvent, error) {
 	var event TimestampedEvent
 
 	var eventTime time.Time
 	var typecode string
 	var payload []byte
 
-	err := db.QueryRow(sqlSelectEvent, aggID, version).Scan(&eventTime, &typecode, &payload)
-	if err != nil {
-		return event, err //Caller can sort out no rows vs other error
+	err := q.QueryRowContext(ctx, sqlSelectEvent, tenant, aggID, version).Scan(&eventTime, &typecode, &payload)
+	if err == sql.ErrNoRows {
+		return event, wrapError(ErrEventNotFound, err)
+	} else if err != nil {
+		return event, classifyDBError(err)
 	}
 
 	event = TimestampedEvent{
@@ -3,6 +3,7 @@ package esatomdatapg
 import (
 	"database/sql"
 	"errors"
+	"math"
 	"testing"
 	"time"
 
@@ -165,7 +166,7 @@ func TestQueryForArchive(t *testing.T) {
 	rows := sqlmock.NewRows([]string{"event_time", "aggregate_id",
 		"version", "typecode", "payload"},
 	).AddRow(ts, "1x2x333", 3, "foo", []byte("yeah ok"))
-	mock.ExpectQuery("select").WithArgs("foo").WillReturnRows(rows)
+	mock.ExpectQuery("select").WithArgs(DefaultTenant, "foo").WillReturnRows(rows)
 
 	events, err := RetrieveArchive(db, "foo")
 	if assert.Nil(t, err) {
@@ -190,7 +191,7 @@ func TestRetrievePreviousFeed(t *testing.T) {
 	defer db.Close()
 
 	rows := sqlmock.NewRows([]string{"previous"}).AddRow("baz")
-	mock.ExpectQuery("select").WithArgs("bar").WillReturnRows(rows)
+	mock.ExpectQuery("select").WithArgs(DefaultTenant, "bar").WillReturnRows(rows)
 	previous, err := RetrievePreviousFeed(db, "bar")
 	if assert.Nil(t, err) && assert.True(t, previous.Valid) {
 		assert.Equal(t, "baz", previous.String)
@@ -205,7 +206,7 @@ func TestRetrievePreviousFeedNoRows(t *testing.T) {
 	defer db.Close()
 
 	rows := sqlmock.NewRows([]string{"previous"})
-	mock.ExpectQuery("select").WithArgs("bar").WillReturnRows(rows)
+	mock.ExpectQuery("select").WithArgs(DefaultTenant, "bar").WillReturnRows(rows)
 	previous, err := RetrievePreviousFeed(db, "bar")
 	assert.Nil(t, err)
 	assert.False(t, previous.Valid)
@@ -218,7 +219,7 @@ func TestRetrievePreviousFeedRowError(t *testing.T) {
 	}
 	defer db.Close()
 
-	mock.ExpectQuery("select").WithArgs("bar").WillReturnError(errors.New("boom"))
+	mock.ExpectQuery("select").WithArgs(DefaultTenant, "bar").WillReturnError(errors.New("boom"))
 	_, err = RetrievePreviousFeed(db, "bar")
 	if assert.NotNil(t, err) {
 		assert.Equal(t, "boom", err.Error())
@@ -233,7 +234,7 @@ func TestRetrieveNextFeed(t *testing.T) {
 	defer db.Close()
 
 	rows := sqlmock.NewRows([]string{"feedid"}).AddRow("foo")
-	mock.ExpectQuery("select").WithArgs("bar").WillReturnRows(rows)
+	mock.ExpectQuery("select").WithArgs(DefaultTenant, "bar").WillReturnRows(rows)
 	next, err := RetrieveNextFeed(db, "bar")
 	if assert.Nil(t, err) && assert.True(t, next.Valid) {
 		assert.Equal(t, "foo", next.String)
@@ -248,7 +249,7 @@ func TestRetrieveNextFeedNoRows(t *testing.T) {
 	defer db.Close()
 
 	rows := sqlmock.NewRows([]string{"feedid"})
-	mock.ExpectQuery("select").WithArgs("bar").WillReturnRows(rows)
+	mock.ExpectQuery("select").WithArgs(DefaultTenant, "bar").WillReturnRows(rows)
 	previous, err := RetrieveNextFeed(db, "bar")
 	assert.Nil(t, err)
 	assert.False(t, previous.Valid)
@@ -261,7 +262,7 @@ func TestRetrieveNextFeedRowError(t *testing.T) {
 	}
 	defer db.Close()
 
-	mock.ExpectQuery("select").WithArgs("bar").WillReturnError(errors.New("boom"))
+	mock.ExpectQuery("select").WithArgs(DefaultTenant, "bar").WillReturnError(errors.New("boom"))
 	_, err = RetrieveNextFeed(db, "bar")
 	if assert.NotNil(t, err) {
 		assert.Equal(t, "boom", err.Error())
@@ -307,6 +308,226 @@ func TestRetrieveEventNoRow(t *testing.T) {
 
 	_, err = RetrieveEvent(db, "1x2x333", 3)
 	if assert.NotNil(t, err) {
-		assert.Equal(t, sql.ErrNoRows, err)
+		assert.True(t, errors.Is(err, ErrEventNotFound))
+		assert.True(t, errors.Is(err, sql.ErrNoRows))
 	}
 }
+
+func TestRetrieveRecentMetadata(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	ts := time.Now()
+	rows := sqlmock.NewRows([]string{"count", "max", "last_modified", "previous"}).AddRow(2, 10, ts, "feed-1")
+	mock.ExpectQuery("select count").WillReturnRows(rows)
+	rows = sqlmock.NewRows([]string{"count", "max", "last_modified", "previous"}).AddRow(3, 11, ts, "feed-1")
+	mock.ExpectQuery("select count").WillReturnRows(rows)
+
+	meta, err := RetrieveRecentMetadata(db)
+	if assert.Nil(t, err) {
+		assert.False(t, meta.Archived)
+		assert.False(t, meta.Final())
+		assert.Equal(t, "", meta.FeedID)
+		assert.Equal(t, "feed-1", meta.PreviousFeedID)
+		assert.Equal(t, ts, meta.LastModified)
+		assert.NotEqual(t, "", meta.ETag)
+	}
+
+	changed, err := RetrieveRecentMetadata(db)
+	if assert.Nil(t, err) {
+		assert.NotEqual(t, meta.ETag, changed.ETag)
+	}
+}
+
+func TestRetrieveEmptyRecentMetadataAcrossRollover(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	//The recent page is empty before rollover N and after rollover N+1
+	ts := time.Now()
+	for _, previous := range []string{"feed-1", "feed-2"} {
+		rows := sqlmock.NewRows([]string{"count", "max", "last_modified", "previous"}).AddRow(0, 0, ts, previous)
+		mock.ExpectQuery("select count").WithArgs(DefaultTenant, DefaultFeed).WillReturnRows(rows)
+	}
+
+	before, err := RetrieveRecentMetadata(db)
+	assert.Nil(t, err)
+	after, err := RetrieveRecentMetadata(db)
+	assert.Nil(t, err)
+	assert.NotEqual(t, before.ETag, after.ETag)
+	assert.Equal(t, "feed-2", after.PreviousFeedID)
+}
+
+func TestRetrieveArchiveMetadata(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	ts := time.Now()
+	rows := sqlmock.NewRows([]string{"count", "max", "last_modified", "feed_name", "next"}).AddRow(2, 10, ts, "customers", "bar")
+	mock.ExpectQuery("select count").WithArgs(DefaultTenant, "foo").WillReturnRows(rows)
+
+	meta, err := RetrieveArchiveMetadata(db, "foo")
+	if assert.Nil(t, err) {
+		assert.True(t, meta.Archived)
+		assert.True(t, meta.Final())
+		assert.Equal(t, "foo", meta.FeedID)
+		assert.Equal(t, "bar", meta.NextFeedID)
+		assert.Equal(t, "customers", meta.FeedName)
+		assert.Equal(t, ts, meta.LastModified)
+		assert.Equal(t, pageETag("foo", "bar", 2, 10), meta.ETag)
+		assert.NotEqual(t, pageETag("foo", "", 2, 10), meta.ETag)
+		assert.NotEqual(t, pageETag("", "bar", 2, 10), meta.ETag)
+	}
+}
+
+func TestRetrieveArchiveMetadataNoFeed(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("select count").WithArgs(DefaultTenant, "foo").WillReturnRows(sqlmock.NewRows([]string{"count", "max", "last_modified", "feed_name", "next"}))
+
+	_, err = RetrieveArchiveMetadata(db, "foo")
+	assert.True(t, errors.Is(err, ErrFeedNotFound))
+}
+
+var pageColumns = []string{"id", "event_time", "aggregate_id", "version", "typecode", "payload"}
+
+func TestRetrieveRecentPage(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	ts := time.Now()
+	rows := sqlmock.NewRows(pageColumns).
+		AddRow(30, ts, "agg3", 1, "foo", []byte("3")).
+		AddRow(20, ts, "agg2", 1, "foo", []byte("2")).
+		AddRow(10, ts, "agg1", 1, "foo", []byte("1"))
+	mock.ExpectQuery("select id").WithArgs(DefaultTenant, DefaultFeed, int64(math.MaxInt64), 3).WillReturnRows(rows)
+
+	page, err := RetrieveRecentPage(db, 0, 2)
+	if assert.Nil(t, err) {
+		assert.Nil(t, mock.ExpectationsWereMet())
+		if assert.Equal(t, 2, len(page.Events)) {
+			assert.Equal(t, "agg3", page.Events[0].Source)
+			assert.Equal(t, "agg2", page.Events[1].Source)
+		}
+		assert.Equal(t, int64(20), page.NextCursor)
+	}
+}
+
+func TestRetrieveRecentPageLastPage(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	rows := sqlmock.NewRows(pageColumns).
+		AddRow(10, time.Now(), "agg1", 1, "foo", []byte("1"))
+	mock.ExpectQuery("select id").WithArgs(DefaultTenant, DefaultFeed, int64(20), 3).WillReturnRows(rows)
+
+	page, err := RetrieveRecentPage(db, 20, 2)
+	if assert.Nil(t, err) {
+		assert.Equal(t, 1, len(page.Events))
+		assert.Equal(t, int64(0), page.NextCursor)
+	}
+}
+
+func TestRetrieveArchivePage(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	rows := sqlmock.NewRows(pageColumns).
+		AddRow(10, time.Now(), "agg1", 1, "foo", []byte("1"))
+	mock.ExpectQuery("select id").WithArgs(DefaultTenant, "feed1", int64(math.MaxInt64), 11).WillReturnRows(rows)
+
+	page, err := RetrieveArchivePage(db, "feed1", 0, 10)
+	if assert.Nil(t, err) {
+		assert.Equal(t, 1, len(page.Events))
+		assert.Equal(t, int64(0), page.NextCursor)
+	}
+}
+
+func TestRetrievePageErrors(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	_, err = RetrieveRecentPage(db, 0, 0)
+	assert.Equal(t, ErrInvalidPageLimit, err)
+	_, err = RetrieveArchivePage(db, "feed1", 0, -1)
+	assert.Equal(t, ErrInvalidPageLimit, err)
+
+	mock.ExpectQuery("select id").WillReturnError(errors.New("boom"))
+	_, err = RetrieveRecentPage(db, 0, 10)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "boom", err.Error())
+	}
+}
+
+func TestIterateRecent(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	ts := time.Now()
+	rows := sqlmock.NewRows([]string{"event_time", "aggregate_id",
+		"version", "typecode", "payload"},
+	).AddRow(ts, "agg2", 1, "foo", []byte("2")).AddRow(ts, "agg1", 1, "foo", []byte("1"))
+	mock.ExpectQuery("select").WillReturnRows(rows)
+
+	it, err := IterateRecent(db)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer it.Close()
+
+	var sources []string
+	for it.Next() {
+		sources = append(sources, it.Event().Source)
+	}
+
+	assert.Nil(t, it.Err())
+	assert.Equal(t, []string{"agg2", "agg1"}, sources)
+}
+
+func TestIterateArchiveScanError(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	rows := sqlmock.NewRows([]string{"feedid"}).AddRow("foo")
+	mock.ExpectQuery("select").WithArgs(DefaultTenant, "feed1").WillReturnRows(rows)
+
+	it, err := IterateArchive(db, "feed1")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer it.Close()
+
+	assert.False(t, it.Next())
+	assert.NotNil(t, it.Err())
+}
@@ -0,0 +1,415 @@
+package atomhttp
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xtracdev/es-atom-data-pg"
+)
+
+const (
+	//NotificationsPath is the path prefix the handler serves
+	NotificationsPath = "/notifications/"
+
+	//RecentPage is the path element used for the recent (not yet archived) feed page
+	RecentPage = "recent"
+
+	atomNamespace     = "http://www.w3.org/2005/Atom"
+	atomContentType   = "application/atom+xml"
+	entryContentType  = "application/atom+xml;type=entry"
+	eventContentType  = "application/octet-stream"
+	feedTitle         = "event feed"
+	feedAuthor        = "es-atom-data-pg"
+	feedIdPrefix      = "urn:esid:feed:"
+	eventIdPrefix     = "urn:esid:event:"
+	relSelf           = "self"
+	relPrevArchive    = "prev-archive"
+	relNextArchive    = "next-archive"
+	atomTimestampForm = time.RFC3339Nano
+	retryAfterSeconds = "5"
+
+	//DefaultArchiveMaxAge is how long clients may cache archived pages that have
+	//a next page, which never change
+	DefaultArchiveMaxAge = 365 * 24 * time.Hour
+
+	//DefaultRecentMaxAge is how long clients may cache the recent page
+	DefaultRecentMaxAge = 10 * time.Second
+)
+
+// Feed is the RFC 4287 representation of a feed page
+type Feed struct {
+	XMLName xml.Name `xml:"feed"`
+	XMLNS   string   `xml:"xmlns,attr"`
+	Title   string   `xml:"title"`
+	ID      string   `xml:"id"`
+	Updated string   `xml:"updated"`
+	Author  *Person  `xml:"author"`
+	Link    []Link   `xml:"link"`
+	Entry   []*Entry `xml:"entry"`
+}
+
+// Entry is the RFC 4287 representation of a single event
+type Entry struct {
+	XMLName  xml.Name  `xml:"entry"`
+	XMLNS    string    `xml:"xmlns,attr,omitempty"`
+	Title    string    `xml:"title"`
+	ID       string    `xml:"id"`
+	Updated  string    `xml:"updated"`
+	Author   *Person   `xml:"author,omitempty"`
+	Link     []Link    `xml:"link"`
+	Category *Category `xml:"category"`
+	Content  *Content  `xml:"content"`
+}
+
+// Link is an atom link element
+type Link struct {
+	Rel  string `xml:"rel,attr"`
+	Href string `xml:"href,attr"`
+}
+
+// Person is an atom person construct
+type Person struct {
+	Name string `xml:"name"`
+}
+
+// Category is an atom category; we use the event type code as the term
+type Category struct {
+	Term string `xml:"term,attr"`
+}
+
+// Content holds the base64 encoded event payload
+type Content struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+// Handler serves the atom feed stored by the AtomDataProcessor. It handles
+// the following resources relative to NotificationsPath:
+//
+//	recent              - events of the default feed not yet archived
+//	{feedname}/recent   - events of a named feed not yet archived
+//	{feedid}            - an archived feed page, of any feed
+//	{aggid}/{version}   - a single event
+//
+// Feed pages carry ETag, Last-Modified and Cache-Control headers, and conditional
+// requests are answered with 304 Not Modified when the page has not changed. The
+// headers and body of a page are read from one snapshot, so the body is the one
+// the ETag identifies. The recent page of a named feed that has never been written
+// to is not found.
+type Handler struct {
+	store   esatomdatapg.Store
+	baseURL string
+
+	//ArchiveMaxAge is the Cache-Control max-age sent with archived pages that
+	//have a next page
+	ArchiveMaxAge time.Duration
+
+	//RecentMaxAge is the Cache-Control max-age sent with the recent page, and
+	//with the latest archived page, whose next-archive link changes at the next
+	//rollover
+	RecentMaxAge time.Duration
+
+	//Logger receives warnings about requests that could not be served
+	Logger esatomdatapg.Logger
+}
+
+// NewHandler returns a handler that reads feed data from store. Queries are
+// bound to the request context, so they are cancelled if the client goes away.
+// A handler serves one tenant; pass a store returned by Store.Tenant to serve
+// a tenant other than the default.
+// Links in the rendered documents are prefixed with baseURL; if baseURL is
+// empty links are derived from the request host.
+func NewHandler(store esatomdatapg.Store, baseURL string) *Handler {
+	return &Handler{
+		store:         store,
+		baseURL:       strings.TrimSuffix(baseURL, "/"),
+		ArchiveMaxAge: DefaultArchiveMaxAge,
+		RecentMaxAge:  DefaultRecentMaxAge,
+		Logger:        esatomdatapg.NewLogrusLogger(nil),
+	}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !strings.HasPrefix(r.URL.Path, NotificationsPath) {
+		http.NotFound(w, r)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, NotificationsPath), "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == RecentPage:
+		h.serveRecent(w, r, esatomdatapg.DefaultFeed)
+	case len(parts) == 1 && parts[0] != "":
+		h.serveArchive(w, r, parts[0])
+	case len(parts) == 2 && parts[1] == RecentPage && parts[0] != "":
+		h.serveRecent(w, r, parts[0])
+	case len(parts) == 2:
+		version, err := strconv.Atoi(parts[1])
+		if err != nil {
+			http.Error(w, "Version must be an integer", http.StatusBadRequest)
+			return
+		}
+		h.serveEvent(w, r, parts[0], version)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *Handler) serveRecent(w http.ResponseWriter, r *http.Request, feedName string) {
+	//The metadata and events are read from one snapshot so the body matches its ETag
+	var meta esatomdatapg.FeedMetadata
+	var events []esatomdatapg.TimestampedEvent
+	err := h.store.Feed(feedName).ReadSnapshot(r.Context(), func(store esatomdatapg.Store) (err error) {
+		meta, err = store.RetrieveRecentMetadata(r.Context())
+		if err != nil || notModified(r, &meta) {
+			return err
+		}
+
+		events, err = store.RetrieveRecent(r.Context())
+		return err
+	})
+	if errors.Is(err, esatomdatapg.ErrFeedNotFound) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		h.serverError(w, "retrieving recent page", err)
+		return
+	}
+
+	if writeCacheHeaders(w, r, &meta, h.RecentMaxAge) {
+		return
+	}
+
+	//The link is taken from the metadata so it matches the ETag
+	base := h.linkBase(r)
+	feed := newFeed(base, recentPath(feedName), events)
+	if meta.PreviousFeedID != "" {
+		feed.Link = append(feed.Link, Link{Rel: relPrevArchive, Href: feedURL(base, meta.PreviousFeedID)})
+	}
+
+	h.writeXML(w, atomContentType, feed)
+}
+
+func (h *Handler) serveArchive(w http.ResponseWriter, r *http.Request, feedid string) {
+	var meta esatomdatapg.FeedMetadata
+	var events []esatomdatapg.TimestampedEvent
+	var previous sql.NullString
+	err := h.store.ReadSnapshot(r.Context(), func(store esatomdatapg.Store) (err error) {
+		meta, err = store.RetrieveArchiveMetadata(r.Context(), feedid)
+		if err != nil || notModified(r, &meta) {
+			return err
+		}
+
+		events, err = store.RetrieveArchive(r.Context(), feedid)
+		if err != nil {
+			return err
+		}
+
+		previous, err = store.RetrievePreviousFeed(r.Context(), feedid)
+		return err
+	})
+	if errors.Is(err, esatomdatapg.ErrFeedNotFound) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		h.serverError(w, "retrieving archived page", err)
+		return
+	}
+
+	//The latest archived page links to the recent page until the next rollover,
+	//so it may only be cached as long as the recent page
+	maxAge := h.ArchiveMaxAge
+	if !meta.Final() {
+		maxAge = h.RecentMaxAge
+	}
+
+	if writeCacheHeaders(w, r, &meta, maxAge) {
+		return
+	}
+
+	base := h.linkBase(r)
+	feed := newFeed(base, feedid, events)
+	if previous.Valid {
+		feed.Link = append(feed.Link, Link{Rel: relPrevArchive, Href: feedURL(base, previous.String)})
+	}
+
+	//The most recently archived page is followed by the recent page
+	if meta.NextFeedID != "" {
+		feed.Link = append(feed.Link, Link{Rel: relNextArchive, Href: feedURL(base, meta.NextFeedID)})
+	} else {
+		feed.Link = append(feed.Link, Link{Rel: relNextArchive, Href: feedURL(base, recentPath(meta.FeedName))})
+	}
+
+	h.writeXML(w, atomContentType, feed)
+}
+
+func (h *Handler) serveEvent(w http.ResponseWriter, r *http.Request, aggID string, version int) {
+	event, err := h.store.RetrieveEvent(r.Context(), aggID, version)
+	if errors.Is(err, esatomdatapg.ErrEventNotFound) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		h.serverError(w, "retrieving event", err)
+		return
+	}
+
+	entry := newEntry(h.linkBase(r), &event)
+	entry.XMLNS = atomNamespace
+	entry.Author = &Person{Name: feedAuthor}
+
+	h.writeXML(w, entryContentType, entry)
+}
+
+// writeCacheHeaders sets the caching headers for a feed page, and returns true
+// if the request was satisfied with a 304 response.
+func writeCacheHeaders(w http.ResponseWriter, r *http.Request, meta *esatomdatapg.FeedMetadata, maxAge time.Duration) bool {
+	w.Header().Set("ETag", meta.ETag)
+	w.Header().Set("Last-Modified", meta.LastModified.UTC().Format(http.TimeFormat))
+	if meta.Final() {
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int64(maxAge.Seconds())))
+	} else {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int64(maxAge.Seconds())))
+	}
+
+	if notModified(r, meta) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+
+	return false
+}
+
+// notModified evaluates the conditional request headers. Per RFC 7232
+// If-Modified-Since is ignored when If-None-Match is present.
+func notModified(r *http.Request, meta *esatomdatapg.FeedMetadata) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == "*" || tag == meta.ETag {
+				return true
+			}
+		}
+		return false
+	}
+
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		t, err := http.ParseTime(ims)
+		if err != nil {
+			return false
+		}
+		return !meta.LastModified.Truncate(time.Second).After(t)
+	}
+
+	return false
+}
+
+// serverError reports a failure to read the feed data. Transient failures are
+// reported as 503 so clients know to retry.
+func (h *Handler) serverError(w http.ResponseWriter, context string, err error) {
+	h.Logger.Warn("Error "+context, esatomdatapg.Fields{esatomdatapg.FieldError: err.Error()})
+	if errors.Is(err, esatomdatapg.ErrTransient) {
+		w.Header().Set("Retry-After", retryAfterSeconds)
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+
+	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+}
+
+func (h *Handler) linkBase(r *http.Request) string {
+	if h.baseURL != "" {
+		return h.baseURL
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	return fmt.Sprintf("%s://%s", scheme, r.Host)
+}
+
+// recentPath is the path of the recent page of the named feed, relative to
+// NotificationsPath
+func recentPath(feedName string) string {
+	if feedName == esatomdatapg.DefaultFeed || feedName == "" {
+		return RecentPage
+	}
+	return feedName + "/" + RecentPage
+}
+
+func feedURL(base, feedid string) string {
+	return base + NotificationsPath + feedid
+}
+
+func eventURL(base, aggID string, version int) string {
+	return fmt.Sprintf("%s%s%s/%d", base, NotificationsPath, aggID, version)
+}
+
+func newFeed(base, feedid string, events []esatomdatapg.TimestampedEvent) *Feed {
+	//Events are ordered newest first, so the first event dates the page
+	updated := time.Now()
+	if len(events) > 0 {
+		updated = events[0].Timestamp
+	}
+
+	feed := &Feed{
+		XMLNS:   atomNamespace,
+		Title:   feedTitle,
+		ID:      feedIdPrefix + feedid,
+		Updated: updated.Format(atomTimestampForm),
+		Author:  &Person{Name: feedAuthor},
+		Link:    []Link{{Rel: relSelf, Href: feedURL(base, feedid)}},
+	}
+
+	for i := range events {
+		feed.Entry = append(feed.Entry, newEntry(base, &events[i]))
+	}
+
+	return feed
+}
+
+func newEntry(base string, event *esatomdatapg.TimestampedEvent) *Entry {
+	var payload []byte
+	if p, ok := event.Payload.([]byte); ok {
+		payload = p
+	}
+
+	return &Entry{
+		Title:    event.TypeCode,
+		ID:       fmt.Sprintf("%s%s:%d", eventIdPrefix, event.Source, event.Version),
+		Updated:  event.Timestamp.Format(atomTimestampForm),
+		Link:     []Link{{Rel: relSelf, Href: eventURL(base, event.Source, event.Version)}},
+		Category: &Category{Term: event.TypeCode},
+		Content: &Content{
+			Type: eventContentType,
+			Body: base64.StdEncoding.EncodeToString(payload),
+		},
+	}
+}
+
+func (h *Handler) writeXML(w http.ResponseWriter, contentType string, doc interface{}) {
+	out, err := xml.Marshal(doc)
+	if err != nil {
+		h.Logger.Warn("Error marshaling atom document", esatomdatapg.Fields{esatomdatapg.FieldError: err.Error()})
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Write([]byte(xml.Header))
+	w.Write(out)
+}
@@ -0,0 +1,561 @@
+package atomhttp
+
+import (
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"github.com/xtracdev/es-atom-data-pg"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+const testBase = "http://testhost"
+
+var eventColumns = []string{"event_time", "aggregate_id", "version", "typecode", "payload"}
+var metadataColumns = []string{"count", "max_id", "last_modified", "previous"}
+var archiveMetadataColumns = []string{"count", "max_id", "last_modified", "feed_name", "next"}
+
+func expectRecentMetadata(mock sqlmock.Sqlmock, previous string, count, maxID int64, lastModified time.Time) {
+	mock.ExpectQuery("select count").WillReturnRows(
+		sqlmock.NewRows(metadataColumns).AddRow(count, maxID, lastModified, previous),
+	)
+}
+
+func expectArchiveMetadata(mock sqlmock.Sqlmock, feedid, next string, count, maxID int64, lastModified time.Time) {
+	expectNamedArchiveMetadata(mock, esatomdatapg.DefaultFeed, feedid, next, count, maxID, lastModified)
+}
+
+func expectNamedArchiveMetadata(mock sqlmock.Sqlmock, feedName, feedid, next string, count, maxID int64, lastModified time.Time) {
+	mock.ExpectQuery("select count").WithArgs(esatomdatapg.DefaultTenant, feedid).WillReturnRows(
+		sqlmock.NewRows(archiveMetadataColumns).AddRow(count, maxID, lastModified, feedName, next),
+	)
+}
+
+func findLink(links []Link, rel string) (string, bool) {
+	for _, l := range links {
+		if l.Rel == rel {
+			return l.Href, true
+		}
+	}
+	return "", false
+}
+
+// warnings records the messages of warnings logged by a handler
+type warnings []string
+
+func (w *warnings) Warn(msg string, fields esatomdatapg.Fields) {
+	*w = append(*w, msg)
+}
+func (w *warnings) Error(msg string, fields esatomdatapg.Fields) {}
+func (w *warnings) Info(msg string, fields esatomdatapg.Fields)  {}
+func (w *warnings) Debug(msg string, fields esatomdatapg.Fields) {}
+
+func serve(h http.Handler, method, path string) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(method, path, nil)
+	h.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestRecent(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	ts := time.Now()
+	mock.ExpectBegin()
+	expectRecentMetadata(mock, "feed-2", 1, 20, ts)
+	mock.ExpectQuery("select event_time").WillReturnRows(
+		sqlmock.NewRows(eventColumns).AddRow(ts, "agg1", 2, "foo", []byte("yeah ok")),
+	)
+	mock.ExpectCommit()
+
+	rr := serve(NewHandler(esatomdatapg.NewPGStore(db), testBase), "GET", "/notifications/recent")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, atomContentType, rr.Header().Get("Content-Type"))
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	var feed Feed
+	if assert.Nil(t, xml.Unmarshal(rr.Body.Bytes(), &feed)) {
+		assert.Equal(t, "urn:esid:feed:recent", feed.ID)
+		self, _ := findLink(feed.Link, relSelf)
+		assert.Equal(t, testBase+"/notifications/recent", self)
+		prev, _ := findLink(feed.Link, relPrevArchive)
+		assert.Equal(t, testBase+"/notifications/feed-2", prev)
+		_, ok := findLink(feed.Link, relNextArchive)
+		assert.False(t, ok)
+
+		if assert.Equal(t, 1, len(feed.Entry)) {
+			entry := feed.Entry[0]
+			assert.Equal(t, "urn:esid:event:agg1:2", entry.ID)
+			assert.Equal(t, "foo", entry.Category.Term)
+			assert.Equal(t, "eWVhaCBvaw==", entry.Content.Body)
+			self, _ := findLink(entry.Link, relSelf)
+			assert.Equal(t, testBase+"/notifications/agg1/2", self)
+		}
+	}
+}
+
+func TestRecentNoArchives(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	expectRecentMetadata(mock, "", 0, 0, time.Now())
+	mock.ExpectQuery("select event_time").WillReturnRows(sqlmock.NewRows(eventColumns))
+	mock.ExpectCommit()
+
+	rr := serve(NewHandler(esatomdatapg.NewPGStore(db), ""), "GET", "/notifications/recent")
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var feed Feed
+	if assert.Nil(t, xml.Unmarshal(rr.Body.Bytes(), &feed)) {
+		self, _ := findLink(feed.Link, relSelf)
+		assert.Equal(t, "http://example.com/notifications/recent", self)
+		_, ok := findLink(feed.Link, relPrevArchive)
+		assert.False(t, ok)
+		assert.Equal(t, 0, len(feed.Entry))
+	}
+}
+
+func TestRecentQueryError(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	expectRecentMetadata(mock, "", 0, 0, time.Now())
+	mock.ExpectQuery("select event_time").WillReturnError(errors.New("boom"))
+	mock.ExpectRollback()
+
+	logger := &warnings{}
+	handler := NewHandler(esatomdatapg.NewPGStore(db), testBase)
+	handler.Logger = logger
+
+	rr := serve(handler, "GET", "/notifications/recent")
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+	assert.Equal(t, warnings{"Error retrieving recent page"}, *logger)
+}
+
+func TestNamedRecent(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	ts := time.Now()
+	mock.ExpectBegin()
+	mock.ExpectQuery("select count").WithArgs(esatomdatapg.DefaultTenant, "customers").WillReturnRows(
+		sqlmock.NewRows(metadataColumns).AddRow(1, 20, ts, "feed-7"),
+	)
+	mock.ExpectQuery("select event_time").WithArgs(esatomdatapg.DefaultTenant, "customers").WillReturnRows(
+		sqlmock.NewRows(eventColumns).AddRow(ts, "cust1", 1, "CustomerCreated", []byte("ok")),
+	)
+	mock.ExpectCommit()
+
+	rr := serve(NewHandler(esatomdatapg.NewPGStore(db), testBase), "GET", "/notifications/customers/recent")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	var feed Feed
+	if assert.Nil(t, xml.Unmarshal(rr.Body.Bytes(), &feed)) {
+		assert.Equal(t, "urn:esid:feed:customers/recent", feed.ID)
+		self, _ := findLink(feed.Link, relSelf)
+		assert.Equal(t, testBase+"/notifications/customers/recent", self)
+		prev, _ := findLink(feed.Link, relPrevArchive)
+		assert.Equal(t, testBase+"/notifications/feed-7", prev)
+		assert.Equal(t, 1, len(feed.Entry))
+	}
+}
+
+func TestArchive(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	expectArchiveMetadata(mock, "feed-2", "feed-3", 1, 10, time.Now())
+	mock.ExpectQuery("select event_time").WithArgs(esatomdatapg.DefaultTenant, "feed-2").WillReturnRows(
+		sqlmock.NewRows(eventColumns).AddRow(time.Now(), "agg1", 1, "foo", []byte("ok")),
+	)
+	mock.ExpectQuery("select previous from t_aefd_feed").WithArgs(esatomdatapg.DefaultTenant, "feed-2").WillReturnRows(
+		sqlmock.NewRows([]string{"previous"}).AddRow("feed-1"),
+	)
+	mock.ExpectCommit()
+
+	rr := serve(NewHandler(esatomdatapg.NewPGStore(db), testBase), "GET", "/notifications/feed-2")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	var feed Feed
+	if assert.Nil(t, xml.Unmarshal(rr.Body.Bytes(), &feed)) {
+		self, _ := findLink(feed.Link, relSelf)
+		assert.Equal(t, testBase+"/notifications/feed-2", self)
+		prev, _ := findLink(feed.Link, relPrevArchive)
+		assert.Equal(t, testBase+"/notifications/feed-1", prev)
+		next, _ := findLink(feed.Link, relNextArchive)
+		assert.Equal(t, testBase+"/notifications/feed-3", next)
+	}
+}
+
+func TestLatestArchiveLinksToRecent(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	expectArchiveMetadata(mock, "feed-1", "", 1, 5, time.Now())
+	mock.ExpectQuery("select event_time").WithArgs(esatomdatapg.DefaultTenant, "feed-1").WillReturnRows(
+		sqlmock.NewRows(eventColumns).AddRow(time.Now(), "agg1", 1, "foo", []byte("ok")),
+	)
+	mock.ExpectQuery("select previous from t_aefd_feed").WithArgs(esatomdatapg.DefaultTenant, "feed-1").WillReturnRows(
+		sqlmock.NewRows([]string{"previous"}).AddRow(nil),
+	)
+	mock.ExpectCommit()
+
+	rr := serve(NewHandler(esatomdatapg.NewPGStore(db), testBase), "GET", "/notifications/feed-1")
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var feed Feed
+	if assert.Nil(t, xml.Unmarshal(rr.Body.Bytes(), &feed)) {
+		_, ok := findLink(feed.Link, relPrevArchive)
+		assert.False(t, ok)
+		next, _ := findLink(feed.Link, relNextArchive)
+		assert.Equal(t, testBase+"/notifications/recent", next)
+	}
+}
+
+func TestLatestNamedArchiveLinksToNamedRecent(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	expectNamedArchiveMetadata(mock, "customers", "feed-7", "", 1, 5, time.Now())
+	mock.ExpectQuery("select event_time").WithArgs(esatomdatapg.DefaultTenant, "feed-7").WillReturnRows(
+		sqlmock.NewRows(eventColumns).AddRow(time.Now(), "cust1", 1, "CustomerCreated", []byte("ok")),
+	)
+	mock.ExpectQuery("select previous from t_aefd_feed").WithArgs(esatomdatapg.DefaultTenant, "feed-7").WillReturnRows(
+		sqlmock.NewRows([]string{"previous"}).AddRow(nil),
+	)
+	mock.ExpectCommit()
+
+	rr := serve(NewHandler(esatomdatapg.NewPGStore(db), testBase), "GET", "/notifications/feed-7")
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var feed Feed
+	if assert.Nil(t, xml.Unmarshal(rr.Body.Bytes(), &feed)) {
+		next, _ := findLink(feed.Link, relNextArchive)
+		assert.Equal(t, testBase+"/notifications/customers/recent", next)
+	}
+}
+
+func TestArchiveCacheHeaders(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	lastModified := time.Date(2017, 5, 1, 10, 0, 0, 0, time.UTC)
+	mock.ExpectBegin()
+	expectArchiveMetadata(mock, "feed-1", "feed-2", 1, 5, lastModified)
+	mock.ExpectQuery("select event_time").WithArgs(esatomdatapg.DefaultTenant, "feed-1").WillReturnRows(
+		sqlmock.NewRows(eventColumns).AddRow(lastModified, "agg1", 1, "foo", []byte("ok")),
+	)
+	mock.ExpectQuery("select previous from t_aefd_feed").WithArgs(esatomdatapg.DefaultTenant, "feed-1").WillReturnRows(
+		sqlmock.NewRows([]string{"previous"}).AddRow(nil),
+	)
+	mock.ExpectCommit()
+
+	rr := serve(NewHandler(esatomdatapg.NewPGStore(db), testBase), "GET", "/notifications/feed-1")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.NotEqual(t, "", rr.Header().Get("ETag"))
+	assert.Equal(t, "Mon, 01 May 2017 10:00:00 GMT", rr.Header().Get("Last-Modified"))
+	assert.Equal(t, "public, max-age=31536000", rr.Header().Get("Cache-Control"))
+}
+
+func TestLatestArchiveCacheHeaders(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	expectArchiveMetadata(mock, "feed-1", "", 1, 5, time.Now())
+	mock.ExpectQuery("select event_time").WithArgs(esatomdatapg.DefaultTenant, "feed-1").WillReturnRows(
+		sqlmock.NewRows(eventColumns).AddRow(time.Now(), "agg1", 1, "foo", []byte("ok")),
+	)
+	mock.ExpectQuery("select previous from t_aefd_feed").WithArgs(esatomdatapg.DefaultTenant, "feed-1").WillReturnRows(
+		sqlmock.NewRows([]string{"previous"}).AddRow(nil),
+	)
+
+	//The next-archive link changes at the next rollover
+	mock.ExpectCommit()
+
+	rr := serve(NewHandler(esatomdatapg.NewPGStore(db), testBase), "GET", "/notifications/feed-1")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "max-age=10", rr.Header().Get("Cache-Control"))
+}
+
+func TestLatestArchiveModifiedByRollover(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	lastModified := time.Now()
+	expectArchiveMetadata(mock, "feed-1", "", 1, 5, lastModified)
+	meta, err := esatomdatapg.RetrieveArchiveMetadata(db, "feed-1")
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	//feed-2 is archived after feed-1 without changing its events
+	mock.ExpectBegin()
+	expectArchiveMetadata(mock, "feed-1", "feed-2", 1, 5, lastModified)
+	mock.ExpectQuery("select event_time").WithArgs(esatomdatapg.DefaultTenant, "feed-1").WillReturnRows(
+		sqlmock.NewRows(eventColumns).AddRow(lastModified, "agg1", 1, "foo", []byte("ok")),
+	)
+	mock.ExpectQuery("select previous from t_aefd_feed").WithArgs(esatomdatapg.DefaultTenant, "feed-1").WillReturnRows(
+		sqlmock.NewRows([]string{"previous"}).AddRow(nil),
+	)
+	mock.ExpectCommit()
+
+	req := httptest.NewRequest("GET", "/notifications/feed-1", nil)
+	req.Header.Set("If-None-Match", meta.ETag)
+	rr := httptest.NewRecorder()
+	NewHandler(esatomdatapg.NewPGStore(db), testBase).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.NotEqual(t, meta.ETag, rr.Header().Get("ETag"))
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	var feed Feed
+	if assert.Nil(t, xml.Unmarshal(rr.Body.Bytes(), &feed)) {
+		next, _ := findLink(feed.Link, relNextArchive)
+		assert.Equal(t, testBase+"/notifications/feed-2", next)
+	}
+}
+
+func TestEmptyRecentModifiedByRollover(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	lastModified := time.Now()
+	expectRecentMetadata(mock, "feed-1", 0, 0, lastModified)
+	meta, err := esatomdatapg.RetrieveRecentMetadata(db)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	//The page was empty before and after feed-2 was archived
+	mock.ExpectBegin()
+	expectRecentMetadata(mock, "feed-2", 0, 0, lastModified)
+	mock.ExpectQuery("select event_time").WillReturnRows(sqlmock.NewRows(eventColumns))
+	mock.ExpectCommit()
+
+	req := httptest.NewRequest("GET", "/notifications/recent", nil)
+	req.Header.Set("If-None-Match", meta.ETag)
+	rr := httptest.NewRecorder()
+	NewHandler(esatomdatapg.NewPGStore(db), testBase).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	var feed Feed
+	if assert.Nil(t, xml.Unmarshal(rr.Body.Bytes(), &feed)) {
+		prev, _ := findLink(feed.Link, relPrevArchive)
+		assert.Equal(t, testBase+"/notifications/feed-2", prev)
+	}
+}
+
+func TestArchiveNotModified(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	expectArchiveMetadata(mock, "feed-1", "feed-2", 1, 5, time.Now())
+	meta, err := esatomdatapg.RetrieveArchiveMetadata(db, "feed-1")
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	mock.ExpectBegin()
+	expectArchiveMetadata(mock, "feed-1", "feed-2", 1, 5, time.Now())
+	mock.ExpectCommit()
+
+	//Only the metadata query is expected; the page is not loaded
+	req := httptest.NewRequest("GET", "/notifications/feed-1", nil)
+	req.Header.Set("If-None-Match", `"nomatch", W/`+meta.ETag)
+	rr := httptest.NewRecorder()
+	NewHandler(esatomdatapg.NewPGStore(db), testBase).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNotModified, rr.Code)
+	assert.Equal(t, 0, rr.Body.Len())
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestRecentNotModifiedSince(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	lastModified := time.Date(2017, 5, 1, 10, 0, 0, 500, time.UTC)
+	mock.ExpectBegin()
+	expectRecentMetadata(mock, "", 3, 20, lastModified)
+	mock.ExpectCommit()
+
+	req := httptest.NewRequest("GET", "/notifications/recent", nil)
+	req.Header.Set("If-Modified-Since", "Mon, 01 May 2017 10:00:00 GMT")
+	rr := httptest.NewRecorder()
+	NewHandler(esatomdatapg.NewPGStore(db), testBase).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNotModified, rr.Code)
+	assert.Equal(t, "max-age=10", rr.Header().Get("Cache-Control"))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestRecentModifiedSince(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	lastModified := time.Date(2017, 5, 1, 10, 0, 1, 0, time.UTC)
+	mock.ExpectBegin()
+	expectRecentMetadata(mock, "", 3, 20, lastModified)
+	mock.ExpectQuery("select event_time").WillReturnRows(sqlmock.NewRows(eventColumns))
+	mock.ExpectCommit()
+
+	req := httptest.NewRequest("GET", "/notifications/recent", nil)
+	req.Header.Set("If-Modified-Since", "Mon, 01 May 2017 10:00:00 GMT")
+	rr := httptest.NewRecorder()
+	NewHandler(esatomdatapg.NewPGStore(db), testBase).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestArchiveNotFound(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("select count").WithArgs(esatomdatapg.DefaultTenant, "nope").WillReturnRows(sqlmock.NewRows(archiveMetadataColumns))
+	mock.ExpectRollback()
+
+	rr := serve(NewHandler(esatomdatapg.NewPGStore(db), testBase), "GET", "/notifications/nope")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestNamedRecentNotFound(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("select count").WithArgs(esatomdatapg.DefaultTenant, "nope").WillReturnRows(
+		sqlmock.NewRows(metadataColumns).AddRow(0, 0, time.Now(), ""),
+	)
+	mock.ExpectRollback()
+
+	rr := serve(NewHandler(esatomdatapg.NewPGStore(db), testBase), "GET", "/notifications/nope/recent")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestEvent(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("select event_time").WithArgs(esatomdatapg.DefaultTenant, "agg1", 3).WillReturnRows(
+		sqlmock.NewRows([]string{"event_time", "typecode", "payload"}).AddRow(time.Now(), "foo", []byte("ok")),
+	)
+
+	rr := serve(NewHandler(esatomdatapg.NewPGStore(db), testBase), "GET", "/notifications/agg1/3")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, entryContentType, rr.Header().Get("Content-Type"))
+
+	var entry Entry
+	if assert.Nil(t, xml.Unmarshal(rr.Body.Bytes(), &entry)) {
+		assert.Equal(t, "urn:esid:event:agg1:3", entry.ID)
+		assert.Equal(t, "foo", entry.Title)
+	}
+}
+
+func TestEventNotFound(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("select event_time").WithArgs(esatomdatapg.DefaultTenant, "agg1", 3).WillReturnRows(
+		sqlmock.NewRows([]string{"event_time", "typecode", "payload"}),
+	)
+
+	rr := serve(NewHandler(esatomdatapg.NewPGStore(db), testBase), "GET", "/notifications/agg1/3")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestBadRequests(t *testing.T) {
+	db, _, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	h := NewHandler(esatomdatapg.NewPGStore(db), testBase)
+	assert.Equal(t, http.StatusBadRequest, serve(h, "GET", "/notifications/agg1/three").Code)
+	assert.Equal(t, http.StatusNotFound, serve(h, "GET", "/notifications/a/b/c").Code)
+	assert.Equal(t, http.StatusNotFound, serve(h, "GET", "/notifications/").Code)
+	assert.Equal(t, http.StatusNotFound, serve(h, "GET", "/other").Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, serve(h, "POST", "/notifications/recent").Code)
+}
+
+func TestEventTransientError(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("select event_time").WithArgs(esatomdatapg.DefaultTenant, "agg1", 3).WillReturnError(&pq.Error{Code: "57P01"})
+
+	rr := serve(NewHandler(esatomdatapg.NewPGStore(db), testBase), "GET", "/notifications/agg1/3")
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Equal(t, "5", rr.Header().Get("Retry-After"))
+}
@@ -1,6 +1,8 @@
 package esatomdatapg
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
 	"database/sql"
 	"errors"
@@ -8,71 +10,227 @@ import (
 	"strconv"
 	"time"
 
-	log "github.com/Sirupsen/logrus"
+	"github.com/lib/pq"
 	"github.com/xtracdev/envinject"
 	"github.com/xtracdev/goes"
-	"github.com/xtracdev/pgpublish"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 const (
-	sqlLatestFeedId        = `select feedid from t_aefd_feed where id = (select max(id) from t_aefd_feed)`
-	sqlInsertEventIntoFeed = `insert into t_aeae_atom_event (aggregate_id, version,typecode, payload, event_time) values($1,$2,$3,$4,$5)`
-	sqlRecentFeedCount     = `select count(*) from t_aeae_atom_event where feedid is null`
+	sqlLatestFeedId        = `select feedid from t_aefd_feed where id = (select max(id) from t_aefd_feed where tenant = $1 and feed_name = $2)`
+	sqlInsertEventIntoFeed = `insert into t_aeae_atom_event (aggregate_id, version,typecode, payload, event_time, feed_name, tenant) values($1,$2,$3,$4,$5,$6,$7) on conflict (tenant, aggregate_id, version) do nothing`
+	sqlSelectStoredEvent   = `select typecode, payload from t_aeae_atom_event where tenant = $1 and aggregate_id = $2 and version = $3`
+	sqlRecentFeedCount     = `select count(*) from t_aeae_atom_event where tenant = $1 and feed_name = $2 and feedid is null`
 	defaultFeedThreshold   = 100
-	sqlUpdateFeedIds       = `update t_aeae_atom_event set feedid = $1 where feedid is null`
-	sqlInsertFeed          = `insert into t_aefd_feed (feedid, previous) values ($1, $2)`
+	sqlUpdateFeedIds       = `update t_aeae_atom_event set feedid = $1 where tenant = $2 and feed_name = $3 and feedid is null`
+	sqlInsertFeed          = `insert into t_aefd_feed (feedid, previous, feed_name, tenant) values ($1, $2, $3, $4)`
 	EnvFeedThreshold       = "FEED_THRESHOLD"
+
+	//Set to true to include event payloads in debug logging. Payloads are
+	//never logged otherwise.
+	EnvLogPayloads = "LOG_PAYLOADS"
+
+	//Number of times a write failing with a transient error is retried before
+	//the error is returned
+	EnvTransientRetries     = "TRANSIENT_RETRIES"
+	defaultTransientRetries = 3
+
+	//Transaction scoped advisory lock used to serialize writers across processor
+	//instances. The key is arbitrary but must be the same for all writers of the
+	//default feed; the keys of named feeds are derived from it.
+	sqlLockFeed       = `select pg_advisory_xact_lock($1)`
+	feedLockKey int64 = 4242170425
+
+	sqlSetSearchPath = `set local search_path to `
 )
 
+// Outcome describes what happened when the processor wrote an event
+type Outcome int
+
+const (
+	//Failed means the event was not stored; the accompanying error says why. It is
+	//the zero value, so an outcome that was never set does not claim success.
+	Failed Outcome = iota
+
+	//Inserted means the event was new and has been stored
+	Inserted
+
+	//DuplicateIdentical means the event was already stored with the same content,
+	//typically because a message was delivered more than once. Safe to acknowledge.
+	DuplicateIdentical
+
+	//DuplicateConflicting means a different event was already stored with the same
+	//aggregate id and version. This indicates a problem upstream.
+	DuplicateConflicting
+)
+
+func (o Outcome) String() string {
+	switch o {
+	case Failed:
+		return "Failed"
+	case Inserted:
+		return "Inserted"
+	case DuplicateIdentical:
+		return "DuplicateIdentical"
+	case DuplicateConflicting:
+		return "DuplicateConflicting"
+	default:
+		return fmt.Sprintf("Outcome(%d)", int(o))
+	}
+}
+
 type AtomDataProcessor struct {
-	db            *sql.DB
-	env           *envinject.InjectedEnv
-	feedThreshold int
+	env              *envinject.InjectedEnv
+	feedThreshold    int
+	maxPageAge       time.Duration
+	maxPageBytes     int64
+	policy           RolloverPolicy
+	routes           []FeedRoute
+	tenantResolver   TenantResolver
+	transientRetries int
+	retryPolicy      BackoffPolicy
+	metrics          Metrics
+	logger           Logger
+	logPayloads      bool
+	now              func() time.Time
+	newID            IDGenerator
+
+	//schema, if set, qualifies the feed tables; lockKey serializes writers of
+	//the feed tables in that schema
+	schema  string
+	lockKey int64
+
+	db *sql.DB
 }
 
-func NewAtomDataProcessor(db *sql.DB, env *envinject.InjectedEnv) (*AtomDataProcessor, error) {
-	if env == nil {
-		return nil, errors.New("Nil injected env")
-	}
+// NewAtomDataProcessor returns a processor configured from the environment and then
+// opts; it is New with WithEnv followed by opts.
+func NewAtomDataProcessor(db *sql.DB, env *envinject.InjectedEnv, opts ...Option) (*AtomDataProcessor, error) {
+	return New(db, append([]Option{WithEnv(env)}, opts...)...)
+}
+
+// retryTransient calls op until it succeeds, fails with an error that is neither
+// transient nor a lost connection, or the retries are used up, backing off between
+// attempts. A lost connection is retried however op classified it, and returned
+// as ErrTransient once the retries are used up. database/sql discards the lost
+// connection, so the retry runs on a new connection from the pool.
+func (adp *AtomDataProcessor) retryTransient(ctx context.Context, op func() error) error {
+	backoff := NewBackoff(adp.retryPolicy)
+	for attempt := 0; ; attempt++ {
+		err := op()
+		if err == nil {
+			return nil
+		}
+
+		lost := isConnectionError(err)
+		if lost && !errors.Is(err, ErrTransient) {
+			err = wrapError(ErrTransient, err)
+		}
+
+		if !errors.Is(err, ErrTransient) || attempt >= adp.transientRetries {
+			return err
+		}
 
-	threshold := readFeedThresholdFromEnv(env)
+		if lost {
+			adp.logger.Warn("Database connection lost, retrying on a new connection", errorFields(Fields{}, err))
+		}
 
-	return &AtomDataProcessor{
-		db:            db,
-		env:           env,
-		feedThreshold: threshold,
-	}, nil
+		delay := backoff.Next()
+		adp.logger.Warn("Transient error, retrying", errorFields(Fields{"delay": delay.String()}, err))
+		adp.metrics.TransientRetry()
+		if sleep(ctx, delay) != nil {
+			return err
+		}
+	}
 }
 
+// ProcessMessage writes the pgpublish encoded event in msg to the atom event table.
+// Redelivery of an event that is already stored is not an error; an event that
+// conflicts with a stored event returns ErrDuplicateEvent. Other errors are
+// ErrDecode for messages that cannot be decoded, ErrRollover if the feed could not
+// be rolled over, and ErrTransient for database errors that may succeed on retry.
 func (adp *AtomDataProcessor) ProcessMessage(msg string) error {
-	log.Infof("process message %s", msg)
+	return adp.ProcessMessageContext(context.Background(), msg)
+}
 
-	var aggId, typecode string
-	var version int
-	var payload []byte
-	var err error
-	var timestamp time.Time
+// ProcessMessageContext is ProcessMessage with a context; cancelling the context
+// rolls back the transaction writing the event.
+func (adp *AtomDataProcessor) ProcessMessageContext(ctx context.Context, msg string) error {
+	_, err := adp.ProcessMessageOutcome(ctx, msg)
+	return err
+}
 
-	aggId, version, payload, typecode, timestamp, err = pgpublish.DecodePGEvent(msg)
+// ProcessMessageOutcome is ProcessMessageContext, also reporting whether the event
+// was inserted or was a duplicate of a stored event.
+func (adp *AtomDataProcessor) ProcessMessageOutcome(ctx context.Context, msg string) (Outcome, error) {
+	ctx, span := tracer.Start(ctx, "ProcessMessage")
+	defer span.End()
+
+	event, timestamp, err := decodeEvent(ctx, msg)
 	if err != nil {
-		return err
+		adp.logger.Warn("Unable to decode message", errorFields(Fields{}, err))
+		recordSpanError(span, err)
+		return Failed, err
 	}
+	adp.logEvent(&event)
 
-	event := goes.Event{
-		Source:   aggId,
-		Version:  version,
-		Payload:  payload,
-		TypeCode: typecode,
+	tenant, err := adp.resolveTenant(ctx, &event)
+	if err != nil {
+		adp.logger.Warn("Unable to resolve tenant", errorFields(eventFields(&event), err))
+		recordSpanError(span, err)
+		return Failed, err
 	}
 
-	return adp.processEvent(&event, timestamp)
+	feed := feedRef{tenant: tenant, name: adp.route(&event)}
+	span.SetAttributes(attribute.String("tenant", feed.tenant), attribute.String("feed.name", feed.name))
+
+	var outcome Outcome
+	err = adp.retryTransient(ctx, func() error {
+		var err error
+		outcome, err = adp.processEvent(ctx, feed, &event, timestamp)
+		return err
+	})
+
+	adp.recordStored(outcome, err)
+	span.SetAttributes(attribute.String("outcome", outcome.String()))
+	recordSpanError(span, err)
+	return outcome, err
 }
 
-func selectLatestFeed(tx *sql.Tx) (sql.NullString, error) {
-	log.Debug("Select last feed id")
+// beginFeedTx starts a transaction writing the feed tables, with the search path
+// set to the processor's schema, if any, and the locks of feeds held. Without the
+// lock concurrent processors can read the same latest feed and recent count, which
+// leads to missed rollovers or two feeds claiming the same previous feed. Callers
+// locking several feeds must pass them in the order of sortFeedRefs so they cannot
+// deadlock.
+func (adp *AtomDataProcessor) beginFeedTx(ctx context.Context, feeds ...feedRef) (*sql.Tx, error) {
+	tx, err := adp.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if adp.schema != "" {
+		_, err = tx.ExecContext(ctx, sqlSetSearchPath+pq.QuoteIdentifier(adp.schema))
+		if err != nil {
+			adp.doRollback(tx)
+			return nil, err
+		}
+	}
+
+	for _, feed := range feeds {
+		_, err = tx.ExecContext(ctx, sqlLockFeed, adp.lockKeyFor(feed))
+		if err != nil {
+			adp.doRollback(tx)
+			return nil, err
+		}
+	}
+
+	return tx, nil
+}
 
+func selectLatestFeed(ctx context.Context, tx *sql.Tx, feed feedRef) (sql.NullString, error) {
 	var feedid sql.NullString
-	rows, err := tx.Query(sqlLatestFeedId)
+	rows, err := tx.QueryContext(ctx, sqlLatestFeedId, feed.tenant, feed.name)
 	if err != nil {
 		return feedid, err
 	}
@@ -92,25 +250,71 @@ func selectLatestFeed(tx *sql.Tx) (sql.NullString, error) {
 	return feedid, nil
 }
 
-func doRollback(tx *sql.Tx) {
+func (adp *AtomDataProcessor) doRollback(tx *sql.Tx) {
 	err := tx.Rollback()
 	if err != nil {
-		log.Warnf("Error on transaction rollback: %s", err.Error())
+		adp.logger.Warn("Error on transaction rollback", errorFields(Fields{}, err))
 	}
 }
 
-func writeEventToAtomEventTable(tx *sql.Tx, event *goes.Event, ts time.Time) error {
-	log.Debug("insert event into atom_event")
-	_, err := tx.Exec(sqlInsertEventIntoFeed,
-		event.Source, event.Version, event.TypeCode, event.Payload, ts)
-	return err
+// writeEventToAtomEventTable inserts the event unless an event with the same aggregate
+// id and version is already stored, in which case the stored event is compared with
+// the event to determine the outcome.
+func (adp *AtomDataProcessor) writeEventToAtomEventTable(ctx context.Context, tx *sql.Tx, feed feedRef, event *goes.Event, ts time.Time) (outcome Outcome, err error) {
+	ctx, span := tracer.Start(ctx, "writeEventToAtomEventTable", eventAttributes(event))
+	defer func() {
+		span.SetAttributes(attribute.String("outcome", outcome.String()))
+		endSpan(span, err)
+	}()
+
+	result, err := tx.ExecContext(ctx, sqlInsertEventIntoFeed,
+		event.Source, event.Version, event.TypeCode, event.Payload, ts, feed.name, feed.tenant)
+	if err != nil {
+		return Failed, classifyDBError(err)
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return Failed, classifyDBError(err)
+	}
+
+	if rows > 0 {
+		return Inserted, nil
+	}
+
+	adp.logger.Info("Event already stored", eventFields(event))
+	return adp.compareWithStoredEvent(ctx, tx, feed.tenant, event)
 }
 
-func getRecentFeedCount(tx *sql.Tx) (int, error) {
-	log.Debug("get current count")
+func (adp *AtomDataProcessor) compareWithStoredEvent(ctx context.Context, tx *sql.Tx, tenant string, event *goes.Event) (Outcome, error) {
+	var typecode string
+	var payload []byte
+
+	err := tx.QueryRowContext(ctx, sqlSelectStoredEvent, tenant, event.Source, event.Version).Scan(&typecode, &payload)
+	if err != nil {
+		return DuplicateConflicting, classifyDBError(err)
+	}
+
+	eventPayload, _ := event.Payload.([]byte)
+	if typecode == event.TypeCode && bytes.Equal(payload, eventPayload) {
+		return DuplicateIdentical, nil
+	}
+
+	fields := eventFields(event)
+	fields["stored_typecode"] = typecode
+	adp.logger.Error("Event conflicts with the stored event", fields)
+	return DuplicateConflicting, wrapError(ErrDuplicateEvent,
+		fmt.Errorf("aggregate %s version %d", event.Source, event.Version))
+}
+
+func (adp *AtomDataProcessor) getRecentFeedCount(ctx context.Context, tx *sql.Tx, feed feedRef) (int, error) {
+	ctx, span := tracer.Start(ctx, "getRecentFeedCount")
+
 	var count int
-	err := tx.QueryRow(sqlRecentFeedCount).Scan(&count)
+	err := tx.QueryRowContext(ctx, sqlRecentFeedCount, feed.tenant, feed.name).Scan(&count)
 
+	span.SetAttributes(attribute.Int("feed.recent_count", count))
+	endSpan(span, err)
 	return count, err
 }
 
@@ -125,30 +329,66 @@ func uuid() (string, error) {
 
 }
 
-func readFeedThresholdFromEnv(env *envinject.InjectedEnv) int {
+func readTransientRetriesFromEnv(env *envinject.InjectedEnv) (int, error) {
+	retries := env.Getenv(EnvTransientRetries)
+	if retries == "" {
+		return defaultTransientRetries, nil
+	}
+
+	n, err := strconv.Atoi(retries)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be an integer, got %q", EnvTransientRetries, retries)
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("%s must not be negative, got %d", EnvTransientRetries, n)
+	}
+
+	return n, nil
+}
+
+func readFeedThresholdFromEnv(env *envinject.InjectedEnv) (int, error) {
 	thresholdOverride := env.Getenv(EnvFeedThreshold)
 	if thresholdOverride == "" {
-		return defaultFeedThreshold
+		return defaultFeedThreshold, nil
 	}
 
 	override, err := strconv.Atoi(thresholdOverride)
 	if err != nil {
-		log.Warnf("Attempted to override threshold with non integer: %s", thresholdOverride)
-		log.Warnf("Defaulting to %d", defaultFeedThreshold)
-		return defaultFeedThreshold
+		return 0, fmt.Errorf("%s must be an integer, got %q", EnvFeedThreshold, thresholdOverride)
+	}
+	if override <= 0 {
+		return 0, fmt.Errorf("%s must be positive, got %d", EnvFeedThreshold, override)
+	}
+
+	return override, nil
+}
+
+func readLogPayloadsFromEnv(env *envinject.InjectedEnv, logger Logger) bool {
+	value := env.Getenv(EnvLogPayloads)
+	if value == "" {
+		return false
 	}
 
-	log.Infof("Overriding default feed threshold with %d", override)
-	return override
+	logPayloads, err := strconv.ParseBool(value)
+	if err != nil {
+		logger.Warn("Invalid payload logging setting, payloads will not be logged",
+			Fields{EnvLogPayloads: value})
+		return false
+	}
 
+	return logPayloads
 }
 
-func createNewFeed(tx *sql.Tx, currentFeedId sql.NullString) error {
+// createNewFeed assigns the recent events of feed to a new feed page following
+// currentFeedId, returning the new feed id.
+func (adp *AtomDataProcessor) createNewFeed(ctx context.Context, tx *sql.Tx, feed feedRef, currentFeedId sql.NullString) (_ sql.NullString, err error) {
+	ctx, span := tracer.Start(ctx, "createNewFeed")
+	defer func() { endSpan(span, err) }()
 
 	var prevFeedId sql.NullString
-	uuidStr, err := uuid()
+	uuidStr, err := adp.newID()
 	if err != nil {
-		return err
+		return currentFeedId, err
 	}
 
 	if currentFeedId.Valid {
@@ -156,72 +396,87 @@ func createNewFeed(tx *sql.Tx, currentFeedId sql.NullString) error {
 
 	}
 	currentFeedId = sql.NullString{String: uuidStr, Valid: true}
+	span.SetAttributes(
+		attribute.String("tenant", feed.tenant),
+		attribute.String("feed.name", feed.name),
+		attribute.String("feed.id", currentFeedId.String),
+		attribute.String("feed.previous", prevFeedId.String),
+	)
 
-	log.Info("Update feed ids")
+	adp.logger.Info("Create new feed",
+		Fields{FieldTenant: feed.tenant, FieldFeedName: feed.name,
+			FieldFeedID: currentFeedId.String, FieldPreviousFeedID: prevFeedId.String})
 
-	_, err = tx.Exec(sqlUpdateFeedIds, currentFeedId)
+	_, err = tx.ExecContext(ctx, sqlUpdateFeedIds, currentFeedId, feed.tenant, feed.name)
 
 	if err != nil {
-		return err
+		return currentFeedId, err
 	}
 
-	log.Infof("Insert into feed %v, %v", currentFeedId, prevFeedId)
-	_, err = tx.Exec(sqlInsertFeed,
-		currentFeedId, prevFeedId)
-	return err
+	_, err = tx.ExecContext(ctx, sqlInsertFeed,
+		currentFeedId, prevFeedId, feed.name, feed.tenant)
+	return currentFeedId, err
 }
 
-func (adp *AtomDataProcessor) processEvent(event *goes.Event, ts time.Time) error {
-	log.Debugf("process event: %v", event)
-
-	log.Debug("Processor invoked")
-
-	//Need a transaction to group the work in this method
-	log.Debug("create transaction")
-	tx, err := adp.db.Begin()
+func (adp *AtomDataProcessor) processEvent(ctx context.Context, feed feedRef, event *goes.Event, ts time.Time) (Outcome, error) {
+	//Need a transaction to group the work in this method, serialized with other
+	//writers of the feed before looking at the feed state
+	tx, err := adp.beginFeedTx(ctx, feed)
 	if err != nil {
-		return err
+		return Failed, classifyDBError(err)
 	}
 
 	//Get the current feed id
-	feedid, err := selectLatestFeed(tx)
+	feedid, err := selectLatestFeed(ctx, tx, feed)
 	if err != nil {
-		doRollback(tx)
-		return err
+		adp.doRollback(tx)
+		return Failed, classifyDBError(err)
 	}
-	log.Debugf("previous feed id is %s", feedid.String)
+	adp.logger.Debug("Latest feed", Fields{FieldTenant: feed.tenant, FieldFeedName: feed.name, FieldFeedID: feedid.String})
 
 	//Insert current row
-	err = writeEventToAtomEventTable(tx, event, ts)
+	outcome, err := adp.writeEventToAtomEventTable(ctx, tx, feed, event, ts)
 	if err != nil {
-		doRollback(tx)
-		return err
+		adp.doRollback(tx)
+		return outcome, err
+	}
+
+	//Nothing was written for a duplicate so there's nothing more to do
+	if outcome != Inserted {
+		adp.doRollback(tx)
+		return outcome, nil
 	}
 
-	//Get current count of records in the current feed
-	count, err := getRecentFeedCount(tx)
+	//Get the stats of the recent page the rollover policy needs
+	policy := adp.rolloverPolicy()
+	page, err := adp.getRecentPage(ctx, tx, feed, policy.Requires())
 	if err != nil {
-		doRollback(tx)
-		return err
+		adp.doRollback(tx)
+		return Failed, classifyDBError(err)
 	}
-	log.Debugf("current count is %d", count)
+	adp.logger.Debug("Recent feed count", Fields{"count": page.Count})
 
-	//Threshold met
-	if count == adp.feedThreshold {
-		log.Infof("Feed threshold of %d met", adp.feedThreshold)
-		err := createNewFeed(tx, feedid)
+	count := page.Count
+	rolledOver := adp.closePage(policy, page)
+	if rolledOver {
+		_, err := adp.createNewFeed(ctx, tx, feed, feedid)
 		if err != nil {
-			doRollback(tx)
-			return err
+			adp.doRollback(tx)
+			return Failed, wrapError(ErrRollover, classifyDBError(err))
 		}
+		count = 0
 	}
 
-	log.Debug("commit txn")
 	err = tx.Commit()
 	if err != nil {
-		log.Warnf("Error commiting processEvent transaction: %s", err.Error())
-		return err
+		adp.logger.Warn("Error commiting processEvent transaction", errorFields(eventFields(event), err))
+		return Failed, classifyDBError(err)
+	}
+
+	if rolledOver {
+		adp.metrics.FeedRolledOver()
 	}
+	adp.metrics.RecentPageSize(feed.tenant, feed.name, count)
 
-	return nil
+	return Inserted, nil
 }
@@ -1,6 +1,9 @@
 package esatomdatapg
 
 import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
 	"errors"
 	"net"
 	"os"
@@ -8,6 +11,7 @@ import (
 	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/lib/pq"
 	"github.com/stretchr/testify/assert"
 	"github.com/xtracdev/envinject"
 	"github.com/xtracdev/goes"
@@ -19,19 +23,46 @@ func TestSetThresholdFromEnv(t *testing.T) {
 	os.Unsetenv(EnvFeedThreshold)
 	os.Unsetenv(envinject.ParamPrefixEnvVar)
 	env, _ := envinject.NewInjectedEnv()
-	assert.Equal(t, defaultFeedThreshold, readFeedThresholdFromEnv(env))
+	threshold, err := readFeedThresholdFromEnv(env)
+	assert.Nil(t, err)
+	assert.Equal(t, defaultFeedThreshold, threshold)
 
 	os.Setenv(EnvFeedThreshold, "2")
 	env, _ = envinject.NewInjectedEnv()
-	assert.Equal(t, 2, readFeedThresholdFromEnv(env))
+	threshold, err = readFeedThresholdFromEnv(env)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, threshold)
 }
 
-func TestSetThresholdToDefaultOnBadEnvSpec(t *testing.T) {
-	os.Setenv(EnvFeedThreshold, "two")
+func TestRejectBadEnvSpec(t *testing.T) {
 	os.Unsetenv(envinject.ParamPrefixEnvVar)
-	env, _ := envinject.NewInjectedEnv()
-	assert.Equal(t, defaultFeedThreshold, readFeedThresholdFromEnv(env))
-	os.Setenv(EnvFeedThreshold, "2")
+	for _, spec := range []struct{ name, value string }{
+		{EnvFeedThreshold, "two"},
+		{EnvFeedThreshold, "0"},
+		{EnvFeedThreshold, "-2"},
+		{EnvFeedMaxPageAge, "soon"},
+		{EnvFeedMaxPageAge, "0s"},
+		{EnvFeedMaxPageBytes, "1MB"},
+		{EnvFeedMaxPageBytes, "-1"},
+		{EnvFeedRoutes, "a/b=foo"},
+		{EnvTransientRetries, "three"},
+		{EnvTransientRetries, "-1"},
+	} {
+		previous, set := os.LookupEnv(spec.name)
+		os.Setenv(spec.name, spec.value)
+		env, _ := envinject.NewInjectedEnv()
+		processor, err := New(nil, WithEnv(env))
+		if assert.NotNil(t, err, spec.name+"="+spec.value) {
+			assert.Contains(t, err.Error(), spec.name)
+		}
+		assert.Nil(t, processor)
+
+		if set {
+			os.Setenv(spec.name, previous)
+		} else {
+			os.Unsetenv(spec.name)
+		}
+	}
 }
 
 func TestReadPreviousFeedIdScanError(t *testing.T) {
@@ -50,10 +81,11 @@ func TestReadPreviousFeedIdScanError(t *testing.T) {
 	rows := sqlmock.NewRows([]string{"feedid"}).AddRow(foo)
 
 	mock.ExpectBegin()
-	mock.ExpectQuery(`select feedid from t_aefd_feed where id = \(select max\(id\) from t_aefd_feed\)`).WillReturnRows(rows)
+	mock.ExpectQuery(`select feedid from t_aefd_feed where id = \(select max\(id\) from t_aefd_feed where tenant = \$1 and feed_name = \$2\)`).
+		WithArgs(DefaultTenant, DefaultFeed).WillReturnRows(rows)
 
 	tx, _ := db.Begin()
-	_, err = selectLatestFeed(tx)
+	_, err = selectLatestFeed(context.Background(), tx, defaultFeedRef)
 	if assert.NotNil(t, err) {
 		err = mock.ExpectationsWereMet()
 		assert.Nil(t, err)
@@ -70,6 +102,7 @@ var ts = time.Now()
 
 var processTests = []struct {
 	beginOk           *bool
+	feedLockOk        *bool
 	feedIdSelectOk    *bool
 	eventInsertOk     *bool
 	thesholdCountOk   *bool
@@ -78,13 +111,14 @@ var processTests = []struct {
 	expectCommit      *bool
 	expectError       bool
 }{
-	{&trueVal, &trueVal, &trueVal, &trueVal, &trueVal, &trueVal, &trueVal, noErrorExpected},
-	{&falseVal, nil, nil, nil, nil, nil, nil, errorExpected},
-	{&trueVal, nil, nil, nil, nil, nil, &falseVal, errorExpected},
-	{&trueVal, &falseVal, nil, nil, nil, nil, &falseVal, errorExpected},
-	{&trueVal, &trueVal, &falseVal, nil, nil, nil, &falseVal, errorExpected},
-	{&trueVal, &trueVal, &trueVal, &falseVal, nil, nil, &falseVal, errorExpected},
-	{&trueVal, &trueVal, &trueVal, &trueVal, &falseVal, nil, &falseVal, errorExpected},
+	{&trueVal, &trueVal, &trueVal, &trueVal, &trueVal, &trueVal, &trueVal, &trueVal, noErrorExpected},
+	{&falseVal, nil, nil, nil, nil, nil, nil, nil, errorExpected},
+	{&trueVal, nil, nil, nil, nil, nil, nil, &falseVal, errorExpected},
+	{&trueVal, &falseVal, nil, nil, nil, nil, nil, &falseVal, errorExpected},
+	{&trueVal, &trueVal, &falseVal, nil, nil, nil, nil, &falseVal, errorExpected},
+	{&trueVal, &trueVal, &trueVal, &falseVal, nil, nil, nil, &falseVal, errorExpected},
+	{&trueVal, &trueVal, &trueVal, &trueVal, &falseVal, nil, nil, &falseVal, errorExpected},
+	{&trueVal, &trueVal, &trueVal, &trueVal, &trueVal, &falseVal, nil, &falseVal, errorExpected},
 }
 
 func testBeginSetup(mock sqlmock.Sqlmock, ok *bool) {
@@ -95,6 +129,18 @@ func testBeginSetup(mock sqlmock.Sqlmock, ok *bool) {
 	}
 }
 
+func testFeedLockSetup(mock sqlmock.Sqlmock, ok *bool) {
+	if ok == nil {
+		return
+	}
+
+	if *ok == true {
+		mock.ExpectExec(`select pg_advisory_xact_lock`).WithArgs(feedLockKey).WillReturnResult(sqlmock.NewResult(0, 0))
+	} else {
+		mock.ExpectExec(`select pg_advisory_xact_lock`).WillReturnError(errors.New("BAM!"))
+	}
+}
+
 func testFeedIdSelectSetup(mock sqlmock.Sqlmock, ok *bool) {
 	if ok == nil {
 		return
@@ -116,7 +162,7 @@ func testEventInsertSetup(mock sqlmock.Sqlmock, ok *bool, eventPtr *goes.Event)
 	if *ok == true {
 		execOkResult := sqlmock.NewResult(1, 1)
 		mock.ExpectExec("insert into t_aeae_atom_event").WithArgs(
-			eventPtr.Source, eventPtr.Version, eventPtr.TypeCode, eventPtr.Payload, ts,
+			eventPtr.Source, eventPtr.Version, eventPtr.TypeCode, eventPtr.Payload, ts, DefaultFeed, DefaultTenant,
 		).WillReturnResult(execOkResult)
 	} else {
 		mock.ExpectExec("insert into t_aeae_atom_event").WillReturnError(errors.New("BAM!"))
@@ -130,8 +176,8 @@ func testThresholdCountSetup(mock sqlmock.Sqlmock, ok *bool) {
 	if *ok == true {
 		rows := sqlmock.NewRows([]string{"feedid"}).AddRow("XXX")
 		env, _ := envinject.NewInjectedEnv()
-		rows = sqlmock.NewRows([]string{"count(*)"}).
-			AddRow(readFeedThresholdFromEnv(env))
+		threshold, _ := readFeedThresholdFromEnv(env)
+		rows = sqlmock.NewRows([]string{"count(*)"}).AddRow(threshold)
 		mock.ExpectQuery(`select count`).WillReturnRows(rows)
 	} else {
 		mock.ExpectQuery(`select count`).WillReturnError(errors.New("BAM!"))
@@ -166,7 +212,7 @@ func testExpectCommitSetup(mock sqlmock.Sqlmock, ok *bool) {
 func testFeedInsertOk(mock sqlmock.Sqlmock, ok *bool) {
 	if ok != nil {
 		execOkResult := sqlmock.NewResult(1, 1)
-		mock.ExpectExec("insert into t_aefd_feed").WillReturnResult(execOkResult).WithArgs(sqlmock.AnyArg(), "XXX")
+		mock.ExpectExec("insert into t_aefd_feed").WillReturnResult(execOkResult).WithArgs(sqlmock.AnyArg(), "XXX", DefaultFeed, DefaultTenant)
 	}
 }
 
@@ -218,6 +264,7 @@ func TestProcessEvents(t *testing.T) {
 		}
 
 		testBeginSetup(mock, tt.beginOk)
+		testFeedLockSetup(mock, tt.feedLockOk)
 		testFeedIdSelectSetup(mock, tt.feedIdSelectOk)
 		testEventInsertSetup(mock, tt.eventInsertOk, eventPtr)
 		testThresholdCountSetup(mock, tt.thesholdCountOk)
@@ -243,3 +290,271 @@ func TestProcessEvents(t *testing.T) {
 		assert.Nil(t, err)
 	}
 }
+
+func TestProcessEventRollsOverPastThreshold(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	eventPtr := &goes.Event{
+		Source:   "agg1",
+		Version:  1,
+		TypeCode: "foo",
+		Payload:  []byte("ok"),
+	}
+
+	env, _ := envinject.NewInjectedEnv()
+	threshold, _ := readFeedThresholdFromEnv(env)
+
+	testBeginSetup(mock, &trueVal)
+	testFeedLockSetup(mock, &trueVal)
+	testFeedIdSelectSetup(mock, &trueVal)
+	testEventInsertSetup(mock, &trueVal, eventPtr)
+	mock.ExpectQuery(`select count`).WillReturnRows(sqlmock.NewRows([]string{"count(*)"}).AddRow(threshold + 1))
+	testThresholdAtomEventUpdateSetup(mock, &trueVal)
+	testFeedInsertOk(mock, &trueVal)
+	testExpectCommitSetup(mock, &trueVal)
+
+	processor, _ := NewAtomDataProcessor(db, env)
+	eventMessage := pgpublish.EncodePGEvent(eventPtr.Source, eventPtr.Version, (eventPtr.Payload).([]byte), eventPtr.TypeCode, ts)
+
+	err = processor.ProcessMessage(eventMessage)
+	assert.Nil(t, err)
+
+	err = mock.ExpectationsWereMet()
+	assert.Nil(t, err)
+}
+
+func TestProcessMessageContextCancelled(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`select pg_advisory_xact_lock`).WillDelayFor(time.Second).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	env, _ := envinject.NewInjectedEnv()
+	processor, _ := NewAtomDataProcessor(db, env)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	eventMessage := pgpublish.EncodePGEvent("agg1", 1, []byte("ok"), "foo", ts)
+	err = processor.ProcessMessageContext(ctx, eventMessage)
+	assert.NotNil(t, err)
+}
+
+func testDuplicateSetup(mock sqlmock.Sqlmock, typecode string, payload []byte) {
+	testBeginSetup(mock, &trueVal)
+	testFeedLockSetup(mock, &trueVal)
+	testFeedIdSelectSetup(mock, &trueVal)
+	mock.ExpectExec("insert into t_aeae_atom_event").WillReturnResult(sqlmock.NewResult(0, 0))
+	rows := sqlmock.NewRows([]string{"typecode", "payload"}).AddRow(typecode, payload)
+	mock.ExpectQuery("select typecode, payload from t_aeae_atom_event").WithArgs(DefaultTenant, "agg1", 1).WillReturnRows(rows)
+	mock.ExpectRollback()
+}
+
+func TestProcessDuplicateIdentical(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	testDuplicateSetup(mock, "foo", []byte("ok"))
+
+	env, _ := envinject.NewInjectedEnv()
+	processor, _ := NewAtomDataProcessor(db, env)
+
+	eventMessage := pgpublish.EncodePGEvent("agg1", 1, []byte("ok"), "foo", ts)
+	outcome, err := processor.ProcessMessageOutcome(context.Background(), eventMessage)
+	assert.Nil(t, err)
+	assert.Equal(t, DuplicateIdentical, outcome)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestProcessDuplicateConflicting(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	testDuplicateSetup(mock, "foo", []byte("something else"))
+
+	env, _ := envinject.NewInjectedEnv()
+	processor, _ := NewAtomDataProcessor(db, env)
+
+	eventMessage := pgpublish.EncodePGEvent("agg1", 1, []byte("ok"), "foo", ts)
+	outcome, err := processor.ProcessMessageOutcome(context.Background(), eventMessage)
+	assert.True(t, errors.Is(err, ErrDuplicateEvent))
+	assert.Equal(t, DuplicateConflicting, outcome)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestOutcomeString(t *testing.T) {
+	assert.Equal(t, "Failed", Failed.String())
+	assert.Equal(t, "Failed", Outcome(0).String())
+	assert.Equal(t, "Inserted", Inserted.String())
+	assert.Equal(t, "DuplicateIdentical", DuplicateIdentical.String())
+	assert.Equal(t, "DuplicateConflicting", DuplicateConflicting.String())
+	assert.Equal(t, "Outcome(42)", Outcome(42).String())
+}
+
+func TestProcessMessageDecodeError(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	env, _ := envinject.NewInjectedEnv()
+	processor, _ := NewAtomDataProcessor(db, env)
+
+	err = processor.ProcessMessage("not an event")
+	assert.True(t, errors.Is(err, ErrDecode))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+// newTestProcessor returns a processor created with opts on a stub database, and
+// a function that closes the database
+func newTestProcessor(t *testing.T, opts ...Option) (*AtomDataProcessor, sqlmock.Sqlmock, func()) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	processor, err := New(db, opts...)
+	if err != nil {
+		db.Close()
+		t.Fatal(err)
+	}
+
+	return processor, mock, func() { db.Close() }
+}
+
+func testRetryProcessor(t *testing.T, db *sql.DB) *AtomDataProcessor {
+	env, _ := envinject.NewInjectedEnv()
+	processor, _ := NewAtomDataProcessor(db, env)
+	processor.retryPolicy = BackoffPolicy{Initial: time.Millisecond, Max: 10 * time.Millisecond, Multiplier: 2}
+	return processor
+}
+
+func testInsertOkSetup(mock sqlmock.Sqlmock) {
+	testBeginSetup(mock, &trueVal)
+	testFeedLockSetup(mock, &trueVal)
+	testFeedIdSelectSetup(mock, &trueVal)
+	mock.ExpectExec("insert into t_aeae_atom_event").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(`select count`).WillReturnRows(sqlmock.NewRows([]string{"count(*)"}).AddRow(1))
+	mock.ExpectCommit()
+}
+
+func TestProcessRetriesTransientErrors(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`select pg_advisory_xact_lock`).WillReturnError(&pq.Error{Code: "40P01"})
+	mock.ExpectRollback()
+	testInsertOkSetup(mock)
+
+	processor := testRetryProcessor(t, db)
+	eventMessage := pgpublish.EncodePGEvent("agg1", 1, []byte("ok"), "foo", ts)
+	outcome, err := processor.ProcessMessageOutcome(context.Background(), eventMessage)
+	assert.Nil(t, err)
+	assert.Equal(t, Inserted, outcome)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestProcessGivesUpAfterTransientRetries(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	processor := testRetryProcessor(t, db)
+	processor.transientRetries = 2
+	for i := 0; i <= processor.transientRetries; i++ {
+		mock.ExpectBegin().WillReturnError(&pq.Error{Code: "40001"})
+	}
+
+	eventMessage := pgpublish.EncodePGEvent("agg1", 1, []byte("ok"), "foo", ts)
+	outcome, err := processor.ProcessMessageOutcome(context.Background(), eventMessage)
+	assert.True(t, errors.Is(err, ErrTransient))
+	assert.Equal(t, Failed, outcome)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestRetryTransientRetriesConnectionErrors(t *testing.T) {
+	db, _, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	processor := testRetryProcessor(t, db)
+	processor.transientRetries = 2
+
+	//Connection errors are retried even when op does not classify them
+	attempts := 0
+	err = processor.retryTransient(context.Background(), func() error {
+		attempts++
+		if attempts == 1 {
+			return driver.ErrBadConn
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, attempts)
+
+	attempts = 0
+	err = processor.retryTransient(context.Background(), func() error {
+		attempts++
+		return &pq.Error{Code: "57P01"}
+	})
+	assert.Equal(t, 3, attempts)
+	assert.True(t, errors.Is(err, ErrTransient))
+}
+
+func TestProcessDoesNotRetryOtherErrors(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin().WillReturnError(errors.New("BAM!"))
+
+	processor := testRetryProcessor(t, db)
+	eventMessage := pgpublish.EncodePGEvent("agg1", 1, []byte("ok"), "foo", ts)
+	err = processor.ProcessMessage(eventMessage)
+	assert.NotNil(t, err)
+	assert.False(t, errors.Is(err, ErrTransient))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestProcessRetriesAfterConnectionLoss(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	//The retry uses the same handle, which replaces the lost connection
+	mock.ExpectBegin().WillReturnError(&pq.Error{Code: "08006"})
+	testInsertOkSetup(mock)
+
+	processor := testRetryProcessor(t, db)
+	eventMessage := pgpublish.EncodePGEvent("agg1", 1, []byte("ok"), "foo", ts)
+	assert.Nil(t, processor.ProcessMessage(eventMessage))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
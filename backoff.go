@@ -0,0 +1,89 @@
+package esatomdatapg
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// BackoffPolicy describes how long to wait between attempts: Initial after the
+// first failure, multiplied by Multiplier after each further failure up to Max.
+// Each delay is randomly adjusted by up to Jitter (a fraction of the delay) so
+// that clients failing together don't retry together.
+type BackoffPolicy struct {
+	Initial    time.Duration
+	Max        time.Duration
+	Multiplier float64
+	Jitter     float64
+}
+
+// DefaultBackoffPolicy is used for retrying transient database errors
+var DefaultBackoffPolicy = BackoffPolicy{
+	Initial:    100 * time.Millisecond,
+	Max:        5 * time.Second,
+	Multiplier: 2,
+	Jitter:     0.2,
+}
+
+// Delay returns the delay after the given number of consecutive failures,
+// starting at 1.
+func (p BackoffPolicy) Delay(failures int) time.Duration {
+	if failures < 1 {
+		return 0
+	}
+
+	delay := float64(p.Initial)
+	for i := 1; i < failures && delay < float64(p.Max); i++ {
+		delay *= p.Multiplier
+	}
+
+	if p.Max > 0 && delay > float64(p.Max) {
+		delay = float64(p.Max)
+	}
+
+	if p.Jitter > 0 {
+		delay += delay * p.Jitter * (2*rand.Float64() - 1)
+	}
+
+	return time.Duration(delay)
+}
+
+// Backoff tracks consecutive failures, growing the delay with each one until Reset
+// is called after a success. A Backoff is not safe for concurrent use.
+type Backoff struct {
+	Policy   BackoffPolicy
+	failures int
+}
+
+func NewBackoff(policy BackoffPolicy) *Backoff {
+	return &Backoff{Policy: policy}
+}
+
+// Next records a failure and returns the delay before the next attempt
+func (b *Backoff) Next() time.Duration {
+	b.failures++
+	return b.Policy.Delay(b.failures)
+}
+
+// Reset clears the failures after a success
+func (b *Backoff) Reset() {
+	b.failures = 0
+}
+
+// Wait records a failure and waits before the next attempt, returning early with
+// the context's error if ctx is done first.
+func (b *Backoff) Wait(ctx context.Context) error {
+	return sleep(ctx, b.Next())
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
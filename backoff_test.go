@@ -0,0 +1,49 @@
+package esatomdatapg
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoffPolicyDelay(t *testing.T) {
+	policy := BackoffPolicy{Initial: 100 * time.Millisecond, Max: time.Second, Multiplier: 2}
+
+	assert.Equal(t, time.Duration(0), policy.Delay(0))
+	assert.Equal(t, 100*time.Millisecond, policy.Delay(1))
+	assert.Equal(t, 200*time.Millisecond, policy.Delay(2))
+	assert.Equal(t, 800*time.Millisecond, policy.Delay(4))
+	assert.Equal(t, time.Second, policy.Delay(5))
+	assert.Equal(t, time.Second, policy.Delay(100))
+}
+
+func TestBackoffPolicyJitter(t *testing.T) {
+	policy := BackoffPolicy{Initial: 100 * time.Millisecond, Max: time.Second, Multiplier: 2, Jitter: 0.5}
+
+	for i := 0; i < 100; i++ {
+		delay := policy.Delay(2)
+		assert.True(t, delay >= 100*time.Millisecond && delay <= 300*time.Millisecond, "delay %s", delay)
+	}
+}
+
+func TestBackoffReset(t *testing.T) {
+	backoff := NewBackoff(BackoffPolicy{Initial: time.Millisecond, Max: time.Second, Multiplier: 10})
+
+	assert.Equal(t, time.Millisecond, backoff.Next())
+	assert.Equal(t, 10*time.Millisecond, backoff.Next())
+	backoff.Reset()
+	assert.Equal(t, time.Millisecond, backoff.Next())
+}
+
+func TestBackoffWaitCancelled(t *testing.T) {
+	backoff := NewBackoff(BackoffPolicy{Initial: time.Minute, Max: time.Minute, Multiplier: 2})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	assert.Equal(t, context.DeadlineExceeded, backoff.Wait(ctx))
+	assert.True(t, time.Since(start) < time.Second)
+}
@@ -0,0 +1,211 @@
+package esatomdatapg
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/xtracdev/goes"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	sqlSavepoint         = `savepoint batch_event`
+	sqlRollbackSavepoint = `rollback to savepoint batch_event`
+	sqlReleaseSavepoint  = `release savepoint batch_event`
+)
+
+// MessageResult is the outcome of processing one message of a batch. A nil Err
+// means the event was committed to the atom event table, or was already stored
+// as indicated by Outcome. A failed message has the Failed outcome, or
+// DuplicateConflicting if it conflicts with a stored event.
+type MessageResult struct {
+	Outcome Outcome
+	Err     error
+}
+
+type batchEvent struct {
+	index int
+	feed  feedRef
+	event goes.Event
+	ts    time.Time
+}
+
+// batchFeed is the state of a feed written by a batch
+type batchFeed struct {
+	feedid sql.NullString
+	page   PageStats
+}
+
+// ProcessMessages writes a batch of pgpublish encoded messages in a single
+// transaction. The results are in the same order as msgs. Messages that cannot be
+// decoded or inserted fail individually without affecting the rest of the batch; if
+// the transaction as a whole fails every message is reported as failed.
+func (adp *AtomDataProcessor) ProcessMessages(msgs []string) []MessageResult {
+	return adp.ProcessMessagesContext(context.Background(), msgs)
+}
+
+// ProcessMessagesContext is ProcessMessages with a context; cancelling the context
+// rolls back the batch.
+func (adp *AtomDataProcessor) ProcessMessagesContext(ctx context.Context, msgs []string) []MessageResult {
+	adp.logger.Debug("Process batch", Fields{"batch_size": len(msgs)})
+
+	ctx, span := tracer.Start(ctx, "ProcessMessages",
+		trace.WithAttributes(attribute.Int("batch.size", len(msgs))))
+	defer span.End()
+
+	results := make([]MessageResult, len(msgs))
+
+	var events []batchEvent
+	for i, msg := range msgs {
+		event, timestamp, err := decodeEvent(ctx, msg)
+		if err != nil {
+			adp.logger.Warn("Unable to decode message", errorFields(Fields{"index": i}, err))
+			results[i].Err = err
+			continue
+		}
+		adp.logEvent(&event)
+
+		tenant, err := adp.resolveTenant(ctx, &event)
+		if err != nil {
+			adp.logger.Warn("Unable to resolve tenant", errorFields(eventFields(&event), err))
+			results[i].Err = err
+			continue
+		}
+
+		feed := feedRef{tenant: tenant, name: adp.route(&event)}
+		events = append(events, batchEvent{index: i, feed: feed, event: event, ts: timestamp})
+	}
+
+	if len(events) == 0 {
+		return results
+	}
+
+	err := adp.retryTransient(ctx, func() error {
+		for _, be := range events {
+			results[be.index] = MessageResult{}
+		}
+		return classifyDBError(adp.processBatch(ctx, events, results))
+	})
+	if err != nil {
+		for _, be := range events {
+			results[be.index] = MessageResult{Err: err}
+		}
+		recordSpanError(span, err)
+		return results
+	}
+
+	for _, be := range events {
+		adp.recordStored(results[be.index].Outcome, results[be.index].Err)
+	}
+
+	return results
+}
+
+// processBatch writes the events in one transaction, recording insert failures in
+// results. An error return means the transaction was rolled back.
+func (adp *AtomDataProcessor) processBatch(ctx context.Context, events []batchEvent, results []MessageResult) error {
+	refs := batchFeedRefs(events)
+	tx, err := adp.beginFeedTx(ctx, refs...)
+	if err != nil {
+		return err
+	}
+
+	//We hold the feed locks, so the pages only change through our own writes and
+	//we can track their stats locally rather than querying after every insert.
+	policy := adp.rolloverPolicy()
+	feeds := make(map[feedRef]*batchFeed, len(refs))
+	for _, ref := range refs {
+		feedid, err := selectLatestFeed(ctx, tx, ref)
+		if err != nil {
+			adp.doRollback(tx)
+			return err
+		}
+
+		page, err := adp.getRecentPage(ctx, tx, ref, policy.Requires())
+		if err != nil {
+			adp.doRollback(tx)
+			return err
+		}
+
+		feeds[ref] = &batchFeed{feedid: feedid, page: page}
+	}
+
+	rollovers := 0
+
+	for _, be := range events {
+		//Each insert runs in a savepoint so a failed insert does not abort the batch
+		_, err = tx.ExecContext(ctx, sqlSavepoint)
+		if err != nil {
+			adp.doRollback(tx)
+			return err
+		}
+
+		outcome, insertErr := adp.writeEventToAtomEventTable(ctx, tx, be.feed, &be.event, be.ts)
+		results[be.index].Outcome = outcome
+		if insertErr != nil {
+			adp.logger.Warn("Error inserting event", errorFields(eventFields(&be.event), insertErr))
+			results[be.index].Err = insertErr
+
+			_, err = tx.ExecContext(ctx, sqlRollbackSavepoint)
+			if err != nil {
+				adp.doRollback(tx)
+				return err
+			}
+			continue
+		}
+
+		_, err = tx.ExecContext(ctx, sqlReleaseSavepoint)
+		if err != nil {
+			adp.doRollback(tx)
+			return err
+		}
+
+		if outcome != Inserted {
+			continue
+		}
+
+		feed := feeds[be.feed]
+		feed.page.add(&be.event, adp.now())
+		if adp.closePage(policy, feed.page) {
+			feed.feedid, err = adp.createNewFeed(ctx, tx, be.feed, feed.feedid)
+			if err != nil {
+				adp.doRollback(tx)
+				return wrapError(ErrRollover, classifyDBError(err))
+			}
+			feed.page = PageStats{}
+			rollovers++
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		adp.logger.Warn("Error commiting processBatch transaction", errorFields(Fields{}, err))
+		return err
+	}
+
+	for i := 0; i < rollovers; i++ {
+		adp.metrics.FeedRolledOver()
+	}
+	for _, ref := range refs {
+		adp.metrics.RecentPageSize(ref.tenant, ref.name, feeds[ref].page.Count)
+	}
+
+	return nil
+}
+
+// batchFeedRefs returns the feeds the events are written to, in lock order
+func batchFeedRefs(events []batchEvent) []feedRef {
+	var refs []feedRef
+	seen := make(map[feedRef]bool)
+	for _, be := range events {
+		if !seen[be.feed] {
+			seen[be.feed] = true
+			refs = append(refs, be.feed)
+		}
+	}
+
+	sortFeedRefs(refs)
+	return refs
+}
@@ -0,0 +1,174 @@
+package esatomdatapg
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"github.com/xtracdev/pgpublish"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func expectBatchStart(mock sqlmock.Sqlmock, recentCount int) {
+	mock.ExpectBegin()
+	mock.ExpectExec(`select pg_advisory_xact_lock`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("select feedid from t_aefd_feed").WillReturnRows(sqlmock.NewRows([]string{"feedid"}).AddRow("XXX"))
+	mock.ExpectQuery(`select count`).WillReturnRows(sqlmock.NewRows([]string{"count(*)"}).AddRow(recentCount))
+}
+
+func expectBatchInsert(mock sqlmock.Sqlmock, aggId string, err error) {
+	mock.ExpectExec("savepoint batch_event").WillReturnResult(sqlmock.NewResult(0, 0))
+	if err != nil {
+		mock.ExpectExec("insert into t_aeae_atom_event").WithArgs(aggId, 1, "foo", []byte("ok"), ts, DefaultFeed, DefaultTenant).WillReturnError(err)
+		mock.ExpectExec("rollback to savepoint batch_event").WillReturnResult(sqlmock.NewResult(0, 0))
+		return
+	}
+	mock.ExpectExec("insert into t_aeae_atom_event").WithArgs(aggId, 1, "foo", []byte("ok"), ts, DefaultFeed, DefaultTenant).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("release savepoint batch_event").WillReturnResult(sqlmock.NewResult(0, 0))
+}
+
+func expectBatchRollover(mock sqlmock.Sqlmock, previous interface{}) {
+	mock.ExpectExec("update t_aeae_atom_event set feedid").WillReturnResult(sqlmock.NewResult(1, 2))
+	mock.ExpectExec("insert into t_aefd_feed").WithArgs(sqlmock.AnyArg(), previous, DefaultFeed, DefaultTenant).WillReturnResult(sqlmock.NewResult(1, 1))
+}
+
+func batchMessage(aggId string) string {
+	return pgpublish.EncodePGEvent(aggId, 1, []byte("ok"), "foo", ts)
+}
+
+func TestProcessMessagesCrossesSeveralPages(t *testing.T) {
+	processor, mock, done := newTestProcessor(t, WithFeedThreshold(2))
+	defer done()
+
+	expectBatchStart(mock, 1)
+	expectBatchInsert(mock, "agg1", nil)
+	expectBatchRollover(mock, "XXX")
+	expectBatchInsert(mock, "agg2", nil)
+	expectBatchInsert(mock, "agg3", nil)
+	expectBatchRollover(mock, sqlmock.AnyArg())
+	mock.ExpectCommit()
+
+	results := processor.ProcessMessages([]string{batchMessage("agg1"), batchMessage("agg2"), batchMessage("agg3")})
+	if assert.Equal(t, 3, len(results)) {
+		for _, r := range results {
+			assert.Nil(t, r.Err)
+		}
+	}
+
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestProcessMessagesPartialFailure(t *testing.T) {
+	processor, mock, done := newTestProcessor(t, WithFeedThreshold(2))
+	defer done()
+
+	expectBatchStart(mock, 0)
+	expectBatchInsert(mock, "agg1", errors.New("duplicate"))
+	expectBatchInsert(mock, "agg2", nil)
+	mock.ExpectCommit()
+
+	results := processor.ProcessMessages([]string{batchMessage("agg1"), "not an event", batchMessage("agg2")})
+	if assert.Equal(t, 3, len(results)) {
+		assert.NotNil(t, results[0].Err)
+		assert.Equal(t, Failed, results[0].Outcome)
+		assert.True(t, errors.Is(results[1].Err, ErrDecode))
+		assert.Equal(t, Failed, results[1].Outcome)
+		assert.Nil(t, results[2].Err)
+		assert.Equal(t, Inserted, results[2].Outcome)
+	}
+
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestProcessMessagesTransactionFailure(t *testing.T) {
+	processor, mock, done := newTestProcessor(t, WithFeedThreshold(2))
+	defer done()
+	processor.feedThreshold = 10
+
+	expectBatchStart(mock, 0)
+	expectBatchInsert(mock, "agg1", nil)
+	expectBatchInsert(mock, "agg2", nil)
+	mock.ExpectCommit().WillReturnError(errors.New("commit failed"))
+
+	results := processor.ProcessMessages([]string{batchMessage("agg1"), "not an event", batchMessage("agg2")})
+	if assert.Equal(t, 3, len(results)) {
+		assert.Equal(t, "commit failed", results[0].Err.Error())
+		assert.NotEqual(t, "commit failed", results[1].Err.Error())
+		assert.Equal(t, "commit failed", results[2].Err.Error())
+		for _, result := range results {
+			assert.Equal(t, Failed, result.Outcome)
+		}
+	}
+
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestProcessMessagesNothingDecodable(t *testing.T) {
+	processor, mock, done := newTestProcessor(t, WithFeedThreshold(2))
+	defer done()
+
+	results := processor.ProcessMessages([]string{"not an event"})
+	if assert.Equal(t, 1, len(results)) {
+		assert.NotNil(t, results[0].Err)
+	}
+
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestProcessMessagesDuplicates(t *testing.T) {
+	processor, mock, done := newTestProcessor(t, WithFeedThreshold(2))
+	defer done()
+
+	expectBatchStart(mock, 1)
+	for _, aggId := range []string{"agg1", "agg2"} {
+		mock.ExpectExec("savepoint batch_event").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("insert into t_aeae_atom_event").WithArgs(aggId, 1, "foo", sqlmock.AnyArg(), ts, DefaultFeed, DefaultTenant).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery("select typecode, payload").WithArgs(DefaultTenant, aggId, 1).WillReturnRows(
+			sqlmock.NewRows([]string{"typecode", "payload"}).AddRow("foo", []byte("agg1")),
+		)
+		if aggId == "agg1" {
+			mock.ExpectExec("release savepoint batch_event").WillReturnResult(sqlmock.NewResult(0, 0))
+		} else {
+			mock.ExpectExec("rollback to savepoint batch_event").WillReturnResult(sqlmock.NewResult(0, 0))
+		}
+	}
+	mock.ExpectCommit()
+
+	results := processor.ProcessMessages([]string{
+		pgpublish.EncodePGEvent("agg1", 1, []byte("agg1"), "foo", ts),
+		pgpublish.EncodePGEvent("agg2", 1, []byte("ok"), "foo", ts),
+	})
+
+	if assert.Equal(t, 2, len(results)) {
+		assert.Nil(t, results[0].Err)
+		assert.Equal(t, DuplicateIdentical, results[0].Outcome)
+		assert.True(t, errors.Is(results[1].Err, ErrDuplicateEvent))
+		assert.Equal(t, DuplicateConflicting, results[1].Outcome)
+	}
+
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestProcessMessagesRetriesTransientFailure(t *testing.T) {
+	processor, mock, done := newTestProcessor(t, WithFeedThreshold(2))
+	defer done()
+	processor.feedThreshold = 10
+	processor.retryPolicy = BackoffPolicy{Initial: time.Millisecond, Max: time.Millisecond, Multiplier: 2}
+
+	expectBatchStart(mock, 0)
+	expectBatchInsert(mock, "agg1", nil)
+	mock.ExpectCommit().WillReturnError(&pq.Error{Code: "40001"})
+	expectBatchStart(mock, 0)
+	expectBatchInsert(mock, "agg1", nil)
+	mock.ExpectCommit()
+
+	results := processor.ProcessMessages([]string{batchMessage("agg1")})
+	if assert.Equal(t, 1, len(results)) {
+		assert.Nil(t, results[0].Err)
+		assert.Equal(t, Inserted, results[0].Outcome)
+	}
+
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/xtracdev/es-atom-data-pg"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// defaultRetryDelay is how long a failed message stays invisible before it is
+// redelivered; this matches the default SQS visibility timeout.
+const defaultRetryDelay = 30 * time.Second
+
+// BatchProcessor writes a batch of pgpublish encoded events, reporting the
+// outcome of each. AtomDataProcessor implements it.
+type BatchProcessor interface {
+	ProcessMessagesContext(ctx context.Context, msgs []string) []esatomdatapg.MessageResult
+}
+
+// Consumer is the processing loop, feeding messages from a source to the
+// processor and acknowledging them based on the results.
+type Consumer struct {
+	source     MessageSource
+	processor  BatchProcessor
+	RetryDelay time.Duration
+
+	//DeadLetters, if set, records messages that will not be processed: those
+	//that can't be decoded, conflicting duplicates, and messages that have
+	//failed MaxAttempts times. Without it such messages are logged and dropped,
+	//or retried until the source gives up on them.
+	DeadLetters DeadLetterSink
+
+	//MaxAttempts is the number of times a message is attempted before it is
+	//dead lettered; zero means no limit
+	MaxAttempts int
+
+	//Health, if set, is told about each successful receive
+	Health *Health
+}
+
+func NewConsumer(source MessageSource, processor BatchProcessor) *Consumer {
+	return &Consumer{
+		source:     source,
+		processor:  processor,
+		RetryDelay: defaultRetryDelay,
+	}
+}
+
+// Process writes a batch of received messages, acking or nacking each based
+// on the result.
+func (c *Consumer) Process(ctx context.Context, messages []*Message) {
+	if len(messages) == 0 {
+		return
+	}
+
+	//Messages with a valid envelope are processed as a batch per tenant, the
+	//rest are acked straight away as retrying them won't help.
+	var tenants []string
+	batches := make(map[string][]*Message)
+	for _, message := range messages {
+		if message.Err != nil {
+			warnErrorfWithFields(log.Fields{"msg id": message.ID}, message.Err.Error())
+			c.discard(ctx, message, message.Err)
+			continue
+		}
+
+		if _, ok := batches[message.Tenant]; !ok {
+			tenants = append(tenants, message.Tenant)
+		}
+		batches[message.Tenant] = append(batches[message.Tenant], message)
+	}
+
+	for _, tenant := range tenants {
+		c.processBatch(tenantContext(ctx, tenant), batches[tenant])
+	}
+}
+
+// processBatch writes a batch of messages of one tenant
+func (c *Consumer) processBatch(ctx context.Context, batch []*Message) {
+	log.Infof("Processing batch of %d messages", len(batch))
+
+	bodies := make([]string, len(batch))
+	for i, message := range batch {
+		bodies[i] = message.Body
+	}
+
+	ctx, span := tracer.Start(ctx, "Process batch",
+		trace.WithLinks(messageSpanLinks(batch)...),
+		trace.WithAttributes(attribute.Int("batch.size", len(batch))))
+	defer span.End()
+
+	start := time.Now()
+	results := c.processor.ProcessMessagesContext(ctx, bodies)
+	stop := time.Now()
+
+	messagesProcessed.Add(float64(len(batch)))
+	processingTime.Observe(stop.Sub(start).Seconds())
+
+	for i, result := range results {
+		message := batch[i]
+		traceMessage(span, message, result, start, stop)
+
+		loggingFields := log.Fields{"MsgId": message.ID, "Outcome": result.Outcome.String()}
+		switch {
+		case result.Outcome == esatomdatapg.DuplicateConflicting:
+			duplicateConflicts.Inc()
+			log.WithFields(loggingFields).Error("Conflicting duplicate event, message will be discarded")
+		case result.Err != nil:
+			warnErrorfWithFields(
+				loggingFields,
+				"Error processing message: %s",
+				result.Err.Error(),
+			)
+		case result.Outcome == esatomdatapg.DuplicateIdentical:
+			duplicatesIgnored.Inc()
+			log.WithFields(loggingFields).Info("Message already processed")
+		default:
+			log.WithFields(loggingFields).Info("Sucessfully processed message ")
+		}
+
+		switch {
+		case result.Err == nil:
+			c.ack(ctx, message)
+		case !retryMessage(result):
+			c.discard(ctx, message, result.Err)
+		case c.attemptsExhausted(message):
+			warnErrorfWithFields(loggingFields, "Giving up on message after %d attempts", message.ReceiveCount)
+			c.discard(ctx, message, result.Err)
+		default:
+			c.nack(ctx, message)
+		}
+	}
+}
+
+func (c *Consumer) ack(ctx context.Context, message *Message) {
+	if err := c.source.Ack(ctx, message); err != nil {
+		warnErrorf("Error deleting message: %s", err.Error())
+	} else {
+		messagesDeleted.Inc()
+	}
+}
+
+func (c *Consumer) nack(ctx context.Context, message *Message) {
+	if err := c.source.Nack(ctx, message, c.RetryDelay); err != nil {
+		warnErrorf("Error returning message: %s", err.Error())
+	}
+}
+
+// discard removes a message that will not be processed from the source, first
+// recording it as a dead letter if a sink is configured. If the dead letter can't
+// be written the message is left on the source to try again later.
+func (c *Consumer) discard(ctx context.Context, message *Message, cause error) {
+	if c.DeadLetters != nil {
+		if err := c.DeadLetters.DeadLetter(ctx, message, cause); err != nil {
+			warnErrorf("Error writing dead letter: %s", err.Error())
+			c.nack(ctx, message)
+			return
+		}
+		deadLettered.Inc()
+	}
+
+	c.ack(ctx, message)
+}
+
+// attemptsExhausted reports whether a failed message should be dead lettered
+// rather than retried. Without a dead letter sink messages are always retried.
+func (c *Consumer) attemptsExhausted(message *Message) bool {
+	return c.DeadLetters != nil && c.MaxAttempts > 0 && message.ReceiveCount >= c.MaxAttempts
+}
+
+func (c *Consumer) received(messages []*Message) {
+	if c.Health != nil {
+		c.Health.Received(messages)
+	}
+}
+
+// release returns an unprocessed message to the source for immediate redelivery
+func (c *Consumer) release(ctx context.Context, message *Message) {
+	if err := c.source.Nack(ctx, message, 0); err != nil {
+		warnErrorf("Error releasing message: %s", err.Error())
+	}
+}
+
+// tenantContext returns ctx carrying tenant for the processor, or ctx if the
+// message did not name a tenant
+func tenantContext(ctx context.Context, tenant string) context.Context {
+	if tenant == "" {
+		return ctx
+	}
+	return esatomdatapg.ContextWithTenant(ctx, tenant)
+}
+
+// retryMessage decides whether a message that could not be processed should be left
+// on the queue for another attempt. Redelivered events are reported as duplicates
+// and can be acknowledged; conflicting duplicates and messages that cannot be
+// decoded will never succeed on retry.
+func retryMessage(result esatomdatapg.MessageResult) bool {
+	switch {
+	case result.Err == nil:
+		return false
+	case errors.Is(result.Err, esatomdatapg.ErrDuplicateEvent):
+		return false
+	case errors.Is(result.Err, esatomdatapg.ErrDecode):
+		return false
+	default:
+		return true
+	}
+}
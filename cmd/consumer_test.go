@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xtracdev/es-atom-data-pg"
+)
+
+// fakeProcessor returns canned results keyed by message body
+type fakeProcessor struct {
+	sync.Mutex
+	results map[string]esatomdatapg.MessageResult
+	batches [][]string
+	tenants []string
+}
+
+func (fp *fakeProcessor) ProcessMessagesContext(ctx context.Context, msgs []string) []esatomdatapg.MessageResult {
+	fp.Lock()
+	defer fp.Unlock()
+
+	fp.batches = append(fp.batches, msgs)
+	tenant, _ := esatomdatapg.TenantFromContext(ctx)
+	fp.tenants = append(fp.tenants, tenant)
+
+	results := make([]esatomdatapg.MessageResult, len(msgs))
+	for i, msg := range msgs {
+		results[i] = fp.results[msg]
+	}
+	return results
+}
+
+func ids(messages []*Message) []string {
+	var result []string
+	for _, m := range messages {
+		result = append(result, m.Body)
+	}
+	return result
+}
+
+// processReceived receives one batch from the consumer's source and processes
+// it, as a pool worker would
+func processReceived(t *testing.T, consumer *Consumer) {
+	messages, err := consumer.source.Receive(context.Background())
+	if assert.Nil(t, err) {
+		consumer.Process(context.Background(), messages)
+	}
+}
+
+func TestProcessAcksAndRetries(t *testing.T) {
+	source := NewMemorySource("ok", "dup", "conflict", "undecodable", "transient")
+	processor := &fakeProcessor{
+		results: map[string]esatomdatapg.MessageResult{
+			"ok":          {Outcome: esatomdatapg.Inserted},
+			"dup":         {Outcome: esatomdatapg.DuplicateIdentical},
+			"conflict":    {Outcome: esatomdatapg.DuplicateConflicting, Err: &esatomdatapg.Error{Kind: esatomdatapg.ErrDuplicateEvent}},
+			"undecodable": {Err: &esatomdatapg.Error{Kind: esatomdatapg.ErrDecode}},
+			"transient":   {Err: &esatomdatapg.Error{Kind: esatomdatapg.ErrTransient}},
+		},
+	}
+
+	processReceived(t, NewConsumer(source, processor))
+	assert.Equal(t, 1, len(processor.batches))
+	assert.Equal(t, []string{"ok", "dup", "conflict", "undecodable"}, ids(source.Acked()))
+	assert.Equal(t, []string{"transient"}, ids(source.Nacked()))
+	assert.Equal(t, 1, source.Pending())
+}
+
+func TestProcessAcksEnvelopeErrors(t *testing.T) {
+	source := NewMemorySource()
+	source.AddMessage(&Message{ID: "bad", Err: errors.New("bad envelope")})
+	processor := &fakeProcessor{}
+
+	processReceived(t, NewConsumer(source, processor))
+	assert.Equal(t, 0, len(processor.batches))
+	if assert.Equal(t, 1, len(source.Acked())) {
+		assert.Equal(t, "bad", source.Acked()[0].ID)
+	}
+}
+
+func TestProcessNothingReceived(t *testing.T) {
+	processor := &fakeProcessor{}
+	processReceived(t, NewConsumer(NewMemorySource(), processor))
+	assert.Equal(t, 0, len(processor.batches))
+}
+
+func TestProcessBatchesByTenant(t *testing.T) {
+	source := NewMemorySource()
+	for _, m := range []*Message{
+		{ID: "1", Body: "a1", Tenant: "acme"},
+		{ID: "2", Body: "n1"},
+		{ID: "3", Body: "a2", Tenant: "acme"},
+		{ID: "4", Body: "g1", Tenant: "globex"},
+	} {
+		source.AddMessage(m)
+	}
+	processor := &fakeProcessor{}
+
+	processReceived(t, NewConsumer(source, processor))
+	assert.Equal(t, [][]string{{"a1", "a2"}, {"n1"}, {"g1"}}, processor.batches)
+	assert.Equal(t, []string{"acme", "", "globex"}, processor.tenants)
+	assert.Equal(t, 4, len(source.Acked()))
+}
+
+func TestRetryMessage(t *testing.T) {
+	assert.False(t, retryMessage(esatomdatapg.MessageResult{}))
+	assert.False(t, retryMessage(esatomdatapg.MessageResult{Outcome: esatomdatapg.DuplicateIdentical}))
+	assert.False(t, retryMessage(esatomdatapg.MessageResult{Err: &esatomdatapg.Error{Kind: esatomdatapg.ErrDuplicateEvent}}))
+	assert.False(t, retryMessage(esatomdatapg.MessageResult{Err: &esatomdatapg.Error{Kind: esatomdatapg.ErrDecode}}))
+	assert.True(t, retryMessage(esatomdatapg.MessageResult{Err: errors.New("boom")}))
+}
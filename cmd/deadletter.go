@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/xtracdev/es-atom-data-pg"
+)
+
+// DeadLetterSink records messages that will not be processed, so they can be
+// inspected and replayed instead of being lost.
+type DeadLetterSink interface {
+	DeadLetter(ctx context.Context, msg *Message, cause error) error
+}
+
+// rawBody returns the message as received, falling back to the body for
+// sources without an envelope
+func rawBody(msg *Message) string {
+	if msg.Raw != "" {
+		return msg.Raw
+	}
+	return msg.Body
+}
+
+// PGDeadLetterSink records dead letters in the t_aedl_dead_letter table
+type PGDeadLetterSink struct {
+	db *sql.DB
+}
+
+func NewPGDeadLetterSink(db *sql.DB) *PGDeadLetterSink {
+	return &PGDeadLetterSink{db: db}
+}
+
+func (s *PGDeadLetterSink) DeadLetter(ctx context.Context, msg *Message, cause error) error {
+	log.WithFields(log.Fields{"MsgId": msg.ID}).Warnf("Dead letter message %s after %d attempts: %s",
+		msg.ID, msg.ReceiveCount, cause.Error())
+
+	return esatomdatapg.WriteDeadLetter(ctx, s.db, &esatomdatapg.DeadLetter{
+		MessageID: msg.ID,
+		Body:      msg.Body,
+		Raw:       rawBody(msg),
+		Error:     cause.Error(),
+		Attempts:  msg.ReceiveCount,
+	})
+}
+
+// SQSDeadLetterSink sends dead letters to an SQS queue. The message is sent as
+// received, so the dead letter queue can be replayed with an SQSSource; the
+// error and attempt count are sent as message attributes.
+type SQSDeadLetterSink struct {
+	svc      *sqs.SQS
+	queueURL string
+}
+
+func NewSQSDeadLetterSink(svc *sqs.SQS, queueURL string) *SQSDeadLetterSink {
+	return &SQSDeadLetterSink{svc: svc, queueURL: queueURL}
+}
+
+func (s *SQSDeadLetterSink) DeadLetter(ctx context.Context, msg *Message, cause error) error {
+	log.WithFields(log.Fields{"MsgId": msg.ID}).Warnf("Send message %s to dead letter queue: %s", msg.ID, cause.Error())
+
+	params := &sqs.SendMessageInput{
+		QueueUrl:    aws.String(s.queueURL),
+		MessageBody: aws.String(rawBody(msg)),
+		MessageAttributes: map[string]*sqs.MessageAttributeValue{
+			"Error": {
+				DataType:    aws.String("String"),
+				StringValue: aws.String(cause.Error()),
+			},
+			"Attempts": {
+				DataType:    aws.String("Number"),
+				StringValue: aws.String(strconv.Itoa(msg.ReceiveCount)),
+			},
+			"OriginalMessageId": {
+				DataType:    aws.String("String"),
+				StringValue: aws.String(msg.ID),
+			},
+		},
+	}
+	_, err := s.svc.SendMessageWithContext(ctx, params)
+	return err
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xtracdev/es-atom-data-pg"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+// fakeSink records dead letters, failing if err is set
+type fakeSink struct {
+	err     error
+	letters []*Message
+	causes  []error
+}
+
+func (fs *fakeSink) DeadLetter(ctx context.Context, msg *Message, cause error) error {
+	if fs.err != nil {
+		return fs.err
+	}
+	fs.letters = append(fs.letters, msg)
+	fs.causes = append(fs.causes, cause)
+	return nil
+}
+
+func TestProcessDeadLettersPermanentFailures(t *testing.T) {
+	source := NewMemorySource("ok", "conflict", "undecodable", "transient")
+	source.AddMessage(&Message{ID: "bad", Raw: "not sns", Err: errors.New("bad envelope")})
+	processor := &fakeProcessor{
+		results: map[string]esatomdatapg.MessageResult{
+			"conflict":    {Outcome: esatomdatapg.DuplicateConflicting, Err: &esatomdatapg.Error{Kind: esatomdatapg.ErrDuplicateEvent}},
+			"undecodable": {Err: &esatomdatapg.Error{Kind: esatomdatapg.ErrDecode}},
+			"transient":   {Err: &esatomdatapg.Error{Kind: esatomdatapg.ErrTransient}},
+		},
+	}
+	sink := &fakeSink{}
+
+	consumer := NewConsumer(source, processor)
+	consumer.DeadLetters = sink
+	consumer.MaxAttempts = 3
+
+	processReceived(t, consumer)
+	assert.Equal(t, []string{"", "conflict", "undecodable"}, ids(sink.letters))
+	assert.Equal(t, "bad envelope", sink.causes[0].Error())
+	assert.Equal(t, []string{"", "ok", "conflict", "undecodable"}, ids(source.Acked()))
+	assert.Equal(t, []string{"transient"}, ids(source.Nacked()))
+}
+
+func TestProcessDeadLettersAfterMaxAttempts(t *testing.T) {
+	source := NewMemorySource("transient")
+	processor := &fakeProcessor{
+		results: map[string]esatomdatapg.MessageResult{
+			"transient": {Err: &esatomdatapg.Error{Kind: esatomdatapg.ErrTransient}},
+		},
+	}
+	sink := &fakeSink{}
+
+	consumer := NewConsumer(source, processor)
+	consumer.DeadLetters = sink
+	consumer.MaxAttempts = 3
+
+	for i := 0; i < 3; i++ {
+		processReceived(t, consumer)
+	}
+
+	assert.Equal(t, 2, len(source.Nacked()))
+	if assert.Equal(t, 1, len(sink.letters)) {
+		assert.Equal(t, 3, sink.letters[0].ReceiveCount)
+		assert.True(t, errors.Is(sink.causes[0], esatomdatapg.ErrTransient))
+	}
+	assert.Equal(t, 1, len(source.Acked()))
+	assert.Equal(t, 0, source.Pending())
+}
+
+func TestProcessDeadLetterFailureRetries(t *testing.T) {
+	source := NewMemorySource("undecodable")
+	processor := &fakeProcessor{
+		results: map[string]esatomdatapg.MessageResult{
+			"undecodable": {Err: &esatomdatapg.Error{Kind: esatomdatapg.ErrDecode}},
+		},
+	}
+
+	consumer := NewConsumer(source, processor)
+	consumer.DeadLetters = &fakeSink{err: errors.New("sink down")}
+
+	processReceived(t, consumer)
+	assert.Equal(t, 0, len(source.Acked()))
+	assert.Equal(t, []string{"undecodable"}, ids(source.Nacked()))
+}
+
+func TestPGDeadLetterSink(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer db.Close()
+
+	mock.ExpectExec("insert into t_aedl_dead_letter").
+		WithArgs("msg-1", "body", "raw", "boom", 2).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	msg := &Message{ID: "msg-1", Body: "body", Raw: "raw", ReceiveCount: 2}
+	assert.Nil(t, NewPGDeadLetterSink(db).DeadLetter(context.Background(), msg, errors.New("boom")))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestReplayDeadLetters(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer db.Close()
+
+	columns := []string{"id", "recorded", "message_id", "body", "raw", "error", "attempts"}
+	mock.ExpectQuery("select id, recorded").WithArgs(0, replayPageSize).WillReturnRows(
+		sqlmock.NewRows(columns).
+			AddRow(1, time.Now(), "m1", "ok", "ok", "boom", 5).
+			AddRow(2, time.Now(), "m2", "", `{"Message":"fails"}`, "boom", 5))
+	mock.ExpectExec("delete from t_aedl_dead_letter").WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("update t_aedl_dead_letter").WithArgs(2, "still failing").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("select id, recorded").WithArgs(2, replayPageSize).WillReturnRows(sqlmock.NewRows(columns))
+
+	processor := &fakeProcessor{
+		results: map[string]esatomdatapg.MessageResult{
+			"fails": {Err: errors.New("still failing")},
+		},
+	}
+
+	replayed, failed, err := ReplayDeadLetters(context.Background(), db, processor)
+	if assert.Nil(t, err) {
+		assert.Equal(t, 1, replayed)
+		assert.Equal(t, 1, failed)
+		assert.Equal(t, [][]string{{"ok"}, {"fails"}}, processor.batches)
+	}
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
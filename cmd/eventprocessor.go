@@ -1,17 +1,22 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"database/sql"
+	"flag"
+	"io"
+	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
-	"github.com/armon/go-metrics"
-	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/lib/pq"
 	"github.com/xtracdev/envinject"
 	"github.com/xtracdev/es-atom-data-pg"
 	"github.com/xtracdev/pgconn"
@@ -21,73 +26,75 @@ import (
 const (
 	QueueUrlEnv         = "EVENT_QUEUE_URL"
 	LogLevel            = "PG_ATOMDATA_LOG_LEVEL"
-	MetricsDumpInterval = 1 * time.Minute
+	ReceiveBatchSizeEnv = "RECEIVE_BATCH_SIZE"
+	ReceiverCountEnv    = "RECEIVER_COUNT"
+	WorkerCountEnv      = "WORKER_COUNT"
+	HTTPListenAddrEnv   = "HTTP_LISTEN_ADDR"
+	TracesExporterEnv   = "OTEL_TRACES_EXPORTER"
+
+	//Health thresholds, as durations such as 5m
+	HealthMaxReceiveAgeEnv = "HEALTH_MAX_RECEIVE_AGE"
+	HealthMaxLagEnv        = "HEALTH_MAX_LAG"
+
+	//Ingest mode selects where events are read from: sqs (the default), kafka,
+	//or postgres, which reads the publish table of the source event store directly.
+	IngestModeEnv          = "INGEST_MODE"
+	IngestModeSQS          = "sqs"
+	IngestModeKafka        = "kafka"
+	IngestModePostgres     = "postgres"
+	SourceDBConnectEnv     = "SOURCE_DB_CONNECT"
+	SourceNotifyChannelEnv = "SOURCE_NOTIFY_CHANNEL"
+	SourcePollIntervalEnv  = "SOURCE_POLL_INTERVAL"
+	KafkaBrokersEnv        = "KAFKA_BROKERS"
+	KafkaTopicsEnv         = "KAFKA_TOPICS"
+	KafkaGroupIDEnv        = "KAFKA_GROUP_ID"
+
+	//Dead letter sink for messages that will not be processed: none (the
+	//default), sqs, or postgres for the t_aedl_dead_letter table.
+	DeadLetterSinkEnv     = "DEAD_LETTER_SINK"
+	DeadLetterSinkSQS     = "sqs"
+	DeadLetterSinkPG      = "postgres"
+	DeadLetterQueueURLEnv = "DEAD_LETTER_QUEUE_URL"
+	MaxAttemptsEnv        = "MAX_ATTEMPTS"
+
+	defaultReceiveBatchSize = 10
+	defaultKafkaGroupID     = "esatomdatapg"
+	defaultMaxAttempts      = 5
+	defaultHTTPListenAddr   = ":8080"
+	maxReceiveBatchSize     = 10
 )
 
 var (
 	queueURL          string
 	atomDataProcessor *esatomdatapg.AtomDataProcessor
-	metricsSink       = metrics.NewInmemSink(MetricsDumpInterval, 2*MetricsDumpInterval)
-	signal            = metrics.DefaultInmemSignal(metricsSink)
-	errorCounter      = []string{"errors"}
-	messagesReceived  = []string{"messages_received"}
-	messagesProcessed = []string{"messages_processed"}
-	messagesDeleted   = []string{"messages_deleted"}
-	processingTime    = []string{"processing_time"}
 )
 
 func init() {
 	//Grab queue url
 	queueURL = os.Getenv(QueueUrlEnv)
-
-	//Initialize metrics library, kick of metrics dump go routine.
-	metrics.NewGlobal(metrics.DefaultConfig("atomdata"), metricsSink)
-	pid := syscall.Getpid()
-	log.Infof("Using %d for signal pid", pid)
-	go func() {
-		c := time.Tick(MetricsDumpInterval)
-		for range c {
-			//Signal self to dump metrics to stdout
-			syscall.Kill(pid, metrics.DefaultSignal)
-		}
-	}()
 }
 
 func warnErrorf(format string, args ...interface{}) {
-	metricsSink.IncrCounter(errorCounter, 1)
+	errorCounter.Inc()
 	log.Warnf(format, args...)
 }
 
 func warnErrorfWithFields(fields log.Fields, format string, args ...interface{}) {
-	metricsSink.IncrCounter(errorCounter, 1)
+	errorCounter.Inc()
 	log.WithFields(fields).Warnf(format, args...)
 }
 
-func errorDelay() {
-	time.Sleep(5 * time.Second)
-}
-
-type SNSMessage struct {
-	Message string
-}
-
-func SNSMessageFromRawMessage(raw string) (*SNSMessage, error) {
-	var snsMessage SNSMessage
-	err := json.Unmarshal([]byte(raw), &snsMessage)
-	return &snsMessage, err
-}
-
-func retryMessage(err error) bool {
-
-	errorMsg := err.Error()
-	if strings.Contains(errorMsg, "duplicate key value violates unique constraint") {
-		return false
-	}
-
-	return true
+// receiveBackoff spaces out receives after consecutive receive errors
+var receiveBackoff = esatomdatapg.BackoffPolicy{
+	Initial:    time.Second,
+	Max:        time.Minute,
+	Multiplier: 2,
+	Jitter:     0.2,
 }
 
 func main() {
+	replay := flag.Bool("replay-dead-letters", false, "Replay dead letters from the dead letter sink, then exit")
+	flag.Parse()
 
 	log.SetFormatter(&log.JSONFormatter{})
 
@@ -98,10 +105,10 @@ func main() {
 
 	pgpublish.SetLogLevel(LogLevel, env)
 
-	log.Infof("Queue url: %s", queueURL)
-	if queueURL == "" {
-		log.Fatalf("%s must be specified in the environment", QueueUrlEnv)
-	}
+	//Stop receiving on SIGINT or SIGTERM; the pool finishes in-flight work
+	//before Run returns.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
 	log.Info("Connect to DB")
 	postgressConnection, err := pgconn.OpenAndConnect(env, 100)
@@ -109,92 +116,321 @@ func main() {
 		log.Fatalf("Failed environment init: %s", err.Error())
 	}
 
+	pm := newProcessorMetrics()
+	atomDataProcessor, err = esatomdatapg.NewAtomDataProcessor(postgressConnection.DB, env, esatomdatapg.WithMetrics(pm))
+	if err != nil {
+		log.Fatalf("Unable to instantiate atom processor: %s", err.Error())
+	}
+
+	if *replay {
+		replayDeadLetters(ctx, env, postgressConnection.DB)
+		return
+	}
+
+	shutdownTracing, err := initTracing(ctx, env)
+	if err != nil {
+		log.Fatalf("Unable to initialize tracing: %s", err.Error())
+	}
+
+	health := NewHealth(postgressConnection.DB)
+	health.MaxReceiveAge = durationFromEnv(env, HealthMaxReceiveAgeEnv, defaultMaxReceiveAge)
+	health.MaxLag = durationFromEnv(env, HealthMaxLagEnv, defaultMaxLag)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler(newMetricsRegistry(pm, postgressConnection.DB)))
+	mux.Handle("/healthz", health.LivenessHandler())
+	mux.Handle("/readyz", health.ReadinessHandler())
+	server := startHTTPServer(env, mux)
+
+	//Sources consuming in the background keep going until the pool has finished,
+	//so in-flight messages can still be acked.
+	sourceCtx, stopSource := context.WithCancel(context.Background())
+	defer stopSource()
+
+	var source MessageSource
+	switch mode := env.Getenv(IngestModeEnv); mode {
+	case "", IngestModeSQS:
+		source = newSQSSourceFromEnv(env)
+	case IngestModeKafka:
+		kafkaSource := newKafkaSourceFromEnv(env)
+		go func() {
+			if err := kafkaSource.Consume(sourceCtx); err != nil && sourceCtx.Err() == nil {
+				log.Fatalf("Kafka consumer failed: %s", err.Error())
+			}
+		}()
+		source = kafkaSource
+	case IngestModePostgres:
+		source = newPGSourceFromEnv(env)
+	default:
+		log.Fatalf("Unknown %s %s", IngestModeEnv, mode)
+	}
+
+	consumer := NewConsumer(source, atomDataProcessor)
+	consumer.Health = health
+	consumer.DeadLetters = newDeadLetterSinkFromEnv(env, postgressConnection.DB)
+	if consumer.DeadLetters != nil {
+		consumer.MaxAttempts = positiveIntFromEnv(env, MaxAttemptsEnv, defaultMaxAttempts)
+		log.Infof("Dead letter messages after %d attempts", consumer.MaxAttempts)
+	}
+
+	batchSize := int(receiveBatchSize(env))
+	pool := NewPool(
+		consumer,
+		positiveIntFromEnv(env, ReceiverCountEnv, 1),
+		positiveIntFromEnv(env, WorkerCountEnv, 1),
+		batchSize,
+		batchSize,
+	)
+
+	//Close quiet pages by age in the background; pages are closed by count as
+	//events are written.
+	if atomDataProcessor.ClosesByAge() {
+		interval := rolloverInterval(atomDataProcessor.MaxPageAge())
+		log.Infof("Closing recent pages by age, checking every %s", interval)
+		go atomDataProcessor.RunRollover(ctx, interval)
+	}
+
+	pool.Run(ctx)
+
+	log.Info("Shutting down")
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelShutdown()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Warnf("Error stopping HTTP server: %s", err.Error())
+	}
+
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		log.Warnf("Error flushing traces: %s", err.Error())
+	}
+
+	stopSource()
+	if closer, ok := source.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Warnf("Error closing message source: %s", err.Error())
+		}
+	}
+
+	if err := postgressConnection.DB.Close(); err != nil {
+		log.Warnf("Error closing DB: %s", err.Error())
+	}
+
+}
+
+// startHTTPServer serves the metrics and health endpoints
+func startHTTPServer(env *envinject.InjectedEnv, handler http.Handler) *http.Server {
+	addr := env.Getenv(HTTPListenAddrEnv)
+	if addr == "" {
+		addr = defaultHTTPListenAddr
+	}
+
+	server := &http.Server{Addr: addr, Handler: handler}
+	go func() {
+		log.Infof("Serving metrics and health checks on %s", addr)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("HTTP server failed: %s", err.Error())
+		}
+	}()
+
+	return server
+}
+
+func newSQSSourceFromEnv(env *envinject.InjectedEnv) *SQSSource {
+	log.Infof("Queue url: %s", queueURL)
+	if queueURL == "" {
+		log.Fatalf("%s must be specified in the environment", QueueUrlEnv)
+	}
+
+	return NewSQSSource(newSQSClient(), queueURL, receiveBatchSize(env))
+}
+
+func newSQSClient() *sqs.SQS {
 	log.Info("Create session")
 	session, err := session.NewSession()
 	if err != nil {
 		log.Fatal(err.Error())
 	}
 
-	svc := sqs.New(session)
+	return sqs.New(session)
+}
 
-	params := &sqs.ReceiveMessageInput{
-		QueueUrl:            aws.String(queueURL), // Required
-		MaxNumberOfMessages: aws.Int64(1),
-		WaitTimeSeconds:     aws.Int64(10),
+func newDeadLetterSinkFromEnv(env *envinject.InjectedEnv, db *sql.DB) DeadLetterSink {
+	switch sink := env.Getenv(DeadLetterSinkEnv); sink {
+	case "":
+		return nil
+	case DeadLetterSinkPG:
+		return NewPGDeadLetterSink(db)
+	case DeadLetterSinkSQS:
+		return NewSQSDeadLetterSink(newSQSClient(), deadLetterQueueURL(env))
+	default:
+		log.Fatalf("Unknown %s %s", DeadLetterSinkEnv, sink)
+		return nil
 	}
+}
 
-	atomDataProcessor, err = esatomdatapg.NewAtomDataProcessor(postgressConnection.DB, env)
-	if err != nil {
-		log.Fatalf("Unable to instantiate atom processor: %s", err.Error())
+func deadLetterQueueURL(env *envinject.InjectedEnv) string {
+	url := env.Getenv(DeadLetterQueueURLEnv)
+	if url == "" {
+		log.Fatalf("%s must be specified in the environment", DeadLetterQueueURLEnv)
 	}
+	return url
+}
 
-	log.Info("Process messages")
-	for {
-		log.Debug("Receieve message")
-		resp, err := svc.ReceiveMessage(params)
+// replayDeadLetters replays the dead letters in the configured sink. Dead letters
+// in the table are processed directly; those in an SQS dead letter queue are moved
+// back to the event queue.
+func replayDeadLetters(ctx context.Context, env *envinject.InjectedEnv, db *sql.DB) {
+	switch sink := env.Getenv(DeadLetterSinkEnv); sink {
+	case DeadLetterSinkPG:
+		replayed, failed, err := ReplayDeadLetters(ctx, db, atomDataProcessor)
 		if err != nil {
-			warnErrorf("Error receieving message: %s", err.Error())
-			errorDelay()
-			continue
+			log.Fatalf("Dead letter replay failed: %s", err.Error())
 		}
-
-		messages := resp.Messages
-		if len(messages) == 0 {
-			continue
+		log.Infof("Replayed %d dead letters, %d failed", replayed, failed)
+	case DeadLetterSinkSQS:
+		if queueURL == "" {
+			log.Fatalf("%s must be specified in the environment", QueueUrlEnv)
 		}
+		moved, err := RedriveQueue(ctx, newSQSClient(), deadLetterQueueURL(env), queueURL)
+		if err != nil {
+			log.Fatalf("Dead letter redrive failed: %s", err.Error())
+		}
+		log.Infof("Moved %d dead letters to %s", moved, queueURL)
+	default:
+		log.Fatalf("%s must be sqs or postgres to replay dead letters", DeadLetterSinkEnv)
+	}
+}
+
+func newKafkaSourceFromEnv(env *envinject.InjectedEnv) *KafkaSource {
+	brokers := splitList(env.Getenv(KafkaBrokersEnv))
+	topics := splitList(env.Getenv(KafkaTopicsEnv))
+	if len(brokers) == 0 || len(topics) == 0 {
+		log.Fatalf("%s and %s must be specified in the environment", KafkaBrokersEnv, KafkaTopicsEnv)
+	}
 
-		metricsSink.IncrCounter(messagesReceived, 1)
+	groupID := env.Getenv(KafkaGroupIDEnv)
+	if groupID == "" {
+		groupID = defaultKafkaGroupID
+	}
+
+	log.Infof("Consume %v from %v as group %s", topics, brokers, groupID)
+	group, err := NewKafkaConsumerGroup(brokers, groupID)
+	if err != nil {
+		log.Fatalf("Failed to create Kafka consumer group: %s", err.Error())
+	}
 
-		message := *messages[0]
+	return NewKafkaSource(group, topics, int(receiveBatchSize(env)))
+}
 
-		loggingFields := log.Fields{"MsgId": *message.MessageId}
+// splitList splits a comma separated list, ignoring empty items
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
 
-		log.WithFields(loggingFields).Infof("Extracting SNS message from %s", *message.MessageId)
+func newPGSourceFromEnv(env *envinject.InjectedEnv) *PGSource {
+	connectStr := env.Getenv(SourceDBConnectEnv)
+	if connectStr == "" {
+		log.Fatalf("%s must be specified in the environment", SourceDBConnectEnv)
+	}
 
-		snsMessageOK := true
-		sns, err := SNSMessageFromRawMessage(*message.Body)
+	log.Info("Connect to source DB")
+	db, err := sql.Open("postgres", connectStr)
+	if err != nil {
+		log.Fatalf("Failed to open source DB: %s", err.Error())
+	}
+
+	if err = db.Ping(); err != nil {
+		log.Fatalf("Failed to connect to source DB: %s", err.Error())
+	}
+
+	var listener *pq.Listener
+	if channel := env.Getenv(SourceNotifyChannelEnv); channel != "" {
+		log.Infof("Listen for notifications on %s", channel)
+		listener, err = NewPGListener(connectStr, channel)
 		if err != nil {
-			snsMessageOK = false
-			warnErrorfWithFields(log.Fields{"msg id": *message.MessageId}, err.Error())
+			log.Fatalf("Failed to listen on %s: %s", channel, err.Error())
 		}
+	}
 
-		if snsMessageOK {
-			log.WithFields(loggingFields).Infof("Processing message from %s", *message.MessageId)
+	return NewPGSource(db, listener, int(receiveBatchSize(env)), sourcePollInterval(env))
+}
 
-			start := time.Now()
-			err = atomDataProcessor.ProcessMessage(sns.Message)
-			if err != nil {
-				warnErrorfWithFields(
-					loggingFields,
-					"Error processing message: %s",
-					err.Error(),
-				)
+// sourcePollInterval reads how often the publish table is polled when no
+// notification arrives.
+func sourcePollInterval(env *envinject.InjectedEnv) time.Duration {
+	return durationFromEnv(env, SourcePollIntervalEnv, defaultSourcePollInterval)
+}
 
-				if retryMessage(err) == true {
-					continue
-				}
-			} else {
+// rolloverInterval is how often the recent page is checked against maxAge: a tenth
+// of maxAge, between a second and a minute. A policy closing pages by age without
+// an AgePolicy has no maxAge, and is checked every minute.
+func rolloverInterval(maxAge time.Duration) time.Duration {
+	if maxAge == 0 {
+		return time.Minute
+	}
 
-				log.WithFields(loggingFields).Info("Sucessfully processed message ")
+	interval := maxAge / 10
+	if interval < time.Second {
+		return time.Second
+	}
+	if interval > time.Minute {
+		return time.Minute
+	}
+	return interval
+}
 
-			}
-			stop := time.Now()
+// durationFromEnv reads a duration from the environment, returning defaultValue
+// if it is not set or not a positive duration.
+func durationFromEnv(env *envinject.InjectedEnv, name string, defaultValue time.Duration) time.Duration {
+	value := env.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
 
-			metricsSink.IncrCounter(messagesProcessed, 1)
-			metrics.AddSample(processingTime, float32(stop.Sub(start).Nanoseconds()/1000000.0))
-		}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		log.Warnf("Invalid %s %s, defaulting to %s", name, value, defaultValue)
+		return defaultValue
+	}
 
-		log.WithFields(loggingFields).Infof("Delete message %s", *message.MessageId)
+	return d
+}
 
-		params := &sqs.DeleteMessageInput{
-			QueueUrl:      aws.String(queueURL),
-			ReceiptHandle: message.ReceiptHandle,
-		}
-		_, err = svc.DeleteMessage(params)
-		if err != nil {
-			warnErrorf("Error deleting message: %s", err.Error())
-		} else {
-			metricsSink.IncrCounter(messagesDeleted, 1)
-		}
+// receiveBatchSize reads the number of messages to receive and process
+// together from the environment. SQS allows at most 10.
+func receiveBatchSize(env *envinject.InjectedEnv) int64 {
+	batchSize := env.Getenv(ReceiveBatchSizeEnv)
+	if batchSize == "" {
+		return defaultReceiveBatchSize
 	}
+
+	size, err := strconv.ParseInt(batchSize, 10, 64)
+	if err != nil || size < 1 || size > maxReceiveBatchSize {
+		log.Warnf("Invalid %s %s, defaulting to %d", ReceiveBatchSizeEnv, batchSize, defaultReceiveBatchSize)
+		return defaultReceiveBatchSize
+	}
+
+	return size
+}
+
+// positiveIntFromEnv reads a count from the environment, returning defaultValue
+// if it is not set or not a positive integer.
+func positiveIntFromEnv(env *envinject.InjectedEnv, name string, defaultValue int) int {
+	value := env.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		log.Warnf("Invalid %s %s, defaulting to %d", name, value, defaultValue)
+		return defaultValue
+	}
+
+	return n
 }
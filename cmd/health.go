@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	defaultMaxReceiveAge = 5 * time.Minute
+	defaultMaxLag        = 15 * time.Minute
+	healthCheckTimeout   = 5 * time.Second
+
+	//The latest feed of any feed of any tenant whose previous feed is missing
+	sqlBrokenFeedChain = `select f.tenant, f.feed_name, f.feedid, f.previous from t_aefd_feed f
+		where f.id in (select max(id) from t_aefd_feed group by tenant, feed_name)
+		and f.previous is not null
+		and not exists (select 1 from t_aefd_feed p where p.tenant = f.tenant and p.feedid = f.previous)
+		limit 1`
+)
+
+// Health tracks the progress of the processing loop and serves the liveness
+// and readiness endpoints.
+//
+// The processor is live while receives keep succeeding; an orchestrator should
+// restart a processor that is not live. It is ready when, in addition, the
+// database is reachable, the feed chain of every feed of every tenant can be
+// followed from its latest feed, and the oldest message of the last batch received is no older than MaxLag.
+type Health struct {
+	db *sql.DB
+
+	//MaxReceiveAge is how long the processor may go without a successful receive
+	MaxReceiveAge time.Duration
+
+	//MaxLag is the maximum age of the oldest message received
+	MaxLag time.Duration
+
+	now func() time.Time
+
+	sync.Mutex
+	lastReceive time.Time
+	oldestSent  time.Time
+}
+
+func NewHealth(db *sql.DB) *Health {
+	return &Health{
+		db:            db,
+		MaxReceiveAge: defaultMaxReceiveAge,
+		MaxLag:        defaultMaxLag,
+		now:           time.Now,
+		lastReceive:   time.Now(),
+	}
+}
+
+// Received records a successful receive, which may have returned no messages
+func (h *Health) Received(messages []*Message) {
+	var oldest time.Time
+	for _, m := range messages {
+		if !m.SentAt.IsZero() && (oldest.IsZero() || m.SentAt.Before(oldest)) {
+			oldest = m.SentAt
+		}
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	h.lastReceive = h.now()
+	h.oldestSent = oldest
+}
+
+// checkReceive fails if there has been no successful receive for MaxReceiveAge
+func (h *Health) checkReceive() error {
+	h.Lock()
+	defer h.Unlock()
+
+	if age := h.now().Sub(h.lastReceive); age > h.MaxReceiveAge {
+		return fmt.Errorf("No successful receive for %s", age.Round(time.Second))
+	}
+	return nil
+}
+
+// checkLag fails if the oldest message of the last batch is older than MaxLag
+func (h *Health) checkLag() error {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.oldestSent.IsZero() {
+		return nil
+	}
+
+	if lag := h.now().Sub(h.oldestSent); lag > h.MaxLag {
+		return fmt.Errorf("Oldest message received is %s old", lag.Round(time.Second))
+	}
+	return nil
+}
+
+func (h *Health) checkDB(ctx context.Context) error {
+	return h.db.PingContext(ctx)
+}
+
+// checkFeedChain fails if the latest feed of any feed of any tenant refers to a
+// previous feed that can't be retrieved
+func (h *Health) checkFeedChain(ctx context.Context) error {
+	var tenant, feedName, last, previous string
+	err := h.db.QueryRowContext(ctx, sqlBrokenFeedChain).Scan(&tenant, &feedName, &last, &previous)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return fmt.Errorf("Feed %s of feed %s of tenant %s refers to missing previous feed %s",
+		last, feedName, tenant, previous)
+}
+
+type healthCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// LivenessHandler serves /healthz
+func (h *Health) LivenessHandler() http.Handler {
+	return h.handler([]healthCheck{
+		{"receive", func(ctx context.Context) error { return h.checkReceive() }},
+	})
+}
+
+// ReadinessHandler serves /readyz
+func (h *Health) ReadinessHandler() http.Handler {
+	return h.handler([]healthCheck{
+		{"receive", func(ctx context.Context) error { return h.checkReceive() }},
+		{"lag", func(ctx context.Context) error { return h.checkLag() }},
+		{"database", h.checkDB},
+		{"feedchain", h.checkFeedChain},
+	})
+}
+
+// handler runs the checks, responding 200 if all pass and 503 otherwise, with
+// the result of each check in the body
+func (h *Health) handler(checks []healthCheck) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+		defer cancel()
+
+		status := http.StatusOK
+		results := make(map[string]string)
+		for _, c := range checks {
+			if err := c.check(ctx); err != nil {
+				log.Warnf("Health check %s failed: %s", c.name, err.Error())
+				results[c.name] = err.Error()
+				status = http.StatusServiceUnavailable
+				continue
+			}
+			results[c.name] = "ok"
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(results)
+	})
+}
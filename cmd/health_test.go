@@ -0,0 +1,153 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func newTestHealth(db *sql.DB, now time.Time) *Health {
+	h := NewHealth(db)
+	h.now = func() time.Time { return now }
+	h.lastReceive = now
+	return h
+}
+
+func checkHealth(t *testing.T, handler http.Handler) (int, map[string]string) {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+	results := make(map[string]string)
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &results))
+	return w.Code, results
+}
+
+func TestLivenessReceiveAge(t *testing.T) {
+	db, _, err := sqlmock.New()
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer db.Close()
+
+	now := time.Now()
+	h := newTestHealth(db, now)
+
+	code, results := checkHealth(t, h.LivenessHandler())
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok", results["receive"])
+
+	h.now = func() time.Time { return now.Add(h.MaxReceiveAge + time.Second) }
+	code, results = checkHealth(t, h.LivenessHandler())
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Contains(t, results["receive"], "No successful receive")
+
+	h.Received(nil)
+	code, _ = checkHealth(t, h.LivenessHandler())
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestReadinessOK(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("select f.tenant, f.feed_name, f.feedid, f.previous from t_aefd_feed").
+		WillReturnRows(sqlmock.NewRows([]string{"tenant", "feed_name", "feedid", "previous"}))
+
+	now := time.Now()
+	h := newTestHealth(db, now)
+	h.Received([]*Message{{SentAt: now.Add(-time.Minute)}, {}})
+
+	code, results := checkHealth(t, h.ReadinessHandler())
+	assert.Equal(t, http.StatusOK, code)
+	for _, check := range []string{"receive", "lag", "database", "feedchain"} {
+		assert.Equal(t, "ok", results[check], check)
+	}
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestReadinessBrokenFeedChain(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer db.Close()
+
+	//The broken chain belongs to a named feed of another tenant
+	mock.ExpectQuery("select f.tenant, f.feed_name, f.feedid, f.previous from t_aefd_feed").
+		WillReturnRows(sqlmock.NewRows([]string{"tenant", "feed_name", "feedid", "previous"}).
+			AddRow("acme", "customers", "feed2", "feed1"))
+
+	code, results := checkHealth(t, newTestHealth(db, time.Now()).ReadinessHandler())
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Contains(t, results["feedchain"], "of feed customers of tenant acme refers to missing previous feed feed1")
+	assert.Equal(t, "ok", results["database"])
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestReadinessLag(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("select f.tenant, f.feed_name, f.feedid, f.previous from t_aefd_feed").
+		WillReturnRows(sqlmock.NewRows([]string{"tenant", "feed_name", "feedid", "previous"}))
+
+	now := time.Now()
+	h := newTestHealth(db, now)
+	h.Received([]*Message{{SentAt: now.Add(-time.Minute)}, {SentAt: now.Add(-h.MaxLag - time.Minute)}})
+
+	code, results := checkHealth(t, h.ReadinessHandler())
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Contains(t, results["lag"], "Oldest message received")
+
+	//An empty receive means the source has caught up
+	h.Received(nil)
+	mock.ExpectQuery("select f.tenant, f.feed_name, f.feedid, f.previous from t_aefd_feed").
+		WillReturnRows(sqlmock.NewRows([]string{"tenant", "feed_name", "feedid", "previous"}))
+	code, _ = checkHealth(t, h.ReadinessHandler())
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestReadinessDatabaseDown(t *testing.T) {
+	db, _, err := sqlmock.New()
+	if !assert.Nil(t, err) {
+		return
+	}
+	db.Close()
+
+	code, results := checkHealth(t, newTestHealth(db, time.Now()).ReadinessHandler())
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.NotEqual(t, "ok", results["database"])
+	assert.NotEqual(t, "ok", results["feedchain"])
+}
+
+func TestPoolRecordsReceive(t *testing.T) {
+	db, _, err := sqlmock.New()
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer db.Close()
+
+	now := time.Now()
+	h := newTestHealth(db, now.Add(-time.Hour))
+	h.now = func() time.Time { return now }
+
+	consumer := NewConsumer(NewMemorySource(), &fakeProcessor{})
+	consumer.Health = h
+	runPool(t, NewPool(consumer, 1, 1, 1, 1), func() bool {
+		h.Lock()
+		defer h.Unlock()
+		return h.lastReceive.Equal(now)
+	})
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	//How long Receive waits for a first message before returning an empty batch
+	defaultKafkaReceiveWait = time.Second
+)
+
+// KafkaSource receives pgpublish events from Kafka topics as a member of a
+// consumer group.
+//
+// Messages from a partition are delivered in offset order, one at a time: the
+// next message from a partition is not delivered until the previous one has been
+// acked. A nacked message is redelivered after the nack delay, holding up the
+// rest of its partition, so the events of an aggregate (published with the
+// aggregate id as key) are written in order. Messages from different partitions
+// are delivered together in a batch.
+//
+// The offset of a message is marked for commit when it is acked, which the
+// processing loop does after the database transaction commits, so committed
+// offsets never get ahead of the atom event table. After a rebalance or restart
+// uncommitted messages are redelivered and detected as duplicates.
+type KafkaSource struct {
+	group      sarama.ConsumerGroup
+	topics     []string
+	batchSize  int
+	deliveries chan *kafkaDelivery
+
+	//ReceiveWait is how long Receive waits for a message before returning an
+	//empty batch
+	ReceiveWait time.Duration
+
+	sync.Mutex
+	pending map[string]*kafkaDelivery
+}
+
+type kafkaDelivery struct {
+	message *Message
+	result  chan kafkaResult
+}
+
+type kafkaResult struct {
+	ack   bool
+	delay time.Duration
+}
+
+// NewKafkaSource returns a source receiving up to batchSize messages at a time
+// from topics. Consume must be running for messages to be received.
+func NewKafkaSource(group sarama.ConsumerGroup, topics []string, batchSize int) *KafkaSource {
+	return &KafkaSource{
+		group:       group,
+		topics:      topics,
+		batchSize:   batchSize,
+		deliveries:  make(chan *kafkaDelivery),
+		ReceiveWait: defaultKafkaReceiveWait,
+		pending:     make(map[string]*kafkaDelivery),
+	}
+}
+
+// Consume joins the consumer group and consumes the partitions assigned to
+// this member until ctx is done, rejoining after each rebalance.
+func (s *KafkaSource) Consume(ctx context.Context) error {
+	for {
+		if err := s.group.Consume(ctx, s.topics, s); err != nil {
+			return err
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
+
+// Close leaves the consumer group
+func (s *KafkaSource) Close() error {
+	return s.group.Close()
+}
+
+func (s *KafkaSource) Receive(ctx context.Context) ([]*Message, error) {
+	var messages []*Message
+
+	select {
+	case d := <-s.deliveries:
+		messages = append(messages, d.message)
+	case <-time.After(s.ReceiveWait):
+		return nil, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	for len(messages) < s.batchSize {
+		select {
+		case d := <-s.deliveries:
+			messages = append(messages, d.message)
+		default:
+			return messages, nil
+		}
+	}
+
+	return messages, nil
+}
+
+func (s *KafkaSource) Ack(ctx context.Context, msg *Message) error {
+	return s.complete(msg, kafkaResult{ack: true})
+}
+
+func (s *KafkaSource) Nack(ctx context.Context, msg *Message, delay time.Duration) error {
+	return s.complete(msg, kafkaResult{delay: delay})
+}
+
+func (s *KafkaSource) complete(msg *Message, result kafkaResult) error {
+	s.Lock()
+	d, ok := s.pending[msg.Receipt]
+	delete(s.pending, msg.Receipt)
+	s.Unlock()
+
+	if !ok {
+		//The partition was reassigned; the new owner redelivers the message
+		return fmt.Errorf("Message %s is no longer assigned to this consumer", msg.ID)
+	}
+
+	d.result <- result
+	return nil
+}
+
+// Setup is called at the start of a consumer group session
+func (s *KafkaSource) Setup(session sarama.ConsumerGroupSession) error {
+	log.Infof("Kafka consumer group session %d claims %v", session.GenerationID(), session.Claims())
+	return nil
+}
+
+// Cleanup is called at the end of a consumer group session
+func (s *KafkaSource) Cleanup(session sarama.ConsumerGroupSession) error {
+	log.Infof("Kafka consumer group session %d ended", session.GenerationID())
+	return nil
+}
+
+// ConsumeClaim delivers the messages of a partition one at a time
+func (s *KafkaSource) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	for kafkaMessage := range claim.Messages() {
+		if err := s.deliver(session, kafkaMessage); err != nil {
+			//Session over, stop consuming the partition
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// deliver hands the message to Receive and waits for it to be acked, redelivering
+// it each time it is nacked.
+func (s *KafkaSource) deliver(session sarama.ConsumerGroupSession, kafkaMessage *sarama.ConsumerMessage) error {
+	ctx := session.Context()
+	id := fmt.Sprintf("%s/%d/%d", kafkaMessage.Topic, kafkaMessage.Partition, kafkaMessage.Offset)
+
+	for receiveCount := 1; ; receiveCount++ {
+		d := &kafkaDelivery{
+			message: &Message{
+				ID:           id,
+				Body:         string(kafkaMessage.Value),
+				ReceiveCount: receiveCount,
+				Receipt:      fmt.Sprintf("%s/%d", id, receiveCount),
+				SentAt:       kafkaMessage.Timestamp,
+			},
+			result: make(chan kafkaResult, 1),
+		}
+
+		s.Lock()
+		s.pending[d.message.Receipt] = d
+		s.Unlock()
+
+		var result kafkaResult
+		select {
+		case s.deliveries <- d:
+		case <-ctx.Done():
+			s.forget(d)
+			return ctx.Err()
+		}
+
+		select {
+		case result = <-d.result:
+		case <-ctx.Done():
+			s.forget(d)
+			return ctx.Err()
+		}
+
+		if result.ack {
+			session.MarkMessage(kafkaMessage, "")
+			return nil
+		}
+
+		select {
+		case <-time.After(result.delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (s *KafkaSource) forget(d *kafkaDelivery) {
+	s.Lock()
+	delete(s.pending, d.message.Receipt)
+	s.Unlock()
+}
+
+// NewKafkaConsumerGroup connects to brokers as a member of groupID, starting
+// from the oldest offset when the group has no committed offset.
+func NewKafkaConsumerGroup(brokers []string, groupID string) (sarama.ConsumerGroup, error) {
+	if len(brokers) == 0 {
+		return nil, errors.New("No Kafka brokers specified")
+	}
+
+	config := sarama.NewConfig()
+	config.Version = sarama.V0_10_2_0
+	config.Consumer.Offsets.Initial = sarama.OffsetOldest
+
+	return sarama.NewConsumerGroup(brokers, groupID, config)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeGroup is a consumer group with a single member claiming every partition
+type fakeGroup struct {
+	session    *fakeSession
+	partitions map[int32][]string
+}
+
+func (g *fakeGroup) Consume(ctx context.Context, topics []string, handler sarama.ConsumerGroupHandler) error {
+	g.session.ctx = ctx
+	handler.Setup(g.session)
+
+	var wg sync.WaitGroup
+	for partition, values := range g.partitions {
+		claim := &fakeClaim{topic: topics[0], partition: partition, messages: make(chan *sarama.ConsumerMessage, len(values))}
+		for offset, value := range values {
+			claim.messages <- &sarama.ConsumerMessage{Topic: topics[0], Partition: partition, Offset: int64(offset), Value: []byte(value)}
+		}
+		close(claim.messages)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			handler.ConsumeClaim(g.session, claim)
+		}()
+	}
+	wg.Wait()
+
+	handler.Cleanup(g.session)
+
+	//Like a real group, block until the session ends
+	<-ctx.Done()
+	return nil
+}
+
+func (g *fakeGroup) Errors() <-chan error {
+	return nil
+}
+
+func (g *fakeGroup) Close() error {
+	return nil
+}
+
+type fakeSession struct {
+	ctx context.Context
+
+	sync.Mutex
+	marked map[int32][]int64
+}
+
+func (s *fakeSession) Claims() map[string][]int32 { return nil }
+func (s *fakeSession) MemberID() string           { return "member" }
+func (s *fakeSession) GenerationID() int32        { return 1 }
+func (s *fakeSession) Commit()                    {}
+func (s *fakeSession) Context() context.Context   { return s.ctx }
+
+func (s *fakeSession) MarkOffset(topic string, partition int32, offset int64, metadata string) {
+	s.Lock()
+	defer s.Unlock()
+	s.marked[partition] = append(s.marked[partition], offset)
+}
+
+func (s *fakeSession) ResetOffset(topic string, partition int32, offset int64, metadata string) {}
+
+func (s *fakeSession) MarkMessage(msg *sarama.ConsumerMessage, metadata string) {
+	s.MarkOffset(msg.Topic, msg.Partition, msg.Offset+1, metadata)
+}
+
+func (s *fakeSession) markedOffsets(partition int32) []int64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.marked[partition]
+}
+
+type fakeClaim struct {
+	topic     string
+	partition int32
+	messages  chan *sarama.ConsumerMessage
+}
+
+func (c *fakeClaim) Topic() string                            { return c.topic }
+func (c *fakeClaim) Partition() int32                         { return c.partition }
+func (c *fakeClaim) InitialOffset() int64                     { return 0 }
+func (c *fakeClaim) HighWaterMarkOffset() int64               { return int64(len(c.messages)) }
+func (c *fakeClaim) Messages() <-chan *sarama.ConsumerMessage { return c.messages }
+
+func startKafkaSource(t *testing.T, partitions map[int32][]string) (*KafkaSource, *fakeSession, context.CancelFunc) {
+	session := &fakeSession{marked: make(map[int32][]int64)}
+	source := NewKafkaSource(&fakeGroup{session: session, partitions: partitions}, []string{"events"}, 10)
+	source.ReceiveWait = 20 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go source.Consume(ctx)
+	return source, session, cancel
+}
+
+// receiveN receives until n messages have been delivered
+func receiveN(t *testing.T, source *KafkaSource, n int) []*Message {
+	var messages []*Message
+	deadline := time.Now().Add(time.Second)
+	for len(messages) < n && time.Now().Before(deadline) {
+		batch, err := source.Receive(context.Background())
+		assert.Nil(t, err)
+		messages = append(messages, batch...)
+	}
+
+	assert.Equal(t, n, len(messages))
+	return messages
+}
+
+func bodies(messages []*Message) []string {
+	result := ids(messages)
+	sort.Strings(result)
+	return result
+}
+
+func TestKafkaSourcePartitionOrdering(t *testing.T) {
+	source, session, cancel := startKafkaSource(t, map[int32][]string{
+		0: {"a1", "a2"},
+		1: {"b1"},
+	})
+	defer cancel()
+
+	//One message per partition is outstanding at a time
+	messages := receiveN(t, source, 2)
+	assert.Equal(t, []string{"a1", "b1"}, bodies(messages))
+
+	batch, err := source.Receive(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(batch))
+	assert.Equal(t, 0, len(session.markedOffsets(0)))
+
+	//Acking releases the next message of the partition and marks the offset
+	for _, m := range messages {
+		if m.Body == "a1" {
+			assert.Nil(t, source.Ack(context.Background(), m))
+		}
+	}
+
+	next := receiveN(t, source, 1)
+	assert.Equal(t, []string{"a2"}, bodies(next))
+	assert.Equal(t, []int64{1}, session.markedOffsets(0))
+	assert.Equal(t, 0, len(session.markedOffsets(1)))
+
+	assert.Nil(t, source.Ack(context.Background(), next[0]))
+	assert.Eventually(t, func() bool { return len(session.markedOffsets(0)) == 2 }, time.Second, time.Millisecond)
+	assert.Equal(t, []int64{1, 2}, session.markedOffsets(0))
+}
+
+func TestKafkaSourceNackRedelivers(t *testing.T) {
+	source, session, cancel := startKafkaSource(t, map[int32][]string{
+		0: {"a1", "a2"},
+	})
+	defer cancel()
+
+	first := receiveN(t, source, 1)
+	assert.Nil(t, source.Nack(context.Background(), first[0], 0))
+
+	//The nacked message comes back before the rest of the partition
+	retry := receiveN(t, source, 1)
+	assert.Equal(t, "a1", retry[0].Body)
+	assert.Equal(t, first[0].ID, retry[0].ID)
+	assert.Equal(t, 2, retry[0].ReceiveCount)
+	assert.Equal(t, 0, len(session.markedOffsets(0)))
+
+	//Acks of stale deliveries are rejected
+	assert.NotNil(t, source.Ack(context.Background(), first[0]))
+
+	assert.Nil(t, source.Ack(context.Background(), retry[0]))
+	next := receiveN(t, source, 1)
+	assert.Equal(t, "a2", next[0].Body)
+	assert.Equal(t, []int64{1}, session.markedOffsets(0))
+}
+
+func TestKafkaSourceAckAfterSessionEnds(t *testing.T) {
+	source, _, cancel := startKafkaSource(t, map[int32][]string{
+		0: {"a1"},
+	})
+
+	messages := receiveN(t, source, 1)
+	cancel()
+
+	//The delivery is abandoned when the session ends
+	assert.Eventually(t, func() bool {
+		source.Lock()
+		defer source.Unlock()
+		return len(source.pending) == 0
+	}, time.Second, time.Millisecond)
+	assert.NotNil(t, source.Ack(context.Background(), messages[0]))
+}
+
+func TestKafkaSourceWithConsumer(t *testing.T) {
+	source, session, cancel := startKafkaSource(t, map[int32][]string{
+		0: {"a1", "a2", "a3"},
+	})
+	defer cancel()
+
+	processor := &fakeProcessor{}
+	consumer := NewConsumer(source, processor)
+	deadline := time.Now().Add(time.Second)
+	for len(processor.batches) < 3 && time.Now().Before(deadline) {
+		processReceived(t, consumer)
+	}
+
+	assert.Equal(t, [][]string{{"a1"}, {"a2"}, {"a3"}}, processor.batches)
+	assert.Eventually(t, func() bool { return len(session.markedOffsets(0)) == 3 }, time.Second, time.Millisecond)
+}
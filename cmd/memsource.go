@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const memorySourcePollInterval = 10 * time.Millisecond
+
+// MemorySource is an in-memory MessageSource, useful for driving the processing
+// loop in tests. Nacked messages are redelivered immediately.
+type MemorySource struct {
+	sync.Mutex
+	BatchSize int
+	pending   []*Message
+	acked     []*Message
+	nacked    []*Message
+	nextID    int
+}
+
+// NewMemorySource returns a source that will deliver the given message bodies
+func NewMemorySource(bodies ...string) *MemorySource {
+	ms := &MemorySource{BatchSize: 10}
+	for _, body := range bodies {
+		ms.Add(body)
+	}
+	return ms
+}
+
+// Add queues a message for delivery
+func (ms *MemorySource) Add(body string) *Message {
+	ms.Lock()
+	defer ms.Unlock()
+
+	ms.nextID++
+	msg := &Message{
+		ID:      fmt.Sprintf("mem-%d", ms.nextID),
+		Body:    body,
+		Receipt: fmt.Sprintf("receipt-%d", ms.nextID),
+	}
+	ms.pending = append(ms.pending, msg)
+	return msg
+}
+
+// AddMessage queues a message as is, for example one with an envelope error
+func (ms *MemorySource) AddMessage(msg *Message) {
+	ms.Lock()
+	defer ms.Unlock()
+	ms.pending = append(ms.pending, msg)
+}
+
+func (ms *MemorySource) Receive(ctx context.Context) ([]*Message, error) {
+	if batch := ms.take(); len(batch) > 0 {
+		return batch, nil
+	}
+
+	//Emulate a short long poll when there is nothing to deliver
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(memorySourcePollInterval):
+		return nil, nil
+	}
+}
+
+func (ms *MemorySource) take() []*Message {
+	ms.Lock()
+	defer ms.Unlock()
+
+	n := len(ms.pending)
+	if n > ms.BatchSize {
+		n = ms.BatchSize
+	}
+
+	batch := ms.pending[:n:n]
+	ms.pending = ms.pending[n:]
+	for _, msg := range batch {
+		msg.ReceiveCount++
+	}
+
+	return batch
+}
+
+func (ms *MemorySource) Ack(ctx context.Context, msg *Message) error {
+	ms.Lock()
+	defer ms.Unlock()
+	ms.acked = append(ms.acked, msg)
+	return nil
+}
+
+func (ms *MemorySource) Nack(ctx context.Context, msg *Message, delay time.Duration) error {
+	ms.Lock()
+	defer ms.Unlock()
+	ms.nacked = append(ms.nacked, msg)
+	ms.pending = append(ms.pending, msg)
+	return nil
+}
+
+// Acked returns the messages acknowledged so far
+func (ms *MemorySource) Acked() []*Message {
+	ms.Lock()
+	defer ms.Unlock()
+	return append([]*Message(nil), ms.acked...)
+}
+
+// Nacked returns the messages returned to the source so far
+func (ms *MemorySource) Nacked() []*Message {
+	ms.Lock()
+	defer ms.Unlock()
+	return append([]*Message(nil), ms.nacked...)
+}
+
+// Pending returns the number of messages waiting to be received
+func (ms *MemorySource) Pending() int {
+	ms.Lock()
+	defer ms.Unlock()
+	return len(ms.pending)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/xtracdev/es-atom-data-pg"
+)
+
+const metricsNamespace = "atomdata"
+
+var (
+	errorCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "errors_total",
+		Help:      "Errors receiving, processing or deleting messages.",
+	})
+	messagesReceived = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "messages_received_total",
+		Help:      "Messages received from the source.",
+	})
+	messagesProcessed = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "messages_processed_total",
+		Help:      "Messages passed to the processor.",
+	})
+	messagesDeleted = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "messages_deleted_total",
+		Help:      "Messages acknowledged and removed from the source.",
+	})
+	duplicatesIgnored = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "duplicates_ignored_total",
+		Help:      "Messages for events that were already stored.",
+	})
+	duplicateConflicts = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "duplicate_conflicts_total",
+		Help:      "Messages for events conflicting with a stored event.",
+	})
+	deadLettered = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "dead_lettered_total",
+		Help:      "Messages recorded as dead letters.",
+	})
+	processingTime = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "processing_time_seconds",
+		Help:      "Time taken to write a batch of messages.",
+		Buckets:   prometheus.DefBuckets,
+	})
+)
+
+// processorMetrics exports the measurements of AtomDataProcessor
+type processorMetrics struct {
+	eventsStored     *prometheus.CounterVec
+	feedRollovers    prometheus.Counter
+	recentPageSize   *prometheus.GaugeVec
+	transientRetries prometheus.Counter
+}
+
+func newProcessorMetrics() *processorMetrics {
+	return &processorMetrics{
+		eventsStored: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "events_stored_total",
+			Help:      "Events written or found already stored, by outcome.",
+		}, []string{"outcome"}),
+		feedRollovers: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "feed_rollovers_total",
+			Help:      "Recent pages assigned to a new feed.",
+		}),
+		recentPageSize: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "recent_page_size",
+			Help:      "Events in the recent page, by feed and tenant.",
+		}, []string{"feed", "tenant"}),
+		transientRetries: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "transient_retries_total",
+			Help:      "Writes retried after a transient database error.",
+		}),
+	}
+}
+
+func (m *processorMetrics) EventStored(outcome esatomdatapg.Outcome) {
+	m.eventsStored.WithLabelValues(outcome.String()).Inc()
+}
+
+func (m *processorMetrics) FeedRolledOver() {
+	m.feedRollovers.Inc()
+}
+
+func (m *processorMetrics) RecentPageSize(tenant, feed string, size int) {
+	m.recentPageSize.WithLabelValues(feed, tenant).Set(float64(size))
+}
+
+func (m *processorMetrics) TransientRetry() {
+	m.transientRetries.Inc()
+}
+
+func (m *processorMetrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{m.eventsStored, m.feedRollovers, m.recentPageSize, m.transientRetries}
+}
+
+// newMetricsRegistry registers the event processor metrics, the processor
+// metrics, and the connection pool statistics of db.
+func newMetricsRegistry(pm *processorMetrics, db *sql.DB) *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		errorCounter,
+		messagesReceived,
+		messagesProcessed,
+		messagesDeleted,
+		duplicatesIgnored,
+		duplicateConflicts,
+		deadLettered,
+		processingTime,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	registry.MustRegister(pm.collectors()...)
+
+	if db != nil {
+		registry.MustRegister(collectors.NewDBStatsCollector(db, "atomdata"))
+	}
+
+	return registry
+}
+
+// metricsHandler serves the registry in the Prometheus exposition format
+func metricsHandler(registry *prometheus.Registry) http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xtracdev/es-atom-data-pg"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func scrape(t *testing.T, pm *processorMetrics) string {
+	db, _, err := sqlmock.New()
+	if !assert.Nil(t, err) {
+		return ""
+	}
+	defer db.Close()
+
+	server := httptest.NewServer(metricsHandler(newMetricsRegistry(pm, db)))
+	defer server.Close()
+
+	resp, err := server.Client().Get(server.URL)
+	if !assert.Nil(t, err) {
+		return ""
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	return string(body)
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	pm := newProcessorMetrics()
+	pm.EventStored(esatomdatapg.Inserted)
+	pm.EventStored(esatomdatapg.Inserted)
+	pm.EventStored(esatomdatapg.DuplicateIdentical)
+	pm.FeedRolledOver()
+	pm.RecentPageSize(esatomdatapg.DefaultTenant, esatomdatapg.DefaultFeed, 42)
+	pm.RecentPageSize("acme", "customers", 7)
+
+	body := scrape(t, pm)
+	assert.Contains(t, body, `atomdata_events_stored_total{outcome="Inserted"} 2`)
+	assert.Contains(t, body, `atomdata_events_stored_total{outcome="DuplicateIdentical"} 1`)
+	assert.Contains(t, body, "atomdata_feed_rollovers_total 1")
+	assert.Contains(t, body, `atomdata_recent_page_size{feed="default",tenant="default"} 42`)
+	assert.Contains(t, body, `atomdata_recent_page_size{feed="customers",tenant="acme"} 7`)
+	assert.Contains(t, body, "atomdata_messages_received_total")
+	assert.Contains(t, body, "atomdata_processing_time_seconds_bucket")
+	assert.Contains(t, body, "go_sql_open_connections")
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/lib/pq"
+	"github.com/xtracdev/pgpublish"
+)
+
+const (
+	//The source event store tables: events written by the goes Postgres event
+	//store, and the publish table recording events yet to be published.
+	sqlSelectPublished = `select e.aggregate_id, e.version, e.typecode, e.payload, e.event_time
+		from t_aepb_publish p join t_aeev_events e on e.aggregate_id = p.aggregate_id and e.version = p.version
+		order by e.event_time, e.aggregate_id, e.version limit $1`
+	sqlDeletePublished = `delete from t_aepb_publish where aggregate_id = $1 and version = $2`
+
+	defaultSourcePollInterval = 5 * time.Second
+	listenerMinReconnect      = 10 * time.Second
+	listenerMaxReconnect      = time.Minute
+)
+
+type publishKey struct {
+	aggregateID string
+	version     int
+}
+
+// PGSource reads events straight from the publish table of the source Postgres
+// event store, in place of pgpublish forwarding them via SNS and SQS. Acking a
+// message removes it from the publish table. If a listener is supplied the
+// source waits for notifications between polls, otherwise it polls on an interval.
+//
+// An event is delivered again only after it has been nacked, or its ack failed to
+// delete it, so ReceiveCount counts real delivery attempts even when receivers poll
+// while earlier events are still being written. The retry state of events that
+// leave the publish table some other way is dropped.
+//
+// Only one processor should read a given publish table; concurrent readers see
+// the same events and rely on duplicate detection to discard the redundant writes.
+type PGSource struct {
+	db           *sql.DB
+	listener     *pq.Listener
+	batchSize    int
+	pollInterval time.Duration
+
+	sync.Mutex
+	keys     map[string]publishKey
+	attempts map[string]int
+	retryAt  map[string]time.Time
+}
+
+// NewPGSource returns a source reading up to batchSize events at a time from db.
+// listener may be nil, in which case the publish table is polled every pollInterval.
+func NewPGSource(db *sql.DB, listener *pq.Listener, batchSize int, pollInterval time.Duration) *PGSource {
+	return &PGSource{
+		db:           db,
+		listener:     listener,
+		batchSize:    batchSize,
+		pollInterval: pollInterval,
+		keys:         make(map[string]publishKey),
+		attempts:     make(map[string]int),
+		retryAt:      make(map[string]time.Time),
+	}
+}
+
+// NewPGListener listens for notifications on channel, sent by a trigger on the
+// publish table.
+func NewPGListener(connectStr, channel string) (*pq.Listener, error) {
+	listener := pq.NewListener(connectStr, listenerMinReconnect, listenerMaxReconnect,
+		func(ev pq.ListenerEventType, err error) {
+			if err != nil {
+				log.Warnf("Source listener event %d: %s", ev, err.Error())
+			}
+		})
+
+	if err := listener.Listen(channel); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return listener, nil
+}
+
+func (s *PGSource) Receive(ctx context.Context) ([]*Message, error) {
+	messages, err := s.fetch(ctx)
+	if err != nil || len(messages) > 0 {
+		return messages, err
+	}
+
+	s.wait(ctx)
+	return nil, nil
+}
+
+// wait blocks until there may be new events to read
+func (s *PGSource) wait(ctx context.Context) {
+	var notify <-chan *pq.Notification
+	if s.listener != nil {
+		notify = s.listener.Notify
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-notify:
+	case <-time.After(s.pollInterval):
+	}
+}
+
+func (s *PGSource) fetch(ctx context.Context) ([]*Message, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	//Ask for enough rows to fill a batch even if some are in flight or waiting
+	//to be retried
+	limit := s.batchSize + len(s.keys) + len(s.retryAt)
+	rows, err := s.db.QueryContext(ctx, sqlSelectPublished, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	seen := make(map[string]bool)
+	var messages []*Message
+	for rows.Next() {
+		var key publishKey
+		var typecode string
+		var payload []byte
+		var eventTime time.Time
+
+		if err := rows.Scan(&key.aggregateID, &key.version, &typecode, &payload, &eventTime); err != nil {
+			return nil, err
+		}
+
+		id := fmt.Sprintf("%s:%d", key.aggregateID, key.version)
+		seen[id] = true
+		if len(messages) == s.batchSize {
+			continue
+		}
+
+		//Events delivered but not yet acked or nacked are still in flight, and
+		//stay in the publish table until they are acked
+		if _, inFlight := s.keys[id]; inFlight {
+			continue
+		}
+
+		if retryAt, ok := s.retryAt[id]; ok {
+			if now.Before(retryAt) {
+				continue
+			}
+			delete(s.retryAt, id)
+		}
+
+		s.keys[id] = key
+		s.attempts[id]++
+
+		messages = append(messages, &Message{
+			ID:           id,
+			Body:         pgpublish.EncodePGEvent(key.aggregateID, key.version, payload, typecode, eventTime),
+			ReceiveCount: s.attempts[id],
+			Receipt:      id,
+			SentAt:       eventTime,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	//When every row was read, events that are neither in the publish table nor in
+	//flight were deleted by someone else, so stop tracking them
+	if len(seen) < limit {
+		s.prune(seen)
+	}
+
+	return messages, nil
+}
+
+// prune forgets the retry state of events not in seen that are not in flight
+func (s *PGSource) prune(seen map[string]bool) {
+	for id := range s.retryAt {
+		if !seen[id] {
+			delete(s.retryAt, id)
+		}
+	}
+	for id := range s.attempts {
+		if _, inFlight := s.keys[id]; !inFlight && !seen[id] {
+			delete(s.attempts, id)
+		}
+	}
+}
+
+func (s *PGSource) Ack(ctx context.Context, msg *Message) error {
+	s.Lock()
+	key, ok := s.keys[msg.Receipt]
+	s.Unlock()
+	if !ok {
+		return fmt.Errorf("Unknown message %s", msg.Receipt)
+	}
+
+	log.WithFields(log.Fields{"MsgId": msg.ID}).Infof("Delete published event %s", msg.ID)
+	_, err := s.db.ExecContext(ctx, sqlDeletePublished, key.aggregateID, key.version)
+
+	s.Lock()
+	defer s.Unlock()
+
+	//The event is no longer in flight either way; if it could not be deleted it
+	//is delivered again, and found to be already stored
+	delete(s.keys, msg.Receipt)
+	if err != nil {
+		return err
+	}
+
+	delete(s.attempts, msg.Receipt)
+	return nil
+}
+
+// Nack leaves the event in the publish table, skipping it until delay has passed
+func (s *PGSource) Nack(ctx context.Context, msg *Message, delay time.Duration) error {
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.keys, msg.Receipt)
+	s.retryAt[msg.Receipt] = time.Now().Add(delay)
+	return nil
+}
+
+// Close stops listening for notifications and closes the source database
+func (s *PGSource) Close() error {
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	return s.db.Close()
+}
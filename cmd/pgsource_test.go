@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xtracdev/pgpublish"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+var publishedColumns = []string{"aggregate_id", "version", "typecode", "payload", "event_time"}
+
+func TestPGSourceReceiveAndAck(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer db.Close()
+
+	ts := time.Now()
+	mock.ExpectQuery("select e.aggregate_id").WithArgs(10).WillReturnRows(
+		sqlmock.NewRows(publishedColumns).
+			AddRow("agg1", 1, "foo", []byte("ok"), ts).
+			AddRow("agg1", 2, "foo", []byte("ok2"), ts))
+	mock.ExpectExec("delete from t_aepb_publish").WithArgs("agg1", 1).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	source := NewPGSource(db, nil, 10, time.Millisecond)
+	messages, err := source.Receive(context.Background())
+	if assert.Nil(t, err) && assert.Equal(t, 2, len(messages)) {
+		assert.Equal(t, "agg1:1", messages[0].ID)
+		assert.Equal(t, 1, messages[0].ReceiveCount)
+		assert.Equal(t, pgpublish.EncodePGEvent("agg1", 1, []byte("ok"), "foo", ts), messages[0].Body)
+
+		assert.Nil(t, source.Ack(context.Background(), messages[0]))
+	}
+
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestPGSourceNackDelaysRedelivery(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer db.Close()
+
+	ts := time.Now()
+	rows := func() *sqlmock.Rows {
+		return sqlmock.NewRows(publishedColumns).AddRow("agg1", 1, "foo", []byte("ok"), ts)
+	}
+	mock.ExpectQuery("select e.aggregate_id").WithArgs(1).WillReturnRows(rows())
+	mock.ExpectQuery("select e.aggregate_id").WithArgs(2).WillReturnRows(rows())
+	mock.ExpectQuery("select e.aggregate_id").WithArgs(2).WillReturnRows(rows())
+
+	source := NewPGSource(db, nil, 1, time.Millisecond)
+	messages, err := source.Receive(context.Background())
+	if !assert.Nil(t, err) || !assert.Equal(t, 1, len(messages)) {
+		return
+	}
+
+	assert.Nil(t, source.Nack(context.Background(), messages[0], 20*time.Millisecond))
+
+	//Still waiting to be retried
+	messages, err = source.Receive(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(messages))
+
+	time.Sleep(20 * time.Millisecond)
+	messages, err = source.Receive(context.Background())
+	if assert.Nil(t, err) && assert.Equal(t, 1, len(messages)) {
+		assert.Equal(t, 2, messages[0].ReceiveCount)
+	}
+
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestPGSourceAckUnknownMessage(t *testing.T) {
+	db, _, err := sqlmock.New()
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer db.Close()
+
+	source := NewPGSource(db, nil, 10, time.Millisecond)
+	assert.NotNil(t, source.Ack(context.Background(), &Message{ID: "x", Receipt: "x"}))
+}
+
+func TestPGSourceSkipsInFlightEvents(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer db.Close()
+
+	ts := time.Now()
+	rows := func() *sqlmock.Rows {
+		return sqlmock.NewRows(publishedColumns).AddRow("agg1", 1, "foo", []byte("ok"), ts)
+	}
+	mock.ExpectQuery("select e.aggregate_id").WithArgs(10).WillReturnRows(rows())
+	mock.ExpectQuery("select e.aggregate_id").WithArgs(11).WillReturnRows(rows())
+	mock.ExpectExec("delete from t_aepb_publish").WithArgs("agg1", 1).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	source := NewPGSource(db, nil, 10, time.Millisecond)
+	messages, err := source.Receive(context.Background())
+	if !assert.Nil(t, err) || !assert.Equal(t, 1, len(messages)) {
+		return
+	}
+
+	//The event is still in the publish table while it is being written
+	again, err := source.Receive(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(again))
+
+	assert.Nil(t, source.Ack(context.Background(), messages[0]))
+	assert.Equal(t, 0, len(source.attempts))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestPGSourceRedeliversAfterFailedAck(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer db.Close()
+
+	ts := time.Now()
+	rows := func() *sqlmock.Rows {
+		return sqlmock.NewRows(publishedColumns).AddRow("agg1", 1, "foo", []byte("ok"), ts)
+	}
+	mock.ExpectQuery("select e.aggregate_id").WithArgs(10).WillReturnRows(rows())
+	mock.ExpectExec("delete from t_aepb_publish").WithArgs("agg1", 1).WillReturnError(errors.New("connection reset"))
+	mock.ExpectQuery("select e.aggregate_id").WithArgs(10).WillReturnRows(rows())
+
+	source := NewPGSource(db, nil, 10, time.Millisecond)
+	messages, err := source.Receive(context.Background())
+	if !assert.Nil(t, err) || !assert.Equal(t, 1, len(messages)) {
+		return
+	}
+	assert.NotNil(t, source.Ack(context.Background(), messages[0]))
+
+	//The event is no longer in flight, so it is delivered again
+	messages, err = source.Receive(context.Background())
+	if assert.Nil(t, err) && assert.Equal(t, 1, len(messages)) {
+		assert.Equal(t, 2, messages[0].ReceiveCount)
+	}
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestPGSourceForgetsEventsDeletedElsewhere(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer db.Close()
+
+	ts := time.Now()
+	mock.ExpectQuery("select e.aggregate_id").WithArgs(10).WillReturnRows(
+		sqlmock.NewRows(publishedColumns).AddRow("agg1", 1, "foo", []byte("ok"), ts))
+	mock.ExpectQuery("select e.aggregate_id").WithArgs(11).WillReturnRows(sqlmock.NewRows(publishedColumns))
+
+	source := NewPGSource(db, nil, 10, time.Millisecond)
+	messages, err := source.Receive(context.Background())
+	if !assert.Nil(t, err) || !assert.Equal(t, 1, len(messages)) {
+		return
+	}
+	assert.Nil(t, source.Nack(context.Background(), messages[0], time.Hour))
+
+	//Another processor deleted the event from the publish table
+	messages, err = source.Receive(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(messages))
+	assert.Equal(t, 0, len(source.retryAt))
+	assert.Equal(t, 0, len(source.attempts))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
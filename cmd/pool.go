@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/xtracdev/es-atom-data-pg"
+	"github.com/xtracdev/pgpublish"
+)
+
+// Pool runs the processing loop with several receivers and workers. Receivers
+// dispatch messages to workers by aggregate id, so the events of an aggregate
+// are processed by the same worker in the order they were received. Each worker
+// has a bounded queue; when a worker falls behind, receivers dispatching to it
+// block and stop receiving more messages.
+//
+// Workers write concurrently but serialize on the feed lock taken by
+// AtomDataProcessor, which keeps feed rollover safe. The gain is in overlapping
+// receiving, decoding and the database round trips of different workers.
+type Pool struct {
+	consumer  *Consumer
+	receivers int
+	batchSize int
+	queues    []chan *Message
+}
+
+// NewPool returns a pool using consumer's source and processor, with the given
+// number of receivers and workers. Each worker queues up to queueSize messages
+// and processes up to batchSize of them at a time.
+func NewPool(consumer *Consumer, receivers, workers, queueSize, batchSize int) *Pool {
+	queues := make([]chan *Message, workers)
+	for i := range queues {
+		queues[i] = make(chan *Message, queueSize)
+	}
+
+	return &Pool{
+		consumer:  consumer,
+		receivers: receivers,
+		batchSize: batchSize,
+		queues:    queues,
+	}
+}
+
+// Run processes messages until ctx is done. On shutdown receivers stop, messages
+// being written are finished, and queued messages are returned to the source
+// for immediate redelivery.
+func (p *Pool) Run(ctx context.Context) {
+	log.Infof("Process messages with %d receivers and %d workers", p.receivers, len(p.queues))
+
+	//In-flight work is not cancelled with ctx, as abandoning it would only
+	//mean redoing it later
+	processCtx := context.WithoutCancel(ctx)
+
+	var workers sync.WaitGroup
+	for _, queue := range p.queues {
+		workers.Add(1)
+		go func(queue chan *Message) {
+			defer workers.Done()
+			p.work(ctx, processCtx, queue)
+		}(queue)
+	}
+
+	var receivers sync.WaitGroup
+	for i := 0; i < p.receivers; i++ {
+		receivers.Add(1)
+		go func() {
+			defer receivers.Done()
+			p.receive(ctx, processCtx)
+		}()
+	}
+
+	receivers.Wait()
+	for _, queue := range p.queues {
+		close(queue)
+	}
+	workers.Wait()
+	log.Info("Message processing stopped")
+}
+
+func (p *Pool) receive(ctx, processCtx context.Context) {
+	backoff := esatomdatapg.NewBackoff(receiveBackoff)
+	for ctx.Err() == nil {
+		messages, err := p.consumer.source.Receive(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			warnErrorf("Error receieving message: %s", err.Error())
+			backoff.Wait(ctx)
+			continue
+		}
+		backoff.Reset()
+		p.consumer.received(messages)
+
+		if len(messages) == 0 {
+			continue
+		}
+
+		messagesReceived.Add(float64(len(messages)))
+		for i, message := range messages {
+			select {
+			case p.queues[p.workerFor(message)] <- message:
+			case <-ctx.Done():
+				for _, unsent := range messages[i:] {
+					p.consumer.release(processCtx, unsent)
+				}
+				return
+			}
+		}
+	}
+}
+
+// workerFor picks the worker for a message by hashing its aggregate id.
+// Messages that can't be decoded go to the first worker, which discards them.
+func (p *Pool) workerFor(message *Message) int {
+	if message.Err != nil {
+		return 0
+	}
+
+	aggID, _, _, _, _, err := pgpublish.DecodePGEvent(message.Body)
+	if err != nil {
+		return 0
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(aggID))
+	return int(h.Sum32() % uint32(len(p.queues)))
+}
+
+// work processes queued messages in batches until the queue is closed. Once ctx
+// is done, queued messages are released rather than processed.
+func (p *Pool) work(ctx, processCtx context.Context, queue chan *Message) {
+	for message := range queue {
+		if ctx.Err() != nil {
+			p.consumer.release(processCtx, message)
+			continue
+		}
+
+		batch := []*Message{message}
+
+	fill:
+		for len(batch) < p.batchSize {
+			select {
+			case next, ok := <-queue:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, next)
+			default:
+				break fill
+			}
+		}
+
+		p.consumer.Process(processCtx, batch)
+	}
+}
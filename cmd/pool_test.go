@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xtracdev/es-atom-data-pg"
+	"github.com/xtracdev/pgpublish"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func encodedEvent(aggID string, version int) string {
+	return pgpublish.EncodePGEvent(aggID, version, []byte("payload"), "foo", time.Now())
+}
+
+// runPool runs the pool until done returns true
+func runPool(t *testing.T, pool *Pool, done func() bool) {
+	ctx, cancel := context.WithCancel(context.Background())
+	finished := make(chan struct{})
+	go func() {
+		pool.Run(ctx)
+		close(finished)
+	}()
+
+	assert.Eventually(t, done, 2*time.Second, time.Millisecond)
+	cancel()
+
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return after the context was done")
+	}
+}
+
+func TestPoolPreservesAggregateOrder(t *testing.T) {
+	source := NewMemorySource()
+	source.BatchSize = 3
+	for version := 1; version <= 5; version++ {
+		for _, aggID := range []string{"a", "b", "c", "d"} {
+			source.Add(encodedEvent(aggID, version))
+		}
+	}
+
+	processor := &fakeProcessor{}
+	pool := NewPool(NewConsumer(source, processor), 1, 4, 2, 2)
+	runPool(t, pool, func() bool { return len(source.Acked()) == 20 })
+
+	processor.Lock()
+	defer processor.Unlock()
+
+	versions := make(map[string][]int)
+	for _, batch := range processor.batches {
+		assert.True(t, len(batch) <= 2)
+		for _, msg := range batch {
+			aggID, version, _, _, _, err := pgpublish.DecodePGEvent(msg)
+			if assert.Nil(t, err) {
+				versions[aggID] = append(versions[aggID], version)
+			}
+		}
+	}
+
+	for _, aggID := range []string{"a", "b", "c", "d"} {
+		assert.Equal(t, []int{1, 2, 3, 4, 5}, versions[aggID], aggID)
+	}
+}
+
+func TestPoolWorkerFor(t *testing.T) {
+	pool := NewPool(NewConsumer(NewMemorySource(), &fakeProcessor{}), 1, 8, 1, 1)
+
+	for i := 0; i < 20; i++ {
+		aggID := fmt.Sprintf("agg-%d", i)
+		worker := pool.workerFor(&Message{Body: encodedEvent(aggID, 1)})
+		assert.True(t, worker >= 0 && worker < 8)
+		assert.Equal(t, worker, pool.workerFor(&Message{Body: encodedEvent(aggID, 2)}))
+	}
+
+	assert.Equal(t, 0, pool.workerFor(&Message{Body: "not an event"}))
+	assert.Equal(t, 0, pool.workerFor(&Message{Err: fmt.Errorf("bad envelope")}))
+}
+
+// blockingProcessor waits for release before processing each batch
+type blockingProcessor struct {
+	fakeProcessor
+	release   chan struct{}
+	cancelled bool
+}
+
+func (bp *blockingProcessor) ProcessMessagesContext(ctx context.Context, msgs []string) []esatomdatapg.MessageResult {
+	<-bp.release
+	if ctx.Err() != nil {
+		bp.cancelled = true
+	}
+	return bp.fakeProcessor.ProcessMessagesContext(ctx, msgs)
+}
+
+func TestPoolBackpressure(t *testing.T) {
+	source := NewMemorySource()
+	source.BatchSize = 1
+	for i := 0; i < 10; i++ {
+		source.Add(encodedEvent("a", i))
+	}
+
+	processor := &blockingProcessor{release: make(chan struct{})}
+	pool := NewPool(NewConsumer(source, processor), 1, 1, 1, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go pool.Run(ctx)
+
+	//One message being processed, one queued and one held by the receiver
+	assert.Eventually(t, func() bool { return source.Pending() == 7 }, time.Second, time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, 7, source.Pending())
+
+	close(processor.release)
+	assert.Eventually(t, func() bool { return len(source.Acked()) == 10 }, time.Second, time.Millisecond)
+}
+
+func TestPoolShutdown(t *testing.T) {
+	source := NewMemorySource()
+	source.BatchSize = 1
+	for i := 0; i < 10; i++ {
+		source.Add(encodedEvent("a", i))
+	}
+
+	processor := &blockingProcessor{release: make(chan struct{})}
+	pool := NewPool(NewConsumer(source, processor), 1, 1, 1, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	finished := make(chan struct{})
+	go func() {
+		pool.Run(ctx)
+		close(finished)
+	}()
+
+	assert.Eventually(t, func() bool { return source.Pending() == 7 }, time.Second, time.Millisecond)
+	cancel()
+
+	//The batch being written is finished with a live context
+	close(processor.release)
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return after the context was done")
+	}
+
+	assert.False(t, processor.cancelled)
+	assert.Equal(t, 1, len(processor.batches))
+	assert.Equal(t, 1, len(source.Acked()))
+
+	//The queued message and the one held by the receiver are released
+	assert.Equal(t, 2, len(source.Nacked()))
+	assert.Equal(t, 9, source.Pending())
+}
+
+// pollLimitSource passes the first limit receives on to its source, closing
+// polled after the last of them, then blocks until the context is done
+type pollLimitSource struct {
+	MessageSource
+	limit  int
+	polls  int
+	polled chan struct{}
+}
+
+func (s *pollLimitSource) Receive(ctx context.Context) ([]*Message, error) {
+	if s.polls == s.limit {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	messages, err := s.MessageSource.Receive(ctx)
+	s.polls++
+	if s.polls == s.limit {
+		close(s.polled)
+	}
+	return messages, err
+}
+
+func TestPoolPGSourceDeliversOnce(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer db.Close()
+	mock.MatchExpectationsInOrder(false)
+
+	ts := time.Now()
+	rows := func() *sqlmock.Rows {
+		return sqlmock.NewRows(publishedColumns).
+			AddRow("agg1", 1, "foo", []byte("ok"), ts).
+			AddRow("agg2", 1, "foo", []byte("ok"), ts)
+	}
+	mock.ExpectQuery("select e.aggregate_id").WithArgs(2).WillReturnRows(rows())
+
+	//Both events are still in flight when the receiver polls again
+	mock.ExpectQuery("select e.aggregate_id").WithArgs(4).WillReturnRows(rows())
+	mock.ExpectExec("delete from t_aepb_publish").WithArgs("agg1", 1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("delete from t_aepb_publish").WithArgs("agg2", 1).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	pgSource := NewPGSource(db, nil, 2, time.Millisecond)
+	source := &pollLimitSource{MessageSource: pgSource, limit: 2, polled: make(chan struct{})}
+
+	//Nothing is written until the receiver has polled while the events are in flight
+	processor := &blockingProcessor{release: source.polled}
+	processed := func() int {
+		processor.Lock()
+		defer processor.Unlock()
+
+		var count int
+		for _, batch := range processor.batches {
+			count += len(batch)
+		}
+		return count
+	}
+
+	pool := NewPool(NewConsumer(source, processor), 1, 2, 2, 2)
+	runPool(t, pool, func() bool {
+		pgSource.Lock()
+		defer pgSource.Unlock()
+		return processed() == 2 && len(pgSource.keys) == 0
+	})
+
+	assert.Equal(t, 2, processed())
+	assert.Equal(t, 0, len(pgSource.attempts))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
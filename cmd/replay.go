@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/xtracdev/es-atom-data-pg"
+)
+
+const replayPageSize = 100
+
+// ReplayDeadLetters feeds the dead letters recorded in the t_aedl_dead_letter
+// table back through the processor, oldest first. Dead letters that are
+// processed are deleted; those that fail again are kept with the new error.
+// Returns the number of dead letters replayed and the number that failed.
+func ReplayDeadLetters(ctx context.Context, db *sql.DB, processor BatchProcessor) (int, int, error) {
+	var replayed, failed int
+	var afterID int64
+
+	for {
+		deadLetters, err := esatomdatapg.RetrieveDeadLetters(ctx, db, afterID, replayPageSize)
+		if err != nil || len(deadLetters) == 0 {
+			return replayed, failed, err
+		}
+
+		for _, dl := range deadLetters {
+			afterID = dl.ID
+
+			replayCtx := tenantContext(ctx, deadLetterTenant(&dl))
+			result := processor.ProcessMessagesContext(replayCtx, []string{deadLetterBody(&dl)})[0]
+			if result.Err != nil {
+				log.Warnf("Replay of dead letter %d failed: %s", dl.ID, result.Err.Error())
+				failed++
+				if err := esatomdatapg.RecordDeadLetterFailure(ctx, db, dl.ID, result.Err); err != nil {
+					return replayed, failed, err
+				}
+				continue
+			}
+
+			log.Infof("Replayed dead letter %d: %s", dl.ID, result.Outcome)
+			replayed++
+			if err := esatomdatapg.DeleteDeadLetter(ctx, db, dl.ID); err != nil {
+				return replayed, failed, err
+			}
+		}
+	}
+}
+
+// deadLetterBody returns the pgpublish encoded event of a dead letter, extracting
+// it from the SNS envelope if that failed when the message was received
+func deadLetterBody(dl *esatomdatapg.DeadLetter) string {
+	if dl.Body != "" {
+		return dl.Body
+	}
+
+	sns, err := SNSMessageFromRawMessage(dl.Raw)
+	if err != nil {
+		return dl.Raw
+	}
+
+	return sns.Message
+}
+
+// deadLetterTenant returns the tenant named by the SNS envelope of a dead letter,
+// if any
+func deadLetterTenant(dl *esatomdatapg.DeadLetter) string {
+	sns, err := SNSMessageFromRawMessage(dl.Raw)
+	if err != nil {
+		return ""
+	}
+
+	return sns.Tenant()
+}
+
+// RedriveQueue moves the messages in an SQS dead letter queue back to the event
+// queue, where the processor picks them up again. Returns the number of messages
+// moved.
+func RedriveQueue(ctx context.Context, svc *sqs.SQS, deadLetterQueueURL, queueURL string) (int, error) {
+	receiveParams := &sqs.ReceiveMessageInput{
+		QueueUrl:            aws.String(deadLetterQueueURL),
+		MaxNumberOfMessages: aws.Int64(maxReceiveBatchSize),
+		WaitTimeSeconds:     aws.Int64(1),
+	}
+
+	var moved int
+	for {
+		resp, err := svc.ReceiveMessageWithContext(ctx, receiveParams)
+		if err != nil || len(resp.Messages) == 0 {
+			return moved, err
+		}
+
+		for _, msg := range resp.Messages {
+			_, err := svc.SendMessageWithContext(ctx, &sqs.SendMessageInput{
+				QueueUrl:    aws.String(queueURL),
+				MessageBody: msg.Body,
+			})
+			if err != nil {
+				return moved, err
+			}
+
+			_, err = svc.DeleteMessageWithContext(ctx, &sqs.DeleteMessageInput{
+				QueueUrl:      aws.String(deadLetterQueueURL),
+				ReceiptHandle: msg.ReceiptHandle,
+			})
+			if err != nil {
+				return moved, err
+			}
+
+			log.Infof("Moved dead letter %s to %s", aws.StringValue(msg.MessageId), queueURL)
+			moved++
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Message is an event message received from a MessageSource.
+type Message struct {
+	//ID identifies the message for logging
+	ID string
+
+	//Body is the pgpublish encoded event
+	Body string
+
+	//ReceiveCount is the number of times the message has been received, if the
+	//source tracks it
+	ReceiveCount int
+
+	//Err is set when the transport envelope could not be decoded, in which
+	//case Body is empty
+	Err error
+
+	//Receipt is the source specific handle used to ack or nack the message
+	Receipt string
+
+	//Raw is the message as received, before unwrapping any transport envelope.
+	//Empty if the source has no envelope.
+	Raw string
+
+	//SentAt is when the message was sent to the source, if the source records it
+	SentAt time.Time
+
+	//TraceContext is the span context the message was published with, if
+	//the publisher propagated one
+	TraceContext trace.SpanContext
+
+	//Tenant is the tenant the message was published for, if the transport
+	//carries one
+	Tenant string
+}
+
+// MessageSource is a transport delivering pgpublish encoded events to the
+// processing loop.
+type MessageSource interface {
+	//Receive returns the next batch of messages. An empty batch is not an
+	//error; implementations should wait a reasonable time for messages
+	//before returning one.
+	Receive(ctx context.Context) ([]*Message, error)
+
+	//Ack removes a processed message from the source
+	Ack(ctx context.Context, msg *Message) error
+
+	//Nack returns a message to the source to be redelivered after delay
+	Nack(ctx context.Context, msg *Message, delay time.Duration) error
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type SNSMessage struct {
+	Message           string
+	MessageAttributes map[string]SNSMessageAttribute
+}
+
+type SNSMessageAttribute struct {
+	Type  string
+	Value string
+}
+
+// snsTenantAttribute is the SNS message attribute naming the tenant of an event
+const snsTenantAttribute = "tenant"
+
+// Tenant returns the tenant named by the message attributes, if any
+func (m *SNSMessage) Tenant() string {
+	return m.MessageAttributes[snsTenantAttribute].Value
+}
+
+func SNSMessageFromRawMessage(raw string) (*SNSMessage, error) {
+	var snsMessage SNSMessage
+	err := json.Unmarshal([]byte(raw), &snsMessage)
+	return &snsMessage, err
+}
+
+// SQSSource receives pgpublish events delivered to an SQS queue via an SNS
+// topic subscription.
+type SQSSource struct {
+	svc      *sqs.SQS
+	queueURL string
+	params   *sqs.ReceiveMessageInput
+}
+
+// NewSQSSource returns a source receiving up to batchSize messages at a time
+// from queueURL.
+func NewSQSSource(svc *sqs.SQS, queueURL string, batchSize int64) *SQSSource {
+	return &SQSSource{
+		svc:      svc,
+		queueURL: queueURL,
+		params: &sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(queueURL), // Required
+			MaxNumberOfMessages: aws.Int64(batchSize),
+			WaitTimeSeconds:     aws.Int64(10),
+			AttributeNames: []*string{
+				aws.String(sqs.MessageSystemAttributeNameApproximateReceiveCount),
+				aws.String(sqs.MessageSystemAttributeNameSentTimestamp),
+			},
+		},
+	}
+}
+
+func (s *SQSSource) Receive(ctx context.Context) ([]*Message, error) {
+	ctx, span := tracer.Start(ctx, "SQS ReceiveMessage", trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(attribute.String("messaging.destination.name", s.queueURL)))
+	defer span.End()
+
+	log.Debug("Receieve message")
+	resp, err := s.svc.ReceiveMessageWithContext(ctx, s.params)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+
+	var messages []*Message
+	for _, sqsMessage := range resp.Messages {
+		messages = append(messages, messageFromSQS(ctx, sqsMessage))
+	}
+
+	span.SetAttributes(attribute.Int("messaging.batch.message_count", len(messages)))
+	return messages, nil
+}
+
+func messageFromSQS(ctx context.Context, sqsMessage *sqs.Message) *Message {
+	message := &Message{
+		ID:      aws.StringValue(sqsMessage.MessageId),
+		Receipt: aws.StringValue(sqsMessage.ReceiptHandle),
+		Raw:     aws.StringValue(sqsMessage.Body),
+	}
+
+	if count, ok := sqsMessage.Attributes[sqs.MessageSystemAttributeNameApproximateReceiveCount]; ok {
+		message.ReceiveCount, _ = strconv.Atoi(aws.StringValue(count))
+	}
+
+	if sent, ok := sqsMessage.Attributes[sqs.MessageSystemAttributeNameSentTimestamp]; ok {
+		if ms, err := strconv.ParseInt(aws.StringValue(sent), 10, 64); err == nil {
+			message.SentAt = time.Unix(0, ms*int64(time.Millisecond))
+		}
+	}
+
+	log.WithFields(log.Fields{"MsgId": message.ID}).Infof("Extracting SNS message from %s", message.ID)
+	_, span := tracer.Start(ctx, "SNSMessageFromRawMessage",
+		trace.WithAttributes(attribute.String("messaging.message.id", message.ID)))
+	defer span.End()
+
+	sns, err := SNSMessageFromRawMessage(message.Raw)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		message.Err = err
+		return message
+	}
+
+	message.Body = sns.Message
+	message.Tenant = sns.Tenant()
+
+	//Pick up the trace context of the publisher, if it was passed on as SNS
+	//message attributes
+	publisherCtx := otel.GetTextMapPropagator().Extract(context.Background(), snsAttributeCarrier(sns.MessageAttributes))
+	message.TraceContext = trace.SpanContextFromContext(publisherCtx)
+	if message.TraceContext.IsValid() {
+		span.AddLink(trace.Link{SpanContext: message.TraceContext})
+	}
+
+	return message
+}
+
+func (s *SQSSource) Ack(ctx context.Context, msg *Message) error {
+	log.WithFields(log.Fields{"MsgId": msg.ID}).Infof("Delete message %s", msg.ID)
+
+	params := &sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(s.queueURL),
+		ReceiptHandle: aws.String(msg.Receipt),
+	}
+	_, err := s.svc.DeleteMessageWithContext(ctx, params)
+	return err
+}
+
+func (s *SQSSource) Nack(ctx context.Context, msg *Message, delay time.Duration) error {
+	log.WithFields(log.Fields{"MsgId": msg.ID}).Infof("Return message %s to queue", msg.ID)
+
+	params := &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(s.queueURL),
+		ReceiptHandle:     aws.String(msg.Receipt),
+		VisibilityTimeout: aws.Int64(int64(delay.Seconds())),
+	}
+	_, err := s.svc.ChangeMessageVisibilityWithContext(ctx, params)
+	return err
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/xtracdev/envinject"
+	"github.com/xtracdev/es-atom-data-pg"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	tracerName         = "github.com/xtracdev/es-atom-data-pg/cmd"
+	defaultServiceName = "esatomdatapg"
+
+	TracesExporterOTLP   = "otlp"
+	TracesExporterStdout = "stdout"
+	TracesExporterNone   = "none"
+)
+
+var tracer trace.Tracer = otel.Tracer(tracerName)
+
+// initTracing installs the global tracer provider and propagator. Spans are
+// exported according to OTEL_TRACES_EXPORTER: otlp sends them over HTTP to the
+// collector given by the standard OTEL_EXPORTER_OTLP_* variables, stdout writes
+// them to standard out, and none, the default, disables tracing. The returned
+// function flushes any buffered spans and shuts the provider down.
+func initTracing(ctx context.Context, env *envinject.InjectedEnv) (func(context.Context) error, error) {
+	//Trace context is extracted from messages even when not exporting so that
+	//it can be logged and passed on.
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{},
+	))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch name := env.Getenv(TracesExporterEnv); name {
+	case "", TracesExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case TracesExporterOTLP:
+		exporter, err = otlptracehttp.New(ctx)
+	case TracesExporterStdout:
+		exporter, err = stdouttrace.New()
+	default:
+		return nil, fmt.Errorf("Unknown %s %s", TracesExporterEnv, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	//Detectors later in the list take precedence, so OTEL_SERVICE_NAME and
+	//OTEL_RESOURCE_ATTRIBUTES override the default service name.
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", defaultServiceName)),
+		resource.WithTelemetrySDK(),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+
+	log.Infof("Exporting traces to %s", env.Getenv(TracesExporterEnv))
+	return provider.Shutdown, nil
+}
+
+// snsAttributeCarrier adapts the message attributes of an SNS notification for
+// trace context propagation.
+type snsAttributeCarrier map[string]SNSMessageAttribute
+
+func (c snsAttributeCarrier) Get(key string) string {
+	return c[key].Value
+}
+
+func (c snsAttributeCarrier) Set(key, value string) {
+	c[key] = SNSMessageAttribute{Type: "String", Value: value}
+}
+
+func (c snsAttributeCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// messageSpanLinks links to the trace context each message was published with
+func messageSpanLinks(messages []*Message) []trace.Link {
+	var links []trace.Link
+	for _, message := range messages {
+		if message.TraceContext.IsValid() {
+			links = append(links, trace.Link{SpanContext: message.TraceContext})
+		}
+	}
+	return links
+}
+
+// traceMessage records the processing of a message as a span in the trace it
+// was published with, linked to the span of the batch it was processed in.
+func traceMessage(batchSpan trace.Span, message *Message, result esatomdatapg.MessageResult, start, stop time.Time) {
+	if !message.TraceContext.IsValid() {
+		return
+	}
+
+	ctx := trace.ContextWithRemoteSpanContext(context.Background(), message.TraceContext)
+	_, span := tracer.Start(ctx, "Process message",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithTimestamp(start),
+		trace.WithLinks(trace.Link{SpanContext: batchSpan.SpanContext()}),
+		trace.WithAttributes(
+			attribute.String("messaging.message.id", message.ID),
+			attribute.String("outcome", result.Outcome.String()),
+		),
+	)
+
+	if result.Err != nil {
+		span.RecordError(result.Err)
+		span.SetStatus(codes.Error, result.Err.Error())
+	}
+	span.End(trace.WithTimestamp(stop))
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/stretchr/testify/assert"
+	"github.com/xtracdev/es-atom-data-pg"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	testTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	testSpanID  = "00f067aa0ba902b7"
+)
+
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	saved := tracer
+	tracer = provider.Tracer(tracerName)
+	t.Cleanup(func() { tracer = saved })
+
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return recorder
+}
+
+func snsEnvelope(attributes string) *sqs.Message {
+	return &sqs.Message{
+		MessageId:     aws.String("m1"),
+		ReceiptHandle: aws.String("r1"),
+		Body:          aws.String(`{"Message":"event","MessageAttributes":{` + attributes + `}}`),
+	}
+}
+
+func TestMessageFromSQSExtractsTraceContext(t *testing.T) {
+	recorder := recordSpans(t)
+
+	message := messageFromSQS(context.Background(), snsEnvelope(
+		`"traceparent":{"Type":"String","Value":"00-`+testTraceID+`-`+testSpanID+`-01"}`))
+	assert.Nil(t, message.Err)
+	assert.Equal(t, "event", message.Body)
+	assert.True(t, message.TraceContext.IsValid())
+	assert.Equal(t, testTraceID, message.TraceContext.TraceID().String())
+	assert.Equal(t, testSpanID, message.TraceContext.SpanID().String())
+
+	spans := recorder.Ended()
+	if assert.Equal(t, 1, len(spans)) {
+		assert.Equal(t, "SNSMessageFromRawMessage", spans[0].Name())
+		if assert.Equal(t, 1, len(spans[0].Links())) {
+			assert.Equal(t, message.TraceContext.TraceID(), spans[0].Links()[0].SpanContext.TraceID())
+		}
+	}
+}
+
+func TestMessageFromSQSWithoutTraceContext(t *testing.T) {
+	recordSpans(t)
+
+	message := messageFromSQS(context.Background(), snsEnvelope(""))
+	assert.Nil(t, message.Err)
+	assert.False(t, message.TraceContext.IsValid())
+}
+
+func TestMessageFromSQSTenant(t *testing.T) {
+	recordSpans(t)
+
+	message := messageFromSQS(context.Background(), snsEnvelope(`"tenant":{"Type":"String","Value":"acme"}`))
+	assert.Nil(t, message.Err)
+	assert.Equal(t, "acme", message.Tenant)
+}
+
+func TestMessageFromSQSBadEnvelopeSpan(t *testing.T) {
+	recorder := recordSpans(t)
+
+	message := messageFromSQS(context.Background(), &sqs.Message{
+		MessageId: aws.String("m1"),
+		Body:      aws.String("not json"),
+	})
+	assert.NotNil(t, message.Err)
+
+	spans := recorder.Ended()
+	if assert.Equal(t, 1, len(spans)) {
+		assert.Equal(t, codes.Error, spans[0].Status().Code)
+	}
+}
+
+func TestProcessTracesMessagesInPublisherTrace(t *testing.T) {
+	recorder := recordSpans(t)
+
+	traceID, _ := trace.TraceIDFromHex(testTraceID)
+	spanID, _ := trace.SpanIDFromHex(testSpanID)
+	publisher := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+		Remote:     true,
+	})
+
+	source := NewMemorySource("untraced")
+	traced := source.Add("traced")
+	traced.TraceContext = publisher
+
+	processor := &fakeProcessor{
+		results: map[string]esatomdatapg.MessageResult{
+			"traced":   {Err: &esatomdatapg.Error{Kind: esatomdatapg.ErrTransient}},
+			"untraced": {},
+		},
+	}
+	processReceived(t, NewConsumer(source, processor))
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	if !assert.Equal(t, 2, len(spans)) {
+		return
+	}
+
+	batch := spans["Process batch"]
+	if assert.Equal(t, 1, len(batch.Links())) {
+		assert.Equal(t, publisher, batch.Links()[0].SpanContext)
+	}
+
+	message := spans["Process message"]
+	assert.Equal(t, traceID, message.SpanContext().TraceID())
+	assert.Equal(t, spanID, message.Parent().SpanID())
+	assert.Equal(t, codes.Error, message.Status().Code)
+	if assert.Equal(t, 1, len(message.Links())) {
+		assert.Equal(t, batch.SpanContext().SpanID(), message.Links()[0].SpanContext.SpanID())
+	}
+}
@@ -0,0 +1,3 @@
+CREATE INDEX aeaenn_feedid_id
+ON t_aeae_atom_event
+USING BTREE (feedid ASC, id DESC);
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS t_aedl_dead_letter(
+    id bigserial,
+    recorded TIMESTAMP(6) WITHOUT TIME ZONE DEFAULT CLOCK_TIMESTAMP(),
+    message_id CHARACTER VARYING(200),
+    body TEXT,
+    raw TEXT,
+    error TEXT,
+    attempts INTEGER NOT NULL,
+    primary key(id)
+)
+WITH (
+    OIDS=FALSE
+);
@@ -0,0 +1,13 @@
+ALTER TABLE t_aeae_atom_event
+ADD COLUMN IF NOT EXISTS feed_name CHARACTER VARYING(60) NOT NULL DEFAULT 'default';
+
+ALTER TABLE t_aefd_feed
+ADD COLUMN IF NOT EXISTS feed_name CHARACTER VARYING(60) NOT NULL DEFAULT 'default';
+
+CREATE INDEX aeaenn_feed_name_feedid_id
+ON t_aeae_atom_event
+USING BTREE (feed_name ASC, feedid ASC, id DESC);
+
+CREATE INDEX aefdnn_feed_name_id
+ON t_aefd_feed
+USING BTREE (feed_name ASC, id DESC);
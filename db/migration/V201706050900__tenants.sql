@@ -0,0 +1,25 @@
+ALTER TABLE t_aeae_atom_event
+ADD COLUMN IF NOT EXISTS tenant CHARACTER VARYING(60) NOT NULL DEFAULT 'default';
+
+ALTER TABLE t_aefd_feed
+ADD COLUMN IF NOT EXISTS tenant CHARACTER VARYING(60) NOT NULL DEFAULT 'default';
+
+ALTER TABLE t_aeae_atom_event
+DROP CONSTRAINT t_aeae_atom_event_pkey,
+ADD PRIMARY KEY (tenant, aggregate_id, version);
+
+DROP INDEX IF EXISTS aeaenn_feed_name_feedid_id;
+
+DROP INDEX IF EXISTS aefdnn_feed_name_id;
+
+CREATE INDEX aeaenn_tenant_feed_name_feedid_id
+ON t_aeae_atom_event
+USING BTREE (tenant ASC, feed_name ASC, feedid ASC, id DESC);
+
+CREATE INDEX aeaenn_tenant_feedid_id
+ON t_aeae_atom_event
+USING BTREE (tenant ASC, feedid ASC, id DESC);
+
+CREATE INDEX aefdnn_tenant_feed_name_id
+ON t_aefd_feed
+USING BTREE (tenant ASC, feed_name ASC, id DESC);
@@ -0,0 +1,2 @@
+ALTER TABLE t_aeae_atom_event
+ADD COLUMN IF NOT EXISTS write_time TIMESTAMP(6) WITHOUT TIME ZONE NOT NULL DEFAULT (CLOCK_TIMESTAMP() AT TIME ZONE 'UTC');
@@ -0,0 +1,11 @@
+ALTER TABLE t_aeae_atom_event ENABLE ROW LEVEL SECURITY;
+
+ALTER TABLE t_aefd_feed ENABLE ROW LEVEL SECURITY;
+
+CREATE POLICY aeae_tenant_isolation
+ON t_aeae_atom_event
+USING (tenant = current_setting('app.tenant', true));
+
+CREATE POLICY aefd_tenant_isolation
+ON t_aefd_feed
+USING (tenant = current_setting('app.tenant', true));
@@ -0,0 +1,37 @@
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = 'aeae_processor') THEN
+        CREATE ROLE aeae_processor NOLOGIN;
+    END IF;
+END
+$$;
+
+GRANT SELECT, INSERT, UPDATE ON t_aeae_atom_event, t_aefd_feed TO aeae_processor;
+
+GRANT USAGE ON SEQUENCE t_aeae_atom_event_id_seq, t_aefd_feed_id_seq TO aeae_processor;
+
+ALTER TABLE t_aeae_atom_event FORCE ROW LEVEL SECURITY;
+
+ALTER TABLE t_aefd_feed FORCE ROW LEVEL SECURITY;
+
+ALTER POLICY aeae_tenant_isolation
+ON t_aeae_atom_event
+USING (tenant = current_setting('app.tenant', true))
+WITH CHECK (tenant = current_setting('app.tenant', true));
+
+ALTER POLICY aefd_tenant_isolation
+ON t_aefd_feed
+USING (tenant = current_setting('app.tenant', true))
+WITH CHECK (tenant = current_setting('app.tenant', true));
+
+CREATE POLICY aeae_processor_all_tenants
+ON t_aeae_atom_event
+TO aeae_processor
+USING (true)
+WITH CHECK (tenant ~ '^[A-Za-z0-9_-]{1,60}$');
+
+CREATE POLICY aefd_processor_all_tenants
+ON t_aefd_feed
+TO aeae_processor
+USING (true)
+WITH CHECK (tenant ~ '^[A-Za-z0-9_-]{1,60}$');
@@ -0,0 +1,79 @@
+package esatomdatapg
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+const (
+	sqlInsertDeadLetter  = `insert into t_aedl_dead_letter (message_id, body, raw, error, attempts) values ($1, $2, $3, $4, $5)`
+	sqlSelectDeadLetters = `select id, recorded, message_id, body, raw, error, attempts from t_aedl_dead_letter where id > $1 order by id limit $2`
+	sqlDeleteDeadLetter  = `delete from t_aedl_dead_letter where id = $1`
+	sqlUpdateDeadLetter  = `update t_aedl_dead_letter set error = $2, attempts = attempts + 1 where id = $1`
+)
+
+// DeadLetter is a message that could not be processed, kept for inspection and
+// replay.
+type DeadLetter struct {
+	ID        int64
+	Recorded  time.Time
+	MessageID string
+
+	//Body is the pgpublish encoded event, empty if it could not be extracted
+	//from the transport envelope
+	Body string
+
+	//Raw is the message as received from the transport
+	Raw string
+
+	Error    string
+	Attempts int
+}
+
+// WriteDeadLetter records a message that could not be processed in the dead
+// letter table.
+func WriteDeadLetter(ctx context.Context, db *sql.DB, dl *DeadLetter) error {
+	_, err := db.ExecContext(ctx, sqlInsertDeadLetter, dl.MessageID, dl.Body, dl.Raw, dl.Error, dl.Attempts)
+	return classifyDBError(err)
+}
+
+// RetrieveDeadLetters returns up to limit dead letters with ids greater than
+// afterID, oldest first.
+func RetrieveDeadLetters(ctx context.Context, db *sql.DB, afterID int64, limit int) ([]DeadLetter, error) {
+	rows, err := db.QueryContext(ctx, sqlSelectDeadLetters, afterID, limit)
+	if err != nil {
+		return nil, classifyDBError(err)
+	}
+
+	defer rows.Close()
+
+	var deadLetters []DeadLetter
+	for rows.Next() {
+		var dl DeadLetter
+		var messageID, body, raw, errorText sql.NullString
+		if err := rows.Scan(&dl.ID, &dl.Recorded, &messageID, &body, &raw, &errorText, &dl.Attempts); err != nil {
+			return nil, classifyDBError(err)
+		}
+
+		dl.MessageID = messageID.String
+		dl.Body = body.String
+		dl.Raw = raw.String
+		dl.Error = errorText.String
+		deadLetters = append(deadLetters, dl)
+	}
+
+	return deadLetters, classifyDBError(rows.Err())
+}
+
+// DeleteDeadLetter removes a dead letter, typically once it has been replayed
+func DeleteDeadLetter(ctx context.Context, db *sql.DB, id int64) error {
+	_, err := db.ExecContext(ctx, sqlDeleteDeadLetter, id)
+	return classifyDBError(err)
+}
+
+// RecordDeadLetterFailure updates a dead letter after a failed replay
+func RecordDeadLetterFailure(ctx context.Context, db *sql.DB, id int64, cause error) error {
+	_, err := db.ExecContext(ctx, sqlUpdateDeadLetter, id, cause.Error())
+	return classifyDBError(err)
+}
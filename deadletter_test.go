@@ -0,0 +1,66 @@
+package esatomdatapg
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func TestWriteDeadLetter(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec("insert into t_aedl_dead_letter").
+		WithArgs("msg-1", "body", "raw", "boom", 5).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	err = WriteDeadLetter(context.Background(), db, &DeadLetter{
+		MessageID: "msg-1", Body: "body", Raw: "raw", Error: "boom", Attempts: 5,
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestRetrieveDeadLetters(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	ts := time.Now()
+	rows := sqlmock.NewRows([]string{"id", "recorded", "message_id", "body", "raw", "error", "attempts"}).
+		AddRow(3, ts, "msg-1", "body", "raw", "boom", 5).
+		AddRow(4, ts, "msg-2", nil, "raw2", "bad envelope", 1)
+	mock.ExpectQuery("select id, recorded").WithArgs(2, 10).WillReturnRows(rows)
+
+	deadLetters, err := RetrieveDeadLetters(context.Background(), db, 2, 10)
+	if assert.Nil(t, err) && assert.Equal(t, 2, len(deadLetters)) {
+		assert.Equal(t, DeadLetter{ID: 3, Recorded: ts, MessageID: "msg-1", Body: "body", Raw: "raw", Error: "boom", Attempts: 5}, deadLetters[0])
+		assert.Equal(t, "", deadLetters[1].Body)
+		assert.Equal(t, "raw2", deadLetters[1].Raw)
+	}
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestDeleteAndUpdateDeadLetter(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec("update t_aedl_dead_letter").WithArgs(3, "boom").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("delete from t_aedl_dead_letter").WithArgs(3).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	assert.Nil(t, RecordDeadLetterFailure(context.Background(), db, 3, errors.New("boom")))
+	assert.Nil(t, DeleteDeadLetter(context.Background(), db, 3))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
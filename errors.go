@@ -0,0 +1,129 @@
+package esatomdatapg
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Sentinel errors identifying the kind of failure. Errors returned by the processor
+// and query functions wrap the underlying cause; use errors.Is to test the kind.
+var (
+	//ErrDecode means the message could not be decoded; retrying will not help
+	ErrDecode = errors.New("Unable to decode event message")
+
+	//ErrDuplicateEvent means an event with the same aggregate id and version but
+	//different content has already been stored
+	ErrDuplicateEvent = errors.New("Event already stored with different content")
+
+	//ErrFeedNotFound means the requested feed does not exist
+	ErrFeedNotFound = errors.New("Feed not found")
+
+	//ErrEventNotFound means the requested event does not exist
+	ErrEventNotFound = errors.New("Event not found")
+
+	//ErrTransient means the database was unavailable or the transaction could not be
+	//completed due to concurrent activity; the operation may succeed if retried
+	ErrTransient = errors.New("Transient database error")
+
+	//ErrRollover means the recent page could not be assigned to a new feed
+	ErrRollover = errors.New("Feed rollover failed")
+)
+
+// Error associates one of the sentinel error kinds with the underlying cause.
+type Error struct {
+	Kind  error
+	Cause error
+}
+
+func (e *Error) Error() string {
+	if e.Cause == nil {
+		return e.Kind.Error()
+	}
+	return e.Kind.Error() + ": " + e.Cause.Error()
+}
+
+// Is reports whether target is the kind of this error
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+// Unwrap returns the underlying cause
+func (e *Error) Unwrap() error {
+	return e.Cause
+}
+
+func wrapError(kind, cause error) error {
+	return &Error{Kind: kind, Cause: cause}
+}
+
+// Postgres error classes and codes that indicate a retry may succeed
+var transientPGErrorClasses = []string{
+	"08",    //connection exception
+	"40",    //transaction rollback: serialization failure, deadlock detected
+	"53",    //insufficient resources
+	"57P",   //operator intervention: admin shutdown, crash shutdown, cannot connect now
+	"55P03", //lock not available
+}
+
+// classifyDBError wraps database errors that may succeed on retry with ErrTransient.
+// Other errors, and context cancellation, are returned as is.
+func classifyDBError(err error) error {
+	if err == nil || errors.Is(err, ErrTransient) {
+		return err
+	}
+
+	if isTransientDBError(err) {
+		return wrapError(ErrTransient, err)
+	}
+
+	return err
+}
+
+func isTransientDBError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		for _, class := range transientPGErrorClasses {
+			if strings.HasPrefix(string(pqErr.Code), class) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// isConnectionError reports whether err means the connection to the database was
+// lost, as opposed to a transient failure of the transaction.
+func isConnectionError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code.Class() == "08" || strings.HasPrefix(string(pqErr.Code), "57P")
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
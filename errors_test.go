@@ -0,0 +1,72 @@
+package esatomdatapg
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"testing"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorKindAndCause(t *testing.T) {
+	cause := errors.New("bad message")
+	err := wrapError(ErrDecode, cause)
+
+	assert.True(t, errors.Is(err, ErrDecode))
+	assert.True(t, errors.Is(err, cause))
+	assert.False(t, errors.Is(err, ErrTransient))
+	assert.Equal(t, "Unable to decode event message: bad message", err.Error())
+	assert.Equal(t, "Feed not found", wrapError(ErrFeedNotFound, nil).Error())
+}
+
+func TestClassifyDBError(t *testing.T) {
+	transient := []error{
+		driver.ErrBadConn,
+		&pq.Error{Code: "08006"},
+		&pq.Error{Code: "40001"},
+		&pq.Error{Code: "40P01"},
+		&pq.Error{Code: "57P01"},
+		&pq.Error{Code: "55P03"},
+	}
+
+	for _, err := range transient {
+		classified := classifyDBError(err)
+		assert.True(t, errors.Is(classified, ErrTransient), "expected %v to be transient", err)
+		assert.True(t, errors.Is(classified, err))
+	}
+
+	permanent := []error{
+		errors.New("boom"),
+		sql.ErrNoRows,
+		context.Canceled,
+		&pq.Error{Code: "23505"},
+		&pq.Error{Code: "22001"},
+	}
+
+	for _, err := range permanent {
+		assert.Equal(t, err, classifyDBError(err))
+	}
+
+	assert.Nil(t, classifyDBError(nil))
+
+	already := wrapError(ErrTransient, driver.ErrBadConn)
+	assert.Equal(t, already, classifyDBError(already))
+}
+
+func TestRolloverErrorIsTransient(t *testing.T) {
+	err := wrapError(ErrRollover, classifyDBError(&pq.Error{Code: "40001"}))
+	assert.True(t, errors.Is(err, ErrRollover))
+	assert.True(t, errors.Is(err, ErrTransient))
+}
+
+func TestIsConnectionError(t *testing.T) {
+	assert.True(t, isConnectionError(&pq.Error{Code: "08006"}))
+	assert.True(t, isConnectionError(&pq.Error{Code: "57P01"}))
+	assert.True(t, isConnectionError(driver.ErrBadConn))
+	assert.False(t, isConnectionError(&pq.Error{Code: "40001"}))
+	assert.False(t, isConnectionError(context.Canceled))
+	assert.False(t, isConnectionError(errors.New("boom")))
+}
@@ -0,0 +1,171 @@
+package esatomdatapg
+
+import (
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/xtracdev/envinject"
+	"github.com/xtracdev/goes"
+)
+
+const (
+	//DefaultFeed is the feed events are written to when they match no route
+	DefaultFeed = "default"
+
+	//Routes of events to named feeds, as a semicolon separated list of
+	//feed=selector,... entries. A selector is a typecode, or prefix: followed by
+	//an aggregate id prefix, for example
+	//customers=CustomerCreated,CustomerUpdated;orders=prefix:ord-
+	EnvFeedRoutes = "FEED_ROUTES"
+
+	aggregatePrefixSelector = "prefix:"
+)
+
+var feedName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,60}$`)
+
+// feedRef identifies a named feed of a tenant
+type feedRef struct {
+	tenant string
+	name   string
+}
+
+var defaultFeedRef = feedRef{tenant: DefaultTenant, name: DefaultFeed}
+
+// sortFeedRefs sorts feeds by tenant then name, the order writers lock them in
+func sortFeedRefs(feeds []feedRef) {
+	sort.Slice(feeds, func(i, j int) bool {
+		if feeds[i].tenant != feeds[j].tenant {
+			return feeds[i].tenant < feeds[j].tenant
+		}
+		return feeds[i].name < feeds[j].name
+	})
+}
+
+// FeedRoute writes matching events to the named feed rather than the default
+// feed. An event matches if its typecode is one of Typecodes, or its aggregate id
+// starts with AggregatePrefix.
+type FeedRoute struct {
+	Feed            string
+	Typecodes       []string
+	AggregatePrefix string
+}
+
+func (fr *FeedRoute) matches(event *goes.Event) bool {
+	for _, typecode := range fr.Typecodes {
+		if event.TypeCode == typecode {
+			return true
+		}
+	}
+
+	return fr.AggregatePrefix != "" && strings.HasPrefix(event.Source, fr.AggregatePrefix)
+}
+
+func (fr *FeedRoute) validate() error {
+	if !feedName.MatchString(fr.Feed) {
+		return fmt.Errorf("Invalid feed name %q", fr.Feed)
+	}
+
+	if len(fr.Typecodes) == 0 && fr.AggregatePrefix == "" {
+		return fmt.Errorf("Route to feed %s matches no events", fr.Feed)
+	}
+
+	return nil
+}
+
+// route returns the feed event is written to: the feed of the first route it
+// matches, or DefaultFeed
+func (adp *AtomDataProcessor) route(event *goes.Event) string {
+	for i := range adp.routes {
+		if adp.routes[i].matches(event) {
+			return adp.routes[i].Feed
+		}
+	}
+	return DefaultFeed
+}
+
+// Feeds returns the names of the feeds the processor writes to, DefaultFeed first
+func (adp *AtomDataProcessor) Feeds() []string {
+	feeds := []string{DefaultFeed}
+	seen := map[string]bool{DefaultFeed: true}
+	for _, fr := range adp.routes {
+		if !seen[fr.Feed] {
+			seen[fr.Feed] = true
+			feeds = append(feeds, fr.Feed)
+		}
+	}
+	return feeds
+}
+
+// lockKeyFor derives the lock key serializing the writers of feed. The default
+// feed of the default tenant uses the processor's lock key so processors without
+// routes or tenants lock as before.
+func (adp *AtomDataProcessor) lockKeyFor(feed feedRef) int64 {
+	if feed == defaultFeedRef {
+		return adp.lockKey
+	}
+
+	//Tenant names can't contain a slash, so the key names one feed of one tenant
+	key := feed.name
+	if feed.tenant != DefaultTenant {
+		key = feed.tenant + "/" + feed.name
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return adp.lockKey ^ int64(h.Sum64())
+}
+
+// parseFeedRoutes parses routes in the FEED_ROUTES format
+func parseFeedRoutes(value string) ([]FeedRoute, error) {
+	var routes []FeedRoute
+	for _, entry := range strings.Split(value, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Feed route %q is not of the form feed=selector,...", entry)
+		}
+
+		route := FeedRoute{Feed: strings.TrimSpace(parts[0])}
+		for _, selector := range strings.Split(parts[1], ",") {
+			selector = strings.TrimSpace(selector)
+			switch {
+			case selector == "":
+			case strings.HasPrefix(selector, aggregatePrefixSelector):
+				if route.AggregatePrefix != "" {
+					return nil, fmt.Errorf("Route to feed %s has more than one aggregate prefix", route.Feed)
+				}
+				route.AggregatePrefix = strings.TrimPrefix(selector, aggregatePrefixSelector)
+			default:
+				route.Typecodes = append(route.Typecodes, selector)
+			}
+		}
+
+		if err := route.validate(); err != nil {
+			return nil, err
+		}
+		routes = append(routes, route)
+	}
+
+	return routes, nil
+}
+
+func readFeedRoutesFromEnv(env *envinject.InjectedEnv) ([]FeedRoute, error) {
+	value := env.Getenv(EnvFeedRoutes)
+	if value == "" {
+		return nil, nil
+	}
+
+	routes, err := parseFeedRoutes(value)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %s: %s", EnvFeedRoutes, err.Error())
+	}
+
+	return routes, nil
+}
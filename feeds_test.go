@@ -0,0 +1,125 @@
+package esatomdatapg
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xtracdev/goes"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func TestParseFeedRoutes(t *testing.T) {
+	routes, err := parseFeedRoutes(" customers=CustomerCreated, CustomerUpdated ;orders=prefix:ord-;")
+	if assert.Nil(t, err) {
+		assert.Equal(t, []FeedRoute{
+			{Feed: "customers", Typecodes: []string{"CustomerCreated", "CustomerUpdated"}},
+			{Feed: "orders", AggregatePrefix: "ord-"},
+		}, routes)
+	}
+
+	for _, value := range []string{
+		"customers",
+		"customers=",
+		"bad name=CustomerCreated",
+		"=CustomerCreated",
+		"orders=prefix:a,prefix:b",
+	} {
+		_, err := parseFeedRoutes(value)
+		assert.NotNil(t, err, value)
+	}
+}
+
+func TestRoute(t *testing.T) {
+	processor, err := New(nil, WithFeedRoutes(
+		FeedRoute{Feed: "customers", Typecodes: []string{"CustomerCreated"}},
+		FeedRoute{Feed: "orders", AggregatePrefix: "ord-"},
+		FeedRoute{Feed: "customers", AggregatePrefix: "cust-"},
+	))
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	assert.Equal(t, "customers", processor.route(&goes.Event{Source: "ord-1", TypeCode: "CustomerCreated"}))
+	assert.Equal(t, "orders", processor.route(&goes.Event{Source: "ord-1", TypeCode: "OrderPlaced"}))
+	assert.Equal(t, "customers", processor.route(&goes.Event{Source: "cust-1", TypeCode: "CustomerMoved"}))
+	assert.Equal(t, DefaultFeed, processor.route(&goes.Event{Source: "inv-1", TypeCode: "InvoiceSent"}))
+	assert.Equal(t, []string{DefaultFeed, "customers", "orders"}, processor.Feeds())
+}
+
+func TestFeedLockKeys(t *testing.T) {
+	processor, _ := New(nil)
+	customers := feedRef{tenant: DefaultTenant, name: "customers"}
+	assert.Equal(t, feedLockKey, processor.lockKeyFor(defaultFeedRef))
+	assert.NotEqual(t, feedLockKey, processor.lockKeyFor(customers))
+	assert.NotEqual(t, processor.lockKeyFor(feedRef{tenant: DefaultTenant, name: "orders"}), processor.lockKeyFor(customers))
+
+	schemaProcessor, _ := New(nil, WithSchema("unit_a"))
+	assert.NotEqual(t, processor.lockKeyFor(customers), schemaProcessor.lockKeyFor(customers))
+}
+
+func TestProcessMessageNamedFeed(t *testing.T) {
+	processor, mock, done := newTestProcessor(t, WithFeedThreshold(2),
+		WithFeedRoutes(FeedRoute{Feed: "customers", Typecodes: []string{"foo"}}))
+	defer done()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`select pg_advisory_xact_lock`).WithArgs(processor.lockKeyFor(feedRef{tenant: DefaultTenant, name: "customers"})).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("select feedid from t_aefd_feed").WithArgs(DefaultTenant, "customers").
+		WillReturnRows(sqlmock.NewRows([]string{"feedid"}).AddRow("XXX"))
+	mock.ExpectExec("insert into t_aeae_atom_event").WithArgs("agg1", 1, "foo", []byte("ok"), ts, "customers", DefaultTenant).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(`select count`).WithArgs(DefaultTenant, "customers").
+		WillReturnRows(sqlmock.NewRows([]string{"count(*)"}).AddRow(2))
+	mock.ExpectExec("update t_aeae_atom_event set feedid").WithArgs(sqlmock.AnyArg(), DefaultTenant, "customers").
+		WillReturnResult(sqlmock.NewResult(1, 2))
+	mock.ExpectExec("insert into t_aefd_feed").WithArgs(sqlmock.AnyArg(), "XXX", "customers", DefaultTenant).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	assert.Nil(t, processor.ProcessMessage(batchMessage("agg1")))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func expectFeedBatchInsert(mock sqlmock.Sqlmock, aggId, feed string) {
+	mock.ExpectExec("savepoint batch_event").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("insert into t_aeae_atom_event").WithArgs(aggId, 1, "foo", []byte("ok"), ts, feed, DefaultTenant).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("release savepoint batch_event").WillReturnResult(sqlmock.NewResult(0, 0))
+}
+
+func TestProcessMessagesAcrossFeeds(t *testing.T) {
+	processor, mock, done := newTestProcessor(t, WithFeedThreshold(2),
+		WithFeedRoutes(FeedRoute{Feed: "customers", AggregatePrefix: "cust"}))
+	defer done()
+
+	//Feeds are locked in name order, then their pages read
+	mock.ExpectBegin()
+	mock.ExpectExec(`select pg_advisory_xact_lock`).WithArgs(processor.lockKeyFor(feedRef{tenant: DefaultTenant, name: "customers"})).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`select pg_advisory_xact_lock`).WithArgs(feedLockKey).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("select feedid from t_aefd_feed").WithArgs(DefaultTenant, "customers").
+		WillReturnRows(sqlmock.NewRows([]string{"feedid"}))
+	mock.ExpectQuery(`select count`).WithArgs(DefaultTenant, "customers").
+		WillReturnRows(sqlmock.NewRows([]string{"count(*)"}).AddRow(0))
+	mock.ExpectQuery("select feedid from t_aefd_feed").WithArgs(DefaultTenant, DefaultFeed).
+		WillReturnRows(sqlmock.NewRows([]string{"feedid"}).AddRow("XXX"))
+	mock.ExpectQuery(`select count`).WithArgs(DefaultTenant, DefaultFeed).
+		WillReturnRows(sqlmock.NewRows([]string{"count(*)"}).AddRow(1))
+
+	//Only the default feed reaches the threshold
+	expectFeedBatchInsert(mock, "cust1", "customers")
+	expectFeedBatchInsert(mock, "agg1", DefaultFeed)
+	mock.ExpectExec("update t_aeae_atom_event set feedid").WithArgs(sqlmock.AnyArg(), DefaultTenant, DefaultFeed).
+		WillReturnResult(sqlmock.NewResult(1, 2))
+	mock.ExpectExec("insert into t_aefd_feed").WithArgs(sqlmock.AnyArg(), "XXX", DefaultFeed, DefaultTenant).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	results := processor.ProcessMessages([]string{batchMessage("cust1"), batchMessage("agg1")})
+	for _, r := range results {
+		assert.Nil(t, r.Err)
+	}
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
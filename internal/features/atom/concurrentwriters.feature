@@ -0,0 +1,8 @@
+@concurrentwriters
+Feature: Concurrent writers
+  Scenario:
+    Given a clean feed environment and several processors
+    When many events are written concurrently
+    Then all the events are stored
+    And every full page of events is assigned to exactly one feed
+    And the feed chain is linear
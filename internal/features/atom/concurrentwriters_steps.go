@@ -0,0 +1,183 @@
+package atom
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	. "github.com/gucumber/gucumber"
+	"github.com/stretchr/testify/assert"
+	"github.com/xtracdev/envinject"
+	ad "github.com/xtracdev/es-atom-data-pg"
+	"github.com/xtracdev/pgconn"
+	"github.com/xtracdev/pgpublish"
+)
+
+const (
+	concurrentWriters        = 8
+	eventsPerWriter          = 25
+	concurrentFeedThreshold  = 10
+	concurrentExpectedEvents = concurrentWriters * eventsPerWriter
+)
+
+func init() {
+	var processors []*ad.AtomDataProcessor
+	var initFailed bool
+	var ts = time.Now()
+
+	log.Info("Init test envionment")
+	env, err := envinject.NewInjectedEnv()
+	if err != nil {
+		log.Warnf("Failed environment init: %s", err.Error())
+		initFailed = true
+	}
+
+	db, err := pgconn.OpenAndConnect(env, 1)
+	if err != nil {
+		log.Warnf("Failed environment init: %s", err.Error())
+		initFailed = true
+	}
+
+	Given(`^a clean feed environment and several processors$`, func() {
+		if initFailed {
+			assert.False(T, initFailed, "Test env init failure")
+			return
+		}
+
+		_, err = db.Exec("delete from t_aeae_atom_event")
+		assert.Nil(T, err)
+		_, err = db.Exec("delete from t_aefd_feed")
+		assert.Nil(T, err)
+
+		threshold := os.Getenv(ad.EnvFeedThreshold)
+		os.Setenv(ad.EnvFeedThreshold, strconv.Itoa(concurrentFeedThreshold))
+		defer os.Setenv(ad.EnvFeedThreshold, threshold)
+
+		thresholdEnv, err := envinject.NewInjectedEnv()
+		if !assert.Nil(T, err) {
+			return
+		}
+
+		//Each processor stands in for a separate eventprocessor instance
+		//sharing the same database.
+		processors = nil
+		for i := 0; i < concurrentWriters; i++ {
+			p, err := ad.NewAtomDataProcessor(db.DB, thresholdEnv)
+			if assert.Nil(T, err) {
+				processors = append(processors, p)
+			}
+		}
+	})
+
+	When(`^many events are written concurrently$`, func() {
+		if initFailed {
+			return
+		}
+
+		var wg sync.WaitGroup
+		errs := make(chan error, concurrentExpectedEvents)
+
+		for i, p := range processors {
+			wg.Add(1)
+			go func(writer int, processor *ad.AtomDataProcessor) {
+				defer wg.Done()
+				for j := 0; j < eventsPerWriter; j++ {
+					aggId := fmt.Sprintf("writer%d-agg%d", writer, j)
+					encodedEvent := pgpublish.EncodePGEvent(aggId, 1, []byte("ok"), "foo", ts)
+					errs <- processor.ProcessMessage(encodedEvent)
+				}
+			}(i, p)
+		}
+
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			assert.Nil(T, err)
+		}
+	})
+
+	Then(`^all the events are stored$`, func() {
+		if initFailed {
+			return
+		}
+
+		var count int
+		err := db.QueryRow("select count(*) from t_aeae_atom_event").Scan(&count)
+		if assert.Nil(T, err) {
+			assert.Equal(T, concurrentExpectedEvents, count)
+		}
+	})
+
+	And(`^every full page of events is assigned to exactly one feed$`, func() {
+		if initFailed {
+			return
+		}
+
+		rows, err := db.Query("select feedid, count(*) from t_aeae_atom_event where feedid is not null group by feedid")
+		if !assert.Nil(T, err) {
+			return
+		}
+		defer rows.Close()
+
+		var pages int
+		for rows.Next() {
+			var feedid string
+			var count int
+			if assert.Nil(T, rows.Scan(&feedid, &count)) {
+				assert.Equal(T, concurrentFeedThreshold, count, "Unexpected page size for feed %s", feedid)
+				pages++
+			}
+		}
+		assert.Nil(T, rows.Err())
+		assert.Equal(T, concurrentExpectedEvents/concurrentFeedThreshold, pages)
+
+		var recent int
+		err = db.QueryRow("select count(*) from t_aeae_atom_event where feedid is null").Scan(&recent)
+		if assert.Nil(T, err) {
+			assert.Equal(T, concurrentExpectedEvents%concurrentFeedThreshold, recent)
+		}
+	})
+
+	And(`^the feed chain is linear$`, func() {
+		if initFailed {
+			return
+		}
+
+		var feedCount, firstFeeds, sharedPrevious int
+		err := db.QueryRow("select count(*) from t_aefd_feed").Scan(&feedCount)
+		assert.Nil(T, err)
+
+		err = db.QueryRow("select count(*) from t_aefd_feed where previous is null").Scan(&firstFeeds)
+		if assert.Nil(T, err) {
+			assert.Equal(T, 1, firstFeeds, "Expected exactly one feed without a previous feed")
+		}
+
+		err = db.QueryRow("select count(*) from (select previous from t_aefd_feed where previous is not null group by previous having count(*) > 1) s").Scan(&sharedPrevious)
+		if assert.Nil(T, err) {
+			assert.Equal(T, 0, sharedPrevious, "Expected no two feeds to share a previous feed")
+		}
+
+		//Walk back from the latest feed, we should visit every feed
+		feedid, err := ad.RetrieveLastFeed(db.DB)
+		if !assert.Nil(T, err) {
+			return
+		}
+
+		visited := 0
+		current := sql.NullString{String: feedid, Valid: feedid != ""}
+		for current.Valid && visited <= feedCount {
+			visited++
+			current, err = ad.RetrievePreviousFeed(db.DB, current.String)
+			if !assert.Nil(T, err) {
+				return
+			}
+		}
+
+		assert.Equal(T, feedCount, visited)
+	})
+}
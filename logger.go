@@ -0,0 +1,90 @@
+package esatomdatapg
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/xtracdev/goes"
+)
+
+// Field names used in the structured log entries of AtomDataProcessor
+const (
+	FieldAggregateID    = "aggregate_id"
+	FieldVersion        = "version"
+	FieldTypecode       = "typecode"
+	FieldTenant         = "tenant"
+	FieldFeedName       = "feed_name"
+	FieldFeedID         = "feedid"
+	FieldPreviousFeedID = "previous_feedid"
+	FieldPayload        = "payload"
+	FieldPayloadBytes   = "payload_bytes"
+	FieldError          = "error"
+)
+
+// Fields are the structured context of a log entry
+type Fields map[string]interface{}
+
+// Logger receives the log output of AtomDataProcessor. Entries carry the
+// aggregate id, version, typecode and feed id they relate to as fields rather
+// than in the message.
+type Logger interface {
+	Debug(msg string, fields Fields)
+	Info(msg string, fields Fields)
+	Warn(msg string, fields Fields)
+	Error(msg string, fields Fields)
+}
+
+type logrusLogger struct {
+	logger *log.Logger
+}
+
+// NewLogrusLogger returns a Logger writing to logger, or to the standard logrus
+// logger if logger is nil.
+func NewLogrusLogger(logger *log.Logger) Logger {
+	if logger == nil {
+		logger = log.StandardLogger()
+	}
+	return &logrusLogger{logger: logger}
+}
+
+func (l *logrusLogger) Debug(msg string, fields Fields) {
+	l.logger.WithFields(log.Fields(fields)).Debug(msg)
+}
+
+func (l *logrusLogger) Info(msg string, fields Fields) {
+	l.logger.WithFields(log.Fields(fields)).Info(msg)
+}
+
+func (l *logrusLogger) Warn(msg string, fields Fields) {
+	l.logger.WithFields(log.Fields(fields)).Warn(msg)
+}
+
+func (l *logrusLogger) Error(msg string, fields Fields) {
+	l.logger.WithFields(log.Fields(fields)).Error(msg)
+}
+
+// eventFields identifies event in a log entry, without its payload
+func eventFields(event *goes.Event) Fields {
+	return Fields{
+		FieldAggregateID: event.Source,
+		FieldVersion:     event.Version,
+		FieldTypecode:    event.TypeCode,
+	}
+}
+
+// errorFields adds err to fields
+func errorFields(fields Fields, err error) Fields {
+	fields[FieldError] = err.Error()
+	return fields
+}
+
+// logEvent logs an event about to be written at debug level. Payloads can hold
+// sensitive data, so only the payload size is logged unless payload logging was
+// enabled with LOG_PAYLOADS.
+func (adp *AtomDataProcessor) logEvent(event *goes.Event) {
+	fields := eventFields(event)
+	payload, _ := event.Payload.([]byte)
+	fields[FieldPayloadBytes] = len(payload)
+	if adp.logPayloads {
+		fields[FieldPayload] = string(payload)
+	}
+	adp.logger.Debug("Process event", fields)
+}
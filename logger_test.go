@@ -0,0 +1,129 @@
+package esatomdatapg
+
+import (
+	"bytes"
+	"os"
+	"sync"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/xtracdev/envinject"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+type logEntry struct {
+	level  string
+	msg    string
+	fields Fields
+}
+
+type recordingLogger struct {
+	sync.Mutex
+	entries []logEntry
+}
+
+func (l *recordingLogger) record(level, msg string, fields Fields) {
+	l.Lock()
+	defer l.Unlock()
+	l.entries = append(l.entries, logEntry{level, msg, fields})
+}
+
+func (l *recordingLogger) Debug(msg string, fields Fields) { l.record("debug", msg, fields) }
+func (l *recordingLogger) Info(msg string, fields Fields)  { l.record("info", msg, fields) }
+func (l *recordingLogger) Warn(msg string, fields Fields)  { l.record("warn", msg, fields) }
+func (l *recordingLogger) Error(msg string, fields Fields) { l.record("error", msg, fields) }
+
+func (l *recordingLogger) find(msg string) *logEntry {
+	for i := range l.entries {
+		if l.entries[i].msg == msg {
+			return &l.entries[i]
+		}
+	}
+	return nil
+}
+
+func processWithLogger(t *testing.T, logPayloads string) *recordingLogger {
+	if logPayloads == "" {
+		os.Unsetenv(EnvLogPayloads)
+	} else {
+		os.Setenv(EnvLogPayloads, logPayloads)
+		defer os.Unsetenv(EnvLogPayloads)
+	}
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	testInsertOkSetup(mock)
+
+	logger := &recordingLogger{}
+	env, _ := envinject.NewInjectedEnv()
+	processor, err := New(db, WithLogger(logger), WithEnv(env))
+	if !assert.Nil(t, err) {
+		return logger
+	}
+
+	assert.Nil(t, processor.ProcessMessage(batchMessage("agg1")))
+	assert.Nil(t, mock.ExpectationsWereMet())
+	return logger
+}
+
+func TestPayloadNotLoggedByDefault(t *testing.T) {
+	logger := processWithLogger(t, "")
+
+	for _, entry := range logger.entries {
+		_, ok := entry.fields[FieldPayload]
+		assert.False(t, ok, entry.msg)
+	}
+
+	entry := logger.find("Process event")
+	if assert.NotNil(t, entry) {
+		assert.Equal(t, "debug", entry.level)
+		assert.Equal(t, "agg1", entry.fields[FieldAggregateID])
+		assert.Equal(t, 1, entry.fields[FieldVersion])
+		assert.Equal(t, "foo", entry.fields[FieldTypecode])
+		assert.Equal(t, 2, entry.fields[FieldPayloadBytes])
+	}
+}
+
+func TestPayloadLoggingOptIn(t *testing.T) {
+	logger := processWithLogger(t, "true")
+
+	entry := logger.find("Process event")
+	if assert.NotNil(t, entry) {
+		assert.Equal(t, "debug", entry.level)
+		assert.Equal(t, "ok", entry.fields[FieldPayload])
+	}
+
+	for _, entry := range logger.entries {
+		if entry.level != "debug" {
+			_, ok := entry.fields[FieldPayload]
+			assert.False(t, ok, entry.msg)
+		}
+	}
+}
+
+func TestInvalidPayloadLoggingSetting(t *testing.T) {
+	logger := processWithLogger(t, "sometimes")
+
+	assert.NotNil(t, logger.find("Invalid payload logging setting, payloads will not be logged"))
+	entry := logger.find("Process event")
+	if assert.NotNil(t, entry) {
+		_, ok := entry.fields[FieldPayload]
+		assert.False(t, ok)
+	}
+}
+
+func TestLogrusLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logrusLogger := log.New()
+	logrusLogger.Out = &buf
+	logrusLogger.Formatter = &log.JSONFormatter{}
+
+	NewLogrusLogger(logrusLogger).Info("Create new feed", Fields{FieldFeedID: "feed2", FieldPreviousFeedID: "feed1"})
+	assert.Contains(t, buf.String(), `"feedid":"feed2"`)
+	assert.Contains(t, buf.String(), `"previous_feedid":"feed1"`)
+	assert.Contains(t, buf.String(), `"msg":"Create new feed"`)
+}
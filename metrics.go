@@ -0,0 +1,36 @@
+package esatomdatapg
+
+import "errors"
+
+// Metrics receives measurements from the processor. Measurements are reported
+// once the transaction writing the events has committed. Implementations must be
+// safe for concurrent use.
+type Metrics interface {
+	//EventStored is called for each event written, or found to be already stored
+	EventStored(outcome Outcome)
+
+	//FeedRolledOver is called when the recent page is assigned to a new feed
+	FeedRolledOver()
+
+	//RecentPageSize reports the number of events in the recent page of the feed
+	//of tenant written to
+	RecentPageSize(tenant, feed string, size int)
+
+	//TransientRetry is called when a write is retried after a transient error
+	TransientRetry()
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) EventStored(outcome Outcome)                  {}
+func (nopMetrics) FeedRolledOver()                              {}
+func (nopMetrics) RecentPageSize(tenant, feed string, size int) {}
+func (nopMetrics) TransientRetry()                              {}
+
+// recordStored reports the outcome of an event, unless it failed for a reason
+// other than conflicting with a stored event
+func (adp *AtomDataProcessor) recordStored(outcome Outcome, err error) {
+	if err == nil || (outcome == DuplicateConflicting && errors.Is(err, ErrDuplicateEvent)) {
+		adp.metrics.EventStored(outcome)
+	}
+}
@@ -0,0 +1,118 @@
+package esatomdatapg
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"github.com/xtracdev/pgpublish"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+type recordingMetrics struct {
+	sync.Mutex
+	stored     map[Outcome]int
+	rollovers  int
+	recentFeed feedRef
+	recentSize int
+	retries    int
+}
+
+func newRecordingMetrics() *recordingMetrics {
+	return &recordingMetrics{stored: make(map[Outcome]int), recentSize: -1}
+}
+
+func (m *recordingMetrics) EventStored(outcome Outcome) {
+	m.Lock()
+	defer m.Unlock()
+	m.stored[outcome]++
+}
+
+func (m *recordingMetrics) FeedRolledOver() {
+	m.Lock()
+	defer m.Unlock()
+	m.rollovers++
+}
+
+func (m *recordingMetrics) RecentPageSize(tenant, feed string, size int) {
+	m.Lock()
+	defer m.Unlock()
+	m.recentFeed = feedRef{tenant: tenant, name: feed}
+	m.recentSize = size
+}
+
+func (m *recordingMetrics) TransientRetry() {
+	m.Lock()
+	defer m.Unlock()
+	m.retries++
+}
+
+func TestProcessMessageMetrics(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin().WillReturnError(&pq.Error{Code: "40001"})
+	testInsertOkSetup(mock)
+	testDuplicateSetup(mock, "foo", []byte("ok"))
+
+	processor := testRetryProcessor(t, db)
+	metrics := newRecordingMetrics()
+	processor.metrics = metrics
+
+	eventMessage := pgpublish.EncodePGEvent("agg1", 1, []byte("ok"), "foo", ts)
+	assert.Nil(t, processor.ProcessMessage(eventMessage))
+	assert.Nil(t, processor.ProcessMessage(eventMessage))
+
+	assert.Equal(t, map[Outcome]int{Inserted: 1, DuplicateIdentical: 1}, metrics.stored)
+	assert.Equal(t, 1, metrics.retries)
+	assert.Equal(t, 0, metrics.rollovers)
+	assert.Equal(t, defaultFeedRef, metrics.recentFeed)
+	assert.Equal(t, 1, metrics.recentSize)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestProcessMessagesMetrics(t *testing.T) {
+	processor, mock, done := newTestProcessor(t, WithFeedThreshold(2))
+	defer done()
+
+	metrics := newRecordingMetrics()
+	processor.metrics = metrics
+
+	expectBatchStart(mock, 1)
+	expectBatchInsert(mock, "agg1", nil)
+	expectBatchRollover(mock, "XXX")
+	expectBatchInsert(mock, "agg2", nil)
+	mock.ExpectCommit()
+
+	results := processor.ProcessMessagesContext(context.Background(), []string{batchMessage("agg1"), batchMessage("agg2"), "bad"})
+	assert.Equal(t, 3, len(results))
+
+	assert.Equal(t, map[Outcome]int{Inserted: 2}, metrics.stored)
+	assert.Equal(t, 1, metrics.rollovers)
+	assert.Equal(t, defaultFeedRef, metrics.recentFeed)
+	assert.Equal(t, 1, metrics.recentSize)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestProcessMessageMetricsNotRecordedOnRollback(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	testBeginSetup(mock, &falseVal)
+
+	processor := testRetryProcessor(t, db)
+	metrics := newRecordingMetrics()
+	processor.metrics = metrics
+
+	assert.NotNil(t, processor.ProcessMessage(pgpublish.EncodePGEvent("agg1", 1, []byte("ok"), "foo", ts)))
+	assert.Equal(t, 0, len(metrics.stored))
+	assert.Equal(t, -1, metrics.recentSize)
+}
@@ -0,0 +1,261 @@
+package esatomdatapg
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"time"
+
+	"github.com/xtracdev/envinject"
+)
+
+// IDGenerator returns the id for a new feed. Ids must be unique across all feeds.
+type IDGenerator func() (string, error)
+
+// Option configures an AtomDataProcessor created with New. Options are applied in
+// order, so a later option overrides an earlier one.
+type Option func(*AtomDataProcessor) error
+
+var schemaName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// New returns an AtomDataProcessor writing to db, configured by opts. Without
+// options the processor rolls over feeds every 100 events, retries transient
+// errors 3 times, logs to the standard logrus logger and uses the tables on the
+// connection's search path. An option given a nonsensical value, such as a
+// threshold of zero, makes New return an error.
+func New(db *sql.DB, opts ...Option) (*AtomDataProcessor, error) {
+	adp := &AtomDataProcessor{
+		db:               db,
+		feedThreshold:    defaultFeedThreshold,
+		transientRetries: defaultTransientRetries,
+		retryPolicy:      DefaultBackoffPolicy,
+		metrics:          nopMetrics{},
+		logger:           NewLogrusLogger(nil),
+		now:              time.Now,
+		newID:            uuid,
+		lockKey:          feedLockKey,
+		tenantResolver:   ContextTenant,
+	}
+
+	for _, opt := range opts {
+		if err := opt(adp); err != nil {
+			return nil, err
+		}
+	}
+
+	return adp, nil
+}
+
+// WithEnv configures the processor from FEED_THRESHOLD, FEED_MAX_PAGE_AGE,
+// FEED_MAX_PAGE_BYTES, FEED_ROUTES, TENANT_PAYLOAD_FIELD, TRANSIENT_RETRIES and
+// LOG_PAYLOADS in env.
+// An invalid value makes New return an error, as the matching option would. An
+// invalid LOG_PAYLOADS is logged and payloads are not logged, so WithLogger should
+// come before WithEnv for that warning to use the logger.
+func WithEnv(env *envinject.InjectedEnv) Option {
+	return func(adp *AtomDataProcessor) (err error) {
+		if env == nil {
+			return errors.New("Nil injected env")
+		}
+
+		adp.env = env
+		if adp.feedThreshold, err = readFeedThresholdFromEnv(env); err != nil {
+			return err
+		}
+		if adp.maxPageAge, err = readMaxPageAgeFromEnv(env); err != nil {
+			return err
+		}
+		if adp.maxPageBytes, err = readMaxPageBytesFromEnv(env); err != nil {
+			return err
+		}
+		if adp.routes, err = readFeedRoutesFromEnv(env); err != nil {
+			return err
+		}
+		if adp.transientRetries, err = readTransientRetriesFromEnv(env); err != nil {
+			return err
+		}
+		adp.tenantResolver = readTenantResolverFromEnv(env)
+		adp.logPayloads = readLogPayloadsFromEnv(env, adp.logger)
+		return nil
+	}
+}
+
+// WithFeedThreshold sets the number of events in the recent page that closes it
+// as a new archived feed.
+func WithFeedThreshold(threshold int) Option {
+	return func(adp *AtomDataProcessor) error {
+		if threshold <= 0 {
+			return fmt.Errorf("Feed threshold must be positive, got %d", threshold)
+		}
+
+		adp.feedThreshold = threshold
+		return nil
+	}
+}
+
+// WithMaxPageAge closes the recent page once it has been open for maxAge, measured
+// from when its first event was written rather than the event time, even if the
+// feed threshold has not been reached. The age is checked after each event written,
+// and by RunRollover or CloseExpiredPage, which must run to close a quiet page.
+func WithMaxPageAge(maxAge time.Duration) Option {
+	return func(adp *AtomDataProcessor) error {
+		if maxAge <= 0 {
+			return fmt.Errorf("Maximum page age must be positive, got %s", maxAge)
+		}
+
+		adp.maxPageAge = maxAge
+		return nil
+	}
+}
+
+// WithMaxPageBytes closes the recent page once the summed payload size of its
+// events reaches maxBytes, in addition to closing it at the feed threshold. The
+// event reaching the budget is the last in the page, so a page can exceed the
+// budget by at most one event.
+func WithMaxPageBytes(maxBytes int64) Option {
+	return func(adp *AtomDataProcessor) error {
+		if maxBytes <= 0 {
+			return fmt.Errorf("Maximum page bytes must be positive, got %d", maxBytes)
+		}
+
+		adp.maxPageBytes = maxBytes
+		return nil
+	}
+}
+
+// WithRolloverPolicy sets the policy deciding when the recent page is closed,
+// replacing the feed threshold and any page age or byte budget.
+func WithRolloverPolicy(policy RolloverPolicy) Option {
+	return func(adp *AtomDataProcessor) error {
+		if policy == nil {
+			return errors.New("Nil rollover policy")
+		}
+
+		adp.policy = policy
+		return nil
+	}
+}
+
+// WithFeedRoutes writes the events matching routes to named feeds. Routes are
+// tried in order and the first match wins; events matching no route are written
+// to DefaultFeed. Each feed is rolled over independently.
+func WithFeedRoutes(routes ...FeedRoute) Option {
+	return func(adp *AtomDataProcessor) error {
+		for i := range routes {
+			if err := routes[i].validate(); err != nil {
+				return err
+			}
+		}
+
+		adp.routes = append([]FeedRoute(nil), routes...)
+		return nil
+	}
+}
+
+// WithTenantResolver sets how the tenant of each event is determined. The default
+// is ContextTenant.
+func WithTenantResolver(resolver TenantResolver) Option {
+	return func(adp *AtomDataProcessor) error {
+		if resolver == nil {
+			return errors.New("Nil tenant resolver")
+		}
+
+		adp.tenantResolver = resolver
+		return nil
+	}
+}
+
+// WithTransientRetries sets the number of times a write failing with a transient
+// error is retried; zero disables retries.
+func WithTransientRetries(retries int) Option {
+	return func(adp *AtomDataProcessor) error {
+		if retries < 0 {
+			return fmt.Errorf("Transient retries must not be negative, got %d", retries)
+		}
+
+		adp.transientRetries = retries
+		return nil
+	}
+}
+
+// WithIDGenerator sets the function generating the ids of new feeds. The default
+// generates random UUIDs.
+func WithIDGenerator(newID IDGenerator) Option {
+	return func(adp *AtomDataProcessor) error {
+		if newID == nil {
+			return errors.New("Nil id generator")
+		}
+
+		adp.newID = newID
+		return nil
+	}
+}
+
+// WithClock sets the function the processor reads the current time from. The
+// default is time.Now.
+func WithClock(now func() time.Time) Option {
+	return func(adp *AtomDataProcessor) error {
+		if now == nil {
+			return errors.New("Nil clock")
+		}
+
+		adp.now = now
+		return nil
+	}
+}
+
+// WithLogger sets the Logger the processor logs to.
+func WithLogger(logger Logger) Option {
+	return func(adp *AtomDataProcessor) error {
+		if logger == nil {
+			return errors.New("Nil logger")
+		}
+
+		adp.logger = logger
+		return nil
+	}
+}
+
+// WithLogPayloads includes event payloads in debug logging when enabled.
+func WithLogPayloads(enabled bool) Option {
+	return func(adp *AtomDataProcessor) error {
+		adp.logPayloads = enabled
+		return nil
+	}
+}
+
+// WithMetrics sets the Metrics implementation the processor reports to.
+func WithMetrics(metrics Metrics) Option {
+	return func(adp *AtomDataProcessor) error {
+		if metrics == nil {
+			return errors.New("Nil metrics")
+		}
+
+		adp.metrics = metrics
+		return nil
+	}
+}
+
+// WithSchema writes to the t_aeae_atom_event and t_aefd_feed tables in schema
+// rather than those on the connection's search path, allowing several feeds to
+// share a database. Each schema's feed is locked independently.
+func WithSchema(schema string) Option {
+	return func(adp *AtomDataProcessor) error {
+		if !schemaName.MatchString(schema) {
+			return fmt.Errorf("Invalid schema name %q", schema)
+		}
+
+		adp.schema = schema
+		adp.lockKey = schemaLockKey(schema)
+		return nil
+	}
+}
+
+// schemaLockKey derives the feed lock key for the tables in schema
+func schemaLockKey(schema string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(schema))
+	return feedLockKey ^ int64(h.Sum64())
+}
@@ -0,0 +1,107 @@
+package esatomdatapg
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func TestNewDefaults(t *testing.T) {
+	processor, err := New(nil)
+	if assert.Nil(t, err) {
+		assert.Equal(t, defaultFeedThreshold, processor.feedThreshold)
+		assert.Equal(t, defaultTransientRetries, processor.transientRetries)
+		assert.Equal(t, feedLockKey, processor.lockKey)
+		assert.Equal(t, "", processor.schema)
+		assert.False(t, processor.logPayloads)
+	}
+}
+
+func TestNewOptions(t *testing.T) {
+	now := time.Date(2017, 5, 22, 9, 0, 0, 0, time.UTC)
+	logger := &recordingLogger{}
+
+	processor, err := New(nil,
+		WithFeedThreshold(10),
+		WithTransientRetries(0),
+		WithClock(func() time.Time { return now }),
+		WithLogger(logger),
+		WithLogPayloads(true),
+		WithSchema("unit_a"),
+	)
+	if assert.Nil(t, err) {
+		assert.Equal(t, 10, processor.feedThreshold)
+		assert.Equal(t, 0, processor.transientRetries)
+		assert.Equal(t, now, processor.now())
+		assert.Equal(t, logger, processor.logger)
+		assert.True(t, processor.logPayloads)
+		assert.Equal(t, "unit_a", processor.schema)
+		assert.NotEqual(t, feedLockKey, processor.lockKey)
+	}
+}
+
+func TestNewRejectsInvalidOptions(t *testing.T) {
+	for name, opt := range map[string]Option{
+		"zero threshold":      WithFeedThreshold(0),
+		"negative threshold":  WithFeedThreshold(-1),
+		"negative retries":    WithTransientRetries(-1),
+		"zero page age":       WithMaxPageAge(0),
+		"zero page bytes":     WithMaxPageBytes(0),
+		"nil id generator":    WithIDGenerator(nil),
+		"nil clock":           WithClock(nil),
+		"nil logger":          WithLogger(nil),
+		"nil metrics":         WithMetrics(nil),
+		"nil policy":          WithRolloverPolicy(nil),
+		"nil tenant resolver": WithTenantResolver(nil),
+		"invalid feed name":   WithFeedRoutes(FeedRoute{Feed: "a/b", Typecodes: []string{"foo"}}),
+		"route matching none": WithFeedRoutes(FeedRoute{Feed: "customers"}),
+		"nil env":             WithEnv(nil),
+		"empty schema":        WithSchema(""),
+		"schema injection":    WithSchema("a; drop table t_aefd_feed"),
+	} {
+		processor, err := New(nil, opt)
+		assert.NotNil(t, err, name)
+		assert.Nil(t, processor, name)
+	}
+}
+
+func TestSchemaLockKeys(t *testing.T) {
+	assert.Equal(t, schemaLockKey("unit_a"), schemaLockKey("unit_a"))
+	assert.NotEqual(t, schemaLockKey("unit_a"), schemaLockKey("unit_b"))
+}
+
+func TestWithSchemaAndIDGenerator(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	processor, err := New(db,
+		WithSchema("unit_a"),
+		WithFeedThreshold(1),
+		WithIDGenerator(func() (string, error) { return "feed-1", nil }),
+	)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`set local search_path to "unit_a"`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`select pg_advisory_xact_lock`).WithArgs(schemaLockKey("unit_a")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("select feedid from t_aefd_feed").WillReturnRows(sqlmock.NewRows([]string{"feedid"}).AddRow("XXX"))
+	mock.ExpectExec("insert into t_aeae_atom_event").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(`select count`).WillReturnRows(sqlmock.NewRows([]string{"count(*)"}).AddRow(1))
+	mock.ExpectExec("update t_aeae_atom_event set feedid").
+		WithArgs(sql.NullString{String: "feed-1", Valid: true}, DefaultTenant, DefaultFeed).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("insert into t_aefd_feed").
+		WithArgs(sql.NullString{String: "feed-1", Valid: true}, sql.NullString{String: "XXX", Valid: true}, DefaultFeed, DefaultTenant).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	assert.Nil(t, processor.ProcessMessage(batchMessage("agg1")))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,147 @@
+package esatomdatapg
+
+import (
+	"time"
+
+	"github.com/xtracdev/goes"
+)
+
+// PageStat identifies a statistic of the recent page used by a RolloverPolicy
+type PageStat int
+
+const (
+	//StatCount is the number of events in the page; it is always gathered
+	StatCount PageStat = 1 << iota
+
+	//StatBytes is the summed payload size of the events in the page
+	StatBytes
+
+	//StatOldest is the time the first event in the page was written, which is
+	//when the page opened. It is not the event time, so events published long
+	//before they are processed, such as a backlog or a replay, do not age the
+	//page. Policies requiring it can close a page without any new events being
+	//written, so the page should also be checked periodically with RunRollover.
+	StatOldest
+
+	//StatTypecodes is the number of events of each typecode in the page
+	StatTypecodes
+)
+
+// PageStats describes the recent page. Statistics the rollover policy does not
+// require are not gathered, and may be incomplete.
+type PageStats struct {
+	Count     int
+	Bytes     int64
+	Oldest    time.Time
+	Typecodes map[string]int
+}
+
+// add includes an event written to the page at written in the stats
+func (ps *PageStats) add(event *goes.Event, written time.Time) {
+	ps.Count++
+	ps.Bytes += payloadSize(event)
+
+	//Write times are stored in UTC without a time zone, so compare them the same way
+	if ps.Oldest.IsZero() {
+		ps.Oldest = written.UTC()
+	}
+
+	if ps.Typecodes == nil {
+		ps.Typecodes = make(map[string]int)
+	}
+	ps.Typecodes[event.TypeCode]++
+}
+
+// RolloverPolicy decides when the recent page is closed and assigned to a new
+// feed. The processor consults it after each event written to the page, and from
+// RunRollover. Implementations must be safe for concurrent use.
+type RolloverPolicy interface {
+	//Requires returns the statistics the policy uses
+	Requires() PageStat
+
+	//ShouldClose reports whether the page should be closed. The page is never
+	//empty.
+	ShouldClose(page PageStats, now time.Time) bool
+}
+
+// CountPolicy closes the page once it holds Threshold events. This is the
+// default policy, with the feed threshold.
+type CountPolicy struct {
+	Threshold int
+}
+
+func (p CountPolicy) Requires() PageStat {
+	return StatCount
+}
+
+// ShouldClose checks for >= rather than == so a page that somehow went past the
+// threshold (e.g. threshold lowered between runs) still gets closed.
+func (p CountPolicy) ShouldClose(page PageStats, now time.Time) bool {
+	return page.Count >= p.Threshold
+}
+
+// SizePolicy closes the page once the summed payload size of its events reaches
+// MaxBytes. The event reaching the budget is the last in the page, so a page can
+// exceed the budget by at most one event.
+type SizePolicy struct {
+	MaxBytes int64
+}
+
+func (p SizePolicy) Requires() PageStat {
+	return StatBytes
+}
+
+func (p SizePolicy) ShouldClose(page PageStats, now time.Time) bool {
+	return page.Bytes >= p.MaxBytes
+}
+
+// AgePolicy closes the page once it has been open for MaxAge, measured from when
+// its first event was written
+type AgePolicy struct {
+	MaxAge time.Duration
+}
+
+func (p AgePolicy) Requires() PageStat {
+	return StatOldest
+}
+
+func (p AgePolicy) ShouldClose(page PageStats, now time.Time) bool {
+	return !page.Oldest.IsZero() && now.UTC().Sub(page.Oldest) >= p.MaxAge
+}
+
+// AnyPolicy closes the page when any of its policies would
+type AnyPolicy []RolloverPolicy
+
+func (p AnyPolicy) Requires() PageStat {
+	requires := StatCount
+	for _, policy := range p {
+		requires |= policy.Requires()
+	}
+	return requires
+}
+
+func (p AnyPolicy) ShouldClose(page PageStats, now time.Time) bool {
+	for _, policy := range p {
+		if policy.ShouldClose(page, now) {
+			return true
+		}
+	}
+	return false
+}
+
+// rolloverPolicy returns the policy set with WithRolloverPolicy, or one combining
+// the feed threshold with the page age and byte budget, if set.
+func (adp *AtomDataProcessor) rolloverPolicy() RolloverPolicy {
+	if adp.policy != nil {
+		return adp.policy
+	}
+
+	policy := AnyPolicy{CountPolicy{Threshold: adp.feedThreshold}}
+	if adp.maxPageBytes > 0 {
+		policy = append(policy, SizePolicy{MaxBytes: adp.maxPageBytes})
+	}
+	if adp.maxPageAge > 0 {
+		policy = append(policy, AgePolicy{MaxAge: adp.maxPageAge})
+	}
+	return policy
+}
@@ -0,0 +1,97 @@
+package esatomdatapg
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func TestBuiltInPolicies(t *testing.T) {
+	page := PageStats{Count: 3, Bytes: 100, Oldest: rolloverNow.Add(-10 * time.Minute)}
+
+	assert.True(t, CountPolicy{Threshold: 3}.ShouldClose(page, rolloverNow))
+	assert.False(t, CountPolicy{Threshold: 4}.ShouldClose(page, rolloverNow))
+
+	assert.True(t, SizePolicy{MaxBytes: 100}.ShouldClose(page, rolloverNow))
+	assert.False(t, SizePolicy{MaxBytes: 101}.ShouldClose(page, rolloverNow))
+
+	assert.True(t, AgePolicy{MaxAge: 10 * time.Minute}.ShouldClose(page, rolloverNow))
+	assert.False(t, AgePolicy{MaxAge: 11 * time.Minute}.ShouldClose(page, rolloverNow))
+	assert.False(t, AgePolicy{MaxAge: time.Minute}.ShouldClose(PageStats{Count: 1}, rolloverNow))
+
+	any := AnyPolicy{CountPolicy{Threshold: 10}, SizePolicy{MaxBytes: 100}}
+	assert.True(t, any.ShouldClose(page, rolloverNow))
+	assert.False(t, AnyPolicy{CountPolicy{Threshold: 10}}.ShouldClose(page, rolloverNow))
+	assert.Equal(t, StatCount|StatBytes, any.Requires())
+	assert.Equal(t, StatCount, AnyPolicy{}.Requires())
+}
+
+func TestDefaultRolloverPolicy(t *testing.T) {
+	processor, _ := New(nil, WithFeedThreshold(5))
+	assert.Equal(t, AnyPolicy{CountPolicy{Threshold: 5}}, processor.rolloverPolicy())
+
+	processor, _ = New(nil, WithMaxPageBytes(1024), WithMaxPageAge(time.Minute))
+	assert.Equal(t, AnyPolicy{CountPolicy{Threshold: 100}, SizePolicy{MaxBytes: 1024}, AgePolicy{MaxAge: time.Minute}},
+		processor.rolloverPolicy())
+
+	custom := CountPolicy{Threshold: 2}
+	processor, _ = New(nil, WithMaxPageBytes(1024), WithRolloverPolicy(custom))
+	assert.Equal(t, custom, processor.rolloverPolicy())
+}
+
+// typecodePolicy closes the page once it holds max events with typecode
+type typecodePolicy struct {
+	typecode string
+	max      int
+}
+
+func (p typecodePolicy) Requires() PageStat {
+	return StatTypecodes
+}
+
+func (p typecodePolicy) ShouldClose(page PageStats, now time.Time) bool {
+	return page.Typecodes[p.typecode] >= p.max
+}
+
+func expectRecentPageTypecodes(mock sqlmock.Sqlmock, rows *sqlmock.Rows) {
+	mock.ExpectQuery(`select typecode, count\(\*\) from t_aeae_atom_event`).WillReturnRows(rows)
+}
+
+func TestProcessMessageCustomPolicy(t *testing.T) {
+	processor, mock, done := newTestProcessor(t, WithRolloverPolicy(typecodePolicy{"foo", 2}))
+	defer done()
+
+	testBeginSetup(mock, &trueVal)
+	testFeedLockSetup(mock, &trueVal)
+	testFeedIdSelectSetup(mock, &trueVal)
+	mock.ExpectExec("insert into t_aeae_atom_event").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(`select count`).WillReturnRows(sqlmock.NewRows([]string{"count(*)"}).AddRow(3))
+	expectRecentPageTypecodes(mock, sqlmock.NewRows([]string{"typecode", "count"}).AddRow("bar", 1).AddRow("foo", 2))
+	testThresholdAtomEventUpdateSetup(mock, &trueVal)
+	testFeedInsertOk(mock, &trueVal)
+	mock.ExpectCommit()
+
+	assert.Nil(t, processor.ProcessMessage(batchMessage("agg1")))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestProcessMessagesCustomPolicy(t *testing.T) {
+	processor, mock, done := newTestProcessor(t, WithRolloverPolicy(typecodePolicy{"foo", 2}))
+	defer done()
+
+	expectBatchStart(mock, 1)
+	expectRecentPageTypecodes(mock, sqlmock.NewRows([]string{"typecode", "count"}).AddRow("bar", 1))
+	expectBatchInsert(mock, "agg1", nil)
+	expectBatchInsert(mock, "agg2", nil)
+	expectBatchRollover(mock, "XXX")
+	expectBatchInsert(mock, "agg3", nil)
+	mock.ExpectCommit()
+
+	results := processor.ProcessMessages([]string{batchMessage("agg1"), batchMessage("agg2"), batchMessage("agg3")})
+	for _, r := range results {
+		assert.Nil(t, r.Err)
+	}
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,324 @@
+package esatomdatapg
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/xtracdev/envinject"
+	"github.com/xtracdev/goes"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	sqlRecentPageAge   = `select count(*), min(write_time) from t_aeae_atom_event where tenant = $1 and feed_name = $2 and feedid is null`
+	sqlRecentPageBytes = `select coalesce(sum(octet_length(payload)), 0) from t_aeae_atom_event where tenant = $1 and feed_name = $2 and feedid is null`
+
+	sqlRecentPageTypecodes = `select typecode, count(*) from t_aeae_atom_event where tenant = $1 and feed_name = $2 and feedid is null group by typecode`
+
+	//The feeds of all tenants with a non-empty recent page
+	sqlRecentPages = `select distinct tenant, feed_name from t_aeae_atom_event where feedid is null order by tenant, feed_name`
+
+	//Payload byte budget of a page. The page is closed once the summed payload
+	//size of its events reaches this. Not limited if not set.
+	EnvFeedMaxPageBytes = "FEED_MAX_PAGE_BYTES"
+
+	//Maximum age of the recent page, as a duration such as 15m. The page is not
+	//closed based on age if this is not set.
+	EnvFeedMaxPageAge = "FEED_MAX_PAGE_AGE"
+)
+
+// getRecentPage gathers the statistics of the recent page of feed that the policy
+// requires. The count is always gathered.
+func (adp *AtomDataProcessor) getRecentPage(ctx context.Context, tx *sql.Tx, feed feedRef, requires PageStat) (PageStats, error) {
+	var page PageStats
+	var err error
+
+	if requires&StatOldest != 0 {
+		page.Count, page.Oldest, err = adp.getRecentPageAge(ctx, tx, feed)
+	} else {
+		page.Count, err = adp.getRecentFeedCount(ctx, tx, feed)
+	}
+	if err != nil {
+		return page, err
+	}
+
+	if requires&StatBytes != 0 {
+		page.Bytes, err = adp.getRecentPageBytes(ctx, tx, feed)
+		if err != nil {
+			return page, err
+		}
+	}
+
+	if requires&StatTypecodes != 0 {
+		page.Typecodes, err = adp.getRecentPageTypecodes(ctx, tx, feed)
+	}
+
+	return page, err
+}
+
+// getRecentPageAge returns the number of events in the recent page and the time
+// the first of them was written, zero if the page is empty
+func (adp *AtomDataProcessor) getRecentPageAge(ctx context.Context, tx *sql.Tx, feed feedRef) (int, time.Time, error) {
+	ctx, span := tracer.Start(ctx, "getRecentPageAge")
+
+	var count int
+	var oldest sql.NullTime
+	err := tx.QueryRowContext(ctx, sqlRecentPageAge, feed.tenant, feed.name).Scan(&count, &oldest)
+
+	span.SetAttributes(attribute.Int("feed.recent_count", count))
+	endSpan(span, err)
+	return count, oldest.Time, err
+}
+
+// getRecentPageBytes returns the summed payload size of the recent page
+func (adp *AtomDataProcessor) getRecentPageBytes(ctx context.Context, tx *sql.Tx, feed feedRef) (int64, error) {
+	ctx, span := tracer.Start(ctx, "getRecentPageBytes")
+
+	var bytes int64
+	err := tx.QueryRowContext(ctx, sqlRecentPageBytes, feed.tenant, feed.name).Scan(&bytes)
+
+	span.SetAttributes(attribute.Int64("feed.recent_bytes", bytes))
+	endSpan(span, err)
+	return bytes, err
+}
+
+// getRecentPageTypecodes returns the number of events of each typecode in the
+// recent page
+func (adp *AtomDataProcessor) getRecentPageTypecodes(ctx context.Context, tx *sql.Tx, feed feedRef) (typecodes map[string]int, err error) {
+	ctx, span := tracer.Start(ctx, "getRecentPageTypecodes")
+	defer func() { endSpan(span, err) }()
+
+	rows, err := tx.QueryContext(ctx, sqlRecentPageTypecodes, feed.tenant, feed.name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	typecodes = make(map[string]int)
+	for rows.Next() {
+		var typecode string
+		var count int
+		if err = rows.Scan(&typecode, &count); err != nil {
+			return nil, err
+		}
+		typecodes[typecode] = count
+	}
+
+	return typecodes, rows.Err()
+}
+
+// closePage reports whether the rollover policy closes the page, logging why
+func (adp *AtomDataProcessor) closePage(policy RolloverPolicy, page PageStats) bool {
+	if page.Count == 0 || !policy.ShouldClose(page, adp.now()) {
+		return false
+	}
+
+	adp.logger.Info("Rollover policy closed the recent page",
+		Fields{"count": page.Count, "bytes": page.Bytes, "oldest": page.Oldest})
+	return true
+}
+
+// payloadSize is the stored size of the event payload
+func payloadSize(event *goes.Event) int64 {
+	payload, _ := event.Payload.([]byte)
+	return int64(len(payload))
+}
+
+// CloseExpiredPage assigns the recent page of each feed of each tenant to a new
+// feed page if the rollover policy closes it at the current time, even though no
+// new events have been written. This makes the recent events of a quiet stream
+// available as a cacheable archive without waiting for the feed threshold. It
+// returns whether any page was closed, and does nothing if the policy does not
+// depend on the age of the page. Every feed is checked even if closing one fails;
+// the first error is returned.
+func (adp *AtomDataProcessor) CloseExpiredPage(ctx context.Context) (bool, error) {
+	policy := adp.rolloverPolicy()
+	if policy.Requires()&StatOldest == 0 {
+		return false, nil
+	}
+
+	var feeds []feedRef
+	err := adp.retryTransient(ctx, func() error {
+		var err error
+		feeds, err = adp.recentPages(ctx)
+		return classifyDBError(err)
+	})
+	if err != nil {
+		return false, err
+	}
+
+	var anyClosed bool
+	var firstErr error
+	for _, feed := range feeds {
+		var closed bool
+		err := adp.retryTransient(ctx, func() error {
+			var err error
+			closed, err = adp.closeExpiredPage(ctx, feed, policy)
+			return classifyDBError(err)
+		})
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		anyClosed = anyClosed || closed
+	}
+	return anyClosed, firstErr
+}
+
+// recentPages returns the feeds with a non-empty recent page
+func (adp *AtomDataProcessor) recentPages(ctx context.Context) ([]feedRef, error) {
+	//No feed is locked as nothing is written
+	tx, err := adp.beginFeedTx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer adp.doRollback(tx)
+
+	rows, err := tx.QueryContext(ctx, sqlRecentPages)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var feeds []feedRef
+	for rows.Next() {
+		var feed feedRef
+		if err = rows.Scan(&feed.tenant, &feed.name); err != nil {
+			return nil, err
+		}
+		feeds = append(feeds, feed)
+	}
+
+	return feeds, rows.Err()
+}
+
+func (adp *AtomDataProcessor) closeExpiredPage(ctx context.Context, feed feedRef, policy RolloverPolicy) (closed bool, err error) {
+	ctx, span := tracer.Start(ctx, "closeExpiredPage",
+		trace.WithAttributes(attribute.String("tenant", feed.tenant), attribute.String("feed.name", feed.name)))
+	defer func() {
+		span.SetAttributes(attribute.Bool("feed.closed", closed))
+		endSpan(span, err)
+	}()
+
+	tx, err := adp.beginFeedTx(ctx, feed)
+	if err != nil {
+		return false, err
+	}
+
+	page, err := adp.getRecentPage(ctx, tx, feed, policy.Requires())
+	if err != nil {
+		adp.doRollback(tx)
+		return false, err
+	}
+
+	if !adp.closePage(policy, page) {
+		adp.doRollback(tx)
+		return false, nil
+	}
+
+	feedid, err := selectLatestFeed(ctx, tx, feed)
+	if err != nil {
+		adp.doRollback(tx)
+		return false, err
+	}
+
+	_, err = adp.createNewFeed(ctx, tx, feed, feedid)
+	if err != nil {
+		adp.doRollback(tx)
+		return false, wrapError(ErrRollover, classifyDBError(err))
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return false, err
+	}
+
+	adp.metrics.FeedRolledOver()
+	adp.metrics.RecentPageSize(feed.tenant, feed.name, 0)
+	return true, nil
+}
+
+// RunRollover calls CloseExpiredPage every interval until ctx is done. Errors are
+// logged and the page checked again at the next interval. Any number of processor
+// instances may run it; only one closes a given page.
+func (adp *AtomDataProcessor) RunRollover(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := adp.CloseExpiredPage(ctx); err != nil && ctx.Err() == nil {
+				adp.logger.Warn("Unable to close expired recent page", errorFields(Fields{}, err))
+			}
+		}
+	}
+}
+
+// ClosesByAge reports whether the rollover policy depends on the age of the recent
+// page, in which case RunRollover must run for a quiet page to be closed.
+func (adp *AtomDataProcessor) ClosesByAge() bool {
+	return adp.rolloverPolicy().Requires()&StatOldest != 0
+}
+
+// MaxPageAge returns the shortest MaxAge of the AgePolicy in the rollover policy,
+// including one combined with AnyPolicy, zero if there is none. A custom policy
+// can close pages by age without an AgePolicy; see ClosesByAge.
+func (adp *AtomDataProcessor) MaxPageAge() time.Duration {
+	return policyMaxAge(adp.rolloverPolicy())
+}
+
+func policyMaxAge(policy RolloverPolicy) time.Duration {
+	switch p := policy.(type) {
+	case AgePolicy:
+		return p.MaxAge
+	case AnyPolicy:
+		var maxAge time.Duration
+		for _, policy := range p {
+			if age := policyMaxAge(policy); age > 0 && (maxAge == 0 || age < maxAge) {
+				maxAge = age
+			}
+		}
+		return maxAge
+	}
+	return 0
+}
+
+func readMaxPageBytesFromEnv(env *envinject.InjectedEnv) (int64, error) {
+	value := env.Getenv(EnvFeedMaxPageBytes)
+	if value == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be an integer, got %q", EnvFeedMaxPageBytes, value)
+	}
+	if n <= 0 {
+		return 0, fmt.Errorf("%s must be positive, got %d", EnvFeedMaxPageBytes, n)
+	}
+
+	return n, nil
+}
+
+func readMaxPageAgeFromEnv(env *envinject.InjectedEnv) (time.Duration, error) {
+	value := env.Getenv(EnvFeedMaxPageAge)
+	if value == "" {
+		return 0, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be a duration, got %q", EnvFeedMaxPageAge, value)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("%s must be positive, got %s", EnvFeedMaxPageAge, d)
+	}
+
+	return d, nil
+}
@@ -0,0 +1,283 @@
+package esatomdatapg
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xtracdev/pgpublish"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+var rolloverNow = time.Date(2017, 5, 22, 9, 0, 0, 0, time.UTC)
+
+type countingMetrics struct {
+	nopMetrics
+	rollovers int
+}
+
+func (m *countingMetrics) FeedRolledOver() { m.rollovers++ }
+
+// newRolloverTestProcessor returns a test processor closing pages older than 15
+// minutes, with the clock stopped at rolloverNow
+func newRolloverTestProcessor(t *testing.T, opts ...Option) (*AtomDataProcessor, sqlmock.Sqlmock, func()) {
+	return newTestProcessor(t, append([]Option{
+		WithMaxPageAge(15 * time.Minute),
+		WithClock(func() time.Time { return rolloverNow }),
+	}, opts...)...)
+}
+
+// expectRecentPages expects the discovery of the feeds with a recent page
+func expectRecentPages(mock sqlmock.Sqlmock, feeds ...feedRef) {
+	rows := sqlmock.NewRows([]string{"tenant", "feed_name"})
+	for _, feed := range feeds {
+		rows.AddRow(feed.tenant, feed.name)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`select distinct tenant, feed_name from t_aeae_atom_event`).WillReturnRows(rows)
+	mock.ExpectRollback()
+}
+
+func expectRecentPageAge(mock sqlmock.Sqlmock, count int, oldest interface{}) {
+	mock.ExpectBegin()
+	mock.ExpectExec(`select pg_advisory_xact_lock`).WithArgs(feedLockKey).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`select count\(\*\), min\(write_time\)`).
+		WillReturnRows(sqlmock.NewRows([]string{"count", "min"}).AddRow(count, oldest))
+}
+
+func TestCloseExpiredPageDisabled(t *testing.T) {
+	processor, mock, done := newTestProcessor(t)
+	defer done()
+
+	closed, err := processor.CloseExpiredPage(context.Background())
+	assert.Nil(t, err)
+	assert.False(t, closed)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestCloseExpiredPageNotDue(t *testing.T) {
+	processor, mock, done := newRolloverTestProcessor(t)
+	defer done()
+
+	expectRecentPages(mock, defaultFeedRef)
+	expectRecentPageAge(mock, 3, rolloverNow.Add(-14*time.Minute))
+	mock.ExpectRollback()
+
+	closed, err := processor.CloseExpiredPage(context.Background())
+	assert.Nil(t, err)
+	assert.False(t, closed)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestCloseExpiredPageEmpty(t *testing.T) {
+	processor, mock, done := newRolloverTestProcessor(t)
+	defer done()
+
+	//No feed has a recent page to inspect
+	expectRecentPages(mock)
+
+	closed, err := processor.CloseExpiredPage(context.Background())
+	assert.Nil(t, err)
+	assert.False(t, closed)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func expectExpiredPageClosed(mock sqlmock.Sqlmock) {
+	expectRecentPages(mock, defaultFeedRef)
+	expectRecentPageAge(mock, 3, rolloverNow.Add(-15*time.Minute))
+	mock.ExpectQuery("select feedid from t_aefd_feed").WillReturnRows(sqlmock.NewRows([]string{"feedid"}).AddRow("XXX"))
+	testThresholdAtomEventUpdateSetup(mock, &trueVal)
+	testFeedInsertOk(mock, &trueVal)
+	mock.ExpectCommit()
+}
+
+func TestCloseExpiredPage(t *testing.T) {
+	metrics := &countingMetrics{}
+	processor, mock, done := newRolloverTestProcessor(t, WithMetrics(metrics))
+	defer done()
+
+	expectExpiredPageClosed(mock)
+
+	closed, err := processor.CloseExpiredPage(context.Background())
+	assert.Nil(t, err)
+	assert.True(t, closed)
+	assert.Equal(t, 1, metrics.rollovers)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestCloseExpiredPageRolloverError(t *testing.T) {
+	processor, mock, done := newRolloverTestProcessor(t)
+	defer done()
+
+	expectRecentPages(mock, defaultFeedRef)
+	expectRecentPageAge(mock, 3, rolloverNow.Add(-time.Hour))
+	mock.ExpectQuery("select feedid from t_aefd_feed").WillReturnRows(sqlmock.NewRows([]string{"feedid"}).AddRow("XXX"))
+	testThresholdAtomEventUpdateSetup(mock, &falseVal)
+	mock.ExpectRollback()
+
+	closed, err := processor.CloseExpiredPage(context.Background())
+	assert.False(t, closed)
+	assert.True(t, errors.Is(err, ErrRollover))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+// signalMetrics signals each rollover
+type signalMetrics struct {
+	nopMetrics
+	rolledOver chan struct{}
+}
+
+func (m *signalMetrics) FeedRolledOver() { m.rolledOver <- struct{}{} }
+
+func TestRunRollover(t *testing.T) {
+	metrics := &signalMetrics{rolledOver: make(chan struct{}, 1)}
+	processor, mock, done := newRolloverTestProcessor(t, WithMetrics(metrics))
+	defer done()
+
+	expectExpiredPageClosed(mock)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		processor.RunRollover(ctx, time.Millisecond)
+		close(stopped)
+	}()
+
+	select {
+	case <-metrics.rolledOver:
+	case <-time.After(5 * time.Second):
+		t.Error("Expired page was not closed")
+	}
+	cancel()
+	<-stopped
+
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func expectRecentPageBytes(mock sqlmock.Sqlmock, bytes int64) {
+	mock.ExpectQuery(`select coalesce\(sum\(octet_length\(payload\)\), 0\)`).
+		WillReturnRows(sqlmock.NewRows([]string{"bytes"}).AddRow(bytes))
+}
+
+func TestProcessMessagesClosesPageAtByteBudget(t *testing.T) {
+	//Each payload is 2 bytes
+	processor, mock, done := newTestProcessor(t, WithMaxPageBytes(5))
+	defer done()
+
+	expectBatchStart(mock, 1)
+	expectRecentPageBytes(mock, 2)
+	expectBatchInsert(mock, "agg1", nil)
+	expectBatchInsert(mock, "agg2", nil)
+	expectBatchRollover(mock, "XXX")
+	expectBatchInsert(mock, "agg3", nil)
+	mock.ExpectCommit()
+
+	results := processor.ProcessMessages([]string{batchMessage("agg1"), batchMessage("agg2"), batchMessage("agg3")})
+	for _, r := range results {
+		assert.Nil(t, r.Err)
+	}
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestProcessMessageClosesPageAtByteBudget(t *testing.T) {
+	processor, mock, done := newTestProcessor(t, WithMaxPageBytes(1024))
+	defer done()
+
+	testBeginSetup(mock, &trueVal)
+	testFeedLockSetup(mock, &trueVal)
+	testFeedIdSelectSetup(mock, &trueVal)
+	mock.ExpectExec("insert into t_aeae_atom_event").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(`select count`).WillReturnRows(sqlmock.NewRows([]string{"count(*)"}).AddRow(3))
+	expectRecentPageBytes(mock, 1024)
+	testThresholdAtomEventUpdateSetup(mock, &trueVal)
+	testFeedInsertOk(mock, &trueVal)
+	mock.ExpectCommit()
+
+	assert.Nil(t, processor.ProcessMessage(batchMessage("agg1")))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestProcessMessageUnderByteBudget(t *testing.T) {
+	processor, mock, done := newTestProcessor(t, WithMaxPageBytes(1024))
+	defer done()
+
+	testBeginSetup(mock, &trueVal)
+	testFeedLockSetup(mock, &trueVal)
+	testFeedIdSelectSetup(mock, &trueVal)
+	mock.ExpectExec("insert into t_aeae_atom_event").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(`select count`).WillReturnRows(sqlmock.NewRows([]string{"count(*)"}).AddRow(3))
+	expectRecentPageBytes(mock, 1023)
+	mock.ExpectCommit()
+
+	assert.Nil(t, processor.ProcessMessage(batchMessage("agg1")))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestProcessMessagesStaleEventDoesNotClosePage(t *testing.T) {
+	processor, mock, done := newRolloverTestProcessor(t)
+	defer done()
+
+	//The event was published long before the maximum page age, but the page only
+	//opens when it is written
+	published := rolloverNow.Add(-time.Hour)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`select pg_advisory_xact_lock`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("select feedid from t_aefd_feed").WillReturnRows(sqlmock.NewRows([]string{"feedid"}).AddRow("XXX"))
+	mock.ExpectQuery(`select count\(\*\), min\(write_time\)`).
+		WillReturnRows(sqlmock.NewRows([]string{"count", "min"}).AddRow(0, nil))
+	mock.ExpectExec("savepoint batch_event").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("insert into t_aeae_atom_event").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("release savepoint batch_event").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	msg := pgpublish.EncodePGEvent("agg1", 1, []byte("ok"), "foo", published)
+	results := processor.ProcessMessages([]string{msg})
+	assert.Nil(t, results[0].Err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestProcessMessageStaleEventDoesNotClosePage(t *testing.T) {
+	processor, mock, done := newRolloverTestProcessor(t)
+	defer done()
+
+	published := rolloverNow.Add(-time.Hour)
+
+	testBeginSetup(mock, &trueVal)
+	testFeedLockSetup(mock, &trueVal)
+	testFeedIdSelectSetup(mock, &trueVal)
+	mock.ExpectExec("insert into t_aeae_atom_event").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(`select count\(\*\), min\(write_time\)`).
+		WillReturnRows(sqlmock.NewRows([]string{"count", "min"}).AddRow(1, rolloverNow))
+	mock.ExpectCommit()
+
+	msg := pgpublish.EncodePGEvent("agg1", 1, []byte("ok"), "foo", published)
+	assert.Nil(t, processor.ProcessMessage(msg))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestClosesByAge(t *testing.T) {
+	processor, _ := New(nil)
+	assert.False(t, processor.ClosesByAge())
+	assert.Equal(t, time.Duration(0), processor.MaxPageAge())
+
+	processor, _ = New(nil, WithMaxPageAge(15*time.Minute))
+	assert.True(t, processor.ClosesByAge())
+	assert.Equal(t, 15*time.Minute, processor.MaxPageAge())
+
+	//Without FEED_MAX_PAGE_AGE a policy can still close pages by age
+	processor, _ = New(nil, WithRolloverPolicy(AgePolicy{MaxAge: time.Hour}))
+	assert.True(t, processor.ClosesByAge())
+	assert.Equal(t, time.Hour, processor.MaxPageAge())
+
+	processor, _ = New(nil, WithRolloverPolicy(AnyPolicy{
+		CountPolicy{Threshold: 10},
+		AgePolicy{MaxAge: time.Hour},
+		AnyPolicy{AgePolicy{MaxAge: 5 * time.Minute}},
+	}))
+	assert.True(t, processor.ClosesByAge())
+	assert.Equal(t, 5*time.Minute, processor.MaxPageAge())
+}
@@ -0,0 +1,259 @@
+package esatomdatapg
+
+import (
+	"context"
+	"database/sql"
+)
+
+// Store provides context aware access to the atom feed data, allowing request
+// cancellation and deadlines to propagate to the database. The recent page and
+// last feed are those of one named feed; archived pages and events are found by
+// id whichever feed they belong to. All reads are of one tenant's data.
+type Store interface {
+	//Feed returns a Store for the named feed
+	Feed(name string) Store
+
+	//Tenant returns a Store for the feeds of the named tenant, reading with the
+	//tenant set for the row level security policies
+	Tenant(name string) Store
+
+	RetrieveRecent(ctx context.Context) ([]TimestampedEvent, error)
+	RetrieveArchive(ctx context.Context, feedid string) ([]TimestampedEvent, error)
+	RetrieveRecentPage(ctx context.Context, cursor int64, limit int) (EventPage, error)
+	RetrieveArchivePage(ctx context.Context, feedid string, cursor int64, limit int) (EventPage, error)
+	IterateRecent(ctx context.Context) (*EventIterator, error)
+	IterateArchive(ctx context.Context, feedid string) (*EventIterator, error)
+	RetrieveRecentMetadata(ctx context.Context) (FeedMetadata, error)
+	RetrieveArchiveMetadata(ctx context.Context, feedid string) (FeedMetadata, error)
+	RetrieveLastFeed(ctx context.Context) (string, error)
+	RetrievePreviousFeed(ctx context.Context, feedid string) (sql.NullString, error)
+	RetrieveNextFeed(ctx context.Context, feedid string) (sql.NullString, error)
+	RetrieveEvent(ctx context.Context, aggID string, version int) (TimestampedEvent, error)
+
+	//ReadSnapshot calls fn with a Store whose reads all see one snapshot of the
+	//data, so related reads such as the metadata of a page and its events agree.
+	//Stores returned by its Feed method share the snapshot.
+	ReadSnapshot(ctx context.Context, fn func(Store) error) error
+}
+
+// PGStore is the Postgres implementation of Store
+type PGStore struct {
+	db     *sql.DB
+	tenant string
+	feed   string
+
+	//scoped stores read in a transaction with app.tenant set, so reads are
+	//confined to the tenant by row level security as well as the queries
+	scoped bool
+
+	//snapshot, if set, is the transaction of ReadSnapshot that reads run in
+	snapshot *sql.Tx
+}
+
+// NewPGStore returns a Store reading the default feed of the default tenant from db.
+// It does not set app.tenant, so once the row level security policies of db/rls
+// are installed it reads no rows; use Tenant to scope it, even to DefaultTenant.
+func NewPGStore(db *sql.DB) *PGStore {
+	return &PGStore{db: db, tenant: DefaultTenant, feed: DefaultFeed}
+}
+
+func (s *PGStore) Feed(name string) Store {
+	return &PGStore{db: s.db, tenant: s.tenant, feed: name, scoped: s.scoped, snapshot: s.snapshot}
+}
+
+func (s *PGStore) Tenant(name string) Store {
+	return &PGStore{db: s.db, tenant: name, feed: s.feed, scoped: true}
+}
+
+// beginRead starts a read transaction at isolation, with the store's tenant set if
+// the store is scoped
+func (s *PGStore) beginRead(ctx context.Context, isolation sql.IsolationLevel) (*sql.Tx, error) {
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: isolation, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+
+	if !s.scoped {
+		return tx, nil
+	}
+
+	if _, err := tx.ExecContext(ctx, sqlSetTenant, s.tenant); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	return tx, nil
+}
+
+// read runs fn against the database: in the snapshot if there is one, otherwise
+// in a tenant read transaction if the store is scoped
+func (s *PGStore) read(ctx context.Context, fn func(q queryer) error) error {
+	if s.snapshot != nil {
+		return fn(s.snapshot)
+	}
+	if !s.scoped {
+		return fn(s.db)
+	}
+
+	tx, err := s.beginRead(ctx, sql.LevelDefault)
+	if err != nil {
+		return err
+	}
+
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// iterate opens an iterator with open, which for a scoped store keeps its read
+// transaction until the iterator is closed. In a snapshot the iterator must be
+// closed before ReadSnapshot returns.
+func (s *PGStore) iterate(ctx context.Context, open func(q queryer) (*EventIterator, error)) (*EventIterator, error) {
+	if s.snapshot != nil {
+		return open(s.snapshot)
+	}
+	if !s.scoped {
+		return open(s.db)
+	}
+
+	tx, err := s.beginRead(ctx, sql.LevelDefault)
+	if err != nil {
+		return nil, err
+	}
+
+	it, err := open(tx)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	it.tx = tx
+	return it, nil
+}
+
+func (s *PGStore) RetrieveRecent(ctx context.Context) ([]TimestampedEvent, error) {
+	var events []TimestampedEvent
+	err := s.read(ctx, func(q queryer) (err error) {
+		events, err = retrieveEvents(ctx, q, sqlSelectRecent, s.tenant, s.feed)
+		return
+	})
+	return events, err
+}
+
+func (s *PGStore) RetrieveArchive(ctx context.Context, feedid string) ([]TimestampedEvent, error) {
+	var events []TimestampedEvent
+	err := s.read(ctx, func(q queryer) (err error) {
+		events, err = retrieveEvents(ctx, q, sqlSelectForFeed, s.tenant, feedid)
+		return
+	})
+	return events, err
+}
+
+func (s *PGStore) RetrieveRecentPage(ctx context.Context, cursor int64, limit int) (EventPage, error) {
+	var page EventPage
+	err := s.read(ctx, func(q queryer) (err error) {
+		page, err = retrieveRecentPage(ctx, q, s.tenant, s.feed, cursor, limit)
+		return
+	})
+	return page, err
+}
+
+func (s *PGStore) RetrieveArchivePage(ctx context.Context, feedid string, cursor int64, limit int) (EventPage, error) {
+	var page EventPage
+	err := s.read(ctx, func(q queryer) (err error) {
+		page, err = retrieveArchivePage(ctx, q, s.tenant, feedid, cursor, limit)
+		return
+	})
+	return page, err
+}
+
+func (s *PGStore) IterateRecent(ctx context.Context) (*EventIterator, error) {
+	return s.iterate(ctx, func(q queryer) (*EventIterator, error) {
+		return iterateRecent(ctx, q, s.tenant, s.feed)
+	})
+}
+
+func (s *PGStore) IterateArchive(ctx context.Context, feedid string) (*EventIterator, error) {
+	return s.iterate(ctx, func(q queryer) (*EventIterator, error) {
+		return iterateArchive(ctx, q, s.tenant, feedid)
+	})
+}
+
+func (s *PGStore) RetrieveRecentMetadata(ctx context.Context) (FeedMetadata, error) {
+	var meta FeedMetadata
+	err := s.read(ctx, func(q queryer) (err error) {
+		meta, err = retrieveRecentMetadata(ctx, q, s.tenant, s.feed)
+		return
+	})
+	return meta, err
+}
+
+func (s *PGStore) RetrieveArchiveMetadata(ctx context.Context, feedid string) (FeedMetadata, error) {
+	var meta FeedMetadata
+	err := s.read(ctx, func(q queryer) (err error) {
+		meta, err = retrieveArchiveMetadata(ctx, q, s.tenant, feedid)
+		return
+	})
+	return meta, err
+}
+
+func (s *PGStore) RetrieveLastFeed(ctx context.Context) (string, error) {
+	var feedid string
+	err := s.read(ctx, func(q queryer) (err error) {
+		feedid, err = retrieveLastFeed(ctx, q, s.tenant, s.feed)
+		return
+	})
+	return feedid, err
+}
+
+func (s *PGStore) RetrievePreviousFeed(ctx context.Context, feedid string) (sql.NullString, error) {
+	var previous sql.NullString
+	err := s.read(ctx, func(q queryer) (err error) {
+		previous, err = retrievePreviousFeed(ctx, q, s.tenant, feedid)
+		return
+	})
+	return previous, err
+}
+
+func (s *PGStore) RetrieveNextFeed(ctx context.Context, feedid string) (sql.NullString, error) {
+	var next sql.NullString
+	err := s.read(ctx, func(q queryer) (err error) {
+		next, err = retrieveNextFeed(ctx, q, s.tenant, feedid)
+		return
+	})
+	return next, err
+}
+
+func (s *PGStore) RetrieveEvent(ctx context.Context, aggID string, version int) (TimestampedEvent, error) {
+	var event TimestampedEvent
+	err := s.read(ctx, func(q queryer) (err error) {
+		event, err = retrieveEvent(ctx, q, s.tenant, aggID, version)
+		return
+	})
+	return event, err
+}
+
+// ReadSnapshot runs fn in a read only repeatable read transaction, which sees the
+// data as it was when its first query ran.
+func (s *PGStore) ReadSnapshot(ctx context.Context, fn func(Store) error) error {
+	if s.snapshot != nil {
+		return fn(s)
+	}
+
+	tx, err := s.beginRead(ctx, sql.LevelRepeatableRead)
+	if err != nil {
+		return classifyDBError(err)
+	}
+
+	snapshot := *s
+	snapshot.snapshot = tx
+	if err := fn(&snapshot); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return classifyDBError(tx.Commit())
+}
@@ -0,0 +1,77 @@
+package esatomdatapg
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func TestPGStoreRetrieveRecent(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	ts := time.Now()
+	rows := sqlmock.NewRows([]string{"event_time", "aggregate_id",
+		"version", "typecode", "payload"},
+	).AddRow(ts, "1x2x333", 3, "foo", []byte("yeah ok"))
+	mock.ExpectQuery("select").WillReturnRows(rows)
+
+	var store Store = NewPGStore(db)
+	events, err := store.RetrieveRecent(context.Background())
+	if assert.Nil(t, err) {
+		assert.Nil(t, mock.ExpectationsWereMet())
+		assert.Equal(t, 1, len(events))
+	}
+}
+
+func TestPGStoreCancelledContext(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("select").WithArgs(DefaultTenant, "1x2x333", 3).WillDelayFor(time.Second).WillReturnRows(
+		sqlmock.NewRows([]string{"event_time", "typecode", "payload"}).AddRow(time.Now(), "foo", []byte("ok")),
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err = NewPGStore(db).RetrieveEvent(ctx, "1x2x333", 3)
+	assert.NotNil(t, err)
+}
+
+func TestPGStoreReadSnapshot(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	//Both reads run in the one transaction, with the tenant set once
+	mock.ExpectBegin()
+	mock.ExpectExec(`select set_config`).WithArgs("acme").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("select count").WithArgs("acme", "customers").WillReturnRows(
+		sqlmock.NewRows([]string{"count", "max_id", "last_modified", "previous"}).AddRow(1, 7, time.Now(), ""))
+	mock.ExpectQuery("select event_time").WithArgs("acme", "customers").WillReturnRows(
+		sqlmock.NewRows([]string{"event_time", "aggregate_id", "version", "typecode", "payload"}).
+			AddRow(time.Now(), "agg1", 1, "foo", []byte("ok")))
+	mock.ExpectCommit()
+
+	err = NewPGStore(db).Tenant("acme").Feed("customers").ReadSnapshot(context.Background(), func(store Store) error {
+		if _, err := store.RetrieveRecentMetadata(context.Background()); err != nil {
+			return err
+		}
+		_, err := store.RetrieveRecent(context.Background())
+		return err
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,95 @@
+package esatomdatapg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+
+	"github.com/xtracdev/envinject"
+	"github.com/xtracdev/goes"
+)
+
+const (
+	//DefaultTenant owns the events of messages that do not name a tenant
+	DefaultTenant = "default"
+
+	//Top level field of a JSON event payload naming the tenant the event belongs
+	//to. Payloads are not inspected if this is not set.
+	EnvTenantPayloadField = "TENANT_PAYLOAD_FIELD"
+
+	//Sets the tenant checked by the row level security policies for the rest of
+	//the transaction
+	sqlSetTenant = `select set_config('app.tenant', $1, true)`
+)
+
+var tenantName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,60}$`)
+
+type tenantKey struct{}
+
+// ContextWithTenant returns a context carrying the tenant of the messages
+// processed with it, typically taken from the message transport.
+func ContextWithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// TenantFromContext returns the tenant set with ContextWithTenant, if any
+func TenantFromContext(ctx context.Context) (string, bool) {
+	tenant, ok := ctx.Value(tenantKey{}).(string)
+	return tenant, ok && tenant != ""
+}
+
+// TenantResolver returns the tenant an event belongs to. The processor rejects
+// events resolved to an invalid tenant name with ErrDecode.
+type TenantResolver func(ctx context.Context, event *goes.Event) (string, error)
+
+// ContextTenant resolves events to the tenant of the context they are processed
+// with, or DefaultTenant. It is the default resolver.
+func ContextTenant(ctx context.Context, event *goes.Event) (string, error) {
+	if tenant, ok := TenantFromContext(ctx); ok {
+		return tenant, nil
+	}
+	return DefaultTenant, nil
+}
+
+// PayloadTenant resolves events to the tenant named by field of their JSON
+// payload envelope. Events whose payload is not a JSON object with a string field
+// are resolved with ContextTenant.
+func PayloadTenant(field string) TenantResolver {
+	return func(ctx context.Context, event *goes.Event) (string, error) {
+		payload, _ := event.Payload.([]byte)
+
+		var envelope map[string]json.RawMessage
+		if json.Unmarshal(payload, &envelope) == nil {
+			var tenant string
+			if json.Unmarshal(envelope[field], &tenant) == nil && tenant != "" {
+				return tenant, nil
+			}
+		}
+
+		return ContextTenant(ctx, event)
+	}
+}
+
+// resolveTenant returns the tenant of event, validated so it can't be used to
+// reach another tenant's data
+func (adp *AtomDataProcessor) resolveTenant(ctx context.Context, event *goes.Event) (string, error) {
+	tenant, err := adp.tenantResolver(ctx, event)
+	if err != nil {
+		return "", wrapError(ErrDecode, err)
+	}
+
+	if !tenantName.MatchString(tenant) {
+		return "", wrapError(ErrDecode, fmt.Errorf("Invalid tenant %q", tenant))
+	}
+
+	return tenant, nil
+}
+
+func readTenantResolverFromEnv(env *envinject.InjectedEnv) TenantResolver {
+	field := env.Getenv(EnvTenantPayloadField)
+	if field == "" {
+		return ContextTenant
+	}
+	return PayloadTenant(field)
+}
@@ -0,0 +1,162 @@
+package esatomdatapg
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xtracdev/goes"
+	"github.com/xtracdev/pgpublish"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func TestPayloadTenant(t *testing.T) {
+	resolve := PayloadTenant("tenantId")
+	acme := ContextWithTenant(context.Background(), "acme")
+
+	tenant, err := resolve(context.Background(), &goes.Event{Payload: []byte(`{"tenantId":"globex","n":1}`)})
+	assert.Nil(t, err)
+	assert.Equal(t, "globex", tenant)
+
+	for _, payload := range []interface{}{[]byte(`{"n":1}`), []byte(`{"tenantId":2}`), []byte("ok"), nil} {
+		tenant, _ = resolve(acme, &goes.Event{Payload: payload})
+		assert.Equal(t, "acme", tenant)
+
+		tenant, _ = resolve(context.Background(), &goes.Event{Payload: payload})
+		assert.Equal(t, DefaultTenant, tenant)
+	}
+}
+
+func TestContextTenant(t *testing.T) {
+	_, ok := TenantFromContext(ContextWithTenant(context.Background(), ""))
+	assert.False(t, ok)
+
+	tenant, _ := ContextTenant(ContextWithTenant(context.Background(), "acme"), &goes.Event{})
+	assert.Equal(t, "acme", tenant)
+}
+
+func TestTenantLockKeys(t *testing.T) {
+	processor, _ := New(nil)
+	acme := feedRef{tenant: "acme", name: DefaultFeed}
+	assert.NotEqual(t, processor.lockKeyFor(defaultFeedRef), processor.lockKeyFor(acme))
+	assert.NotEqual(t, processor.lockKeyFor(feedRef{tenant: "globex", name: DefaultFeed}), processor.lockKeyFor(acme))
+	assert.NotEqual(t, processor.lockKeyFor(feedRef{tenant: DefaultTenant, name: "acme"}),
+		processor.lockKeyFor(feedRef{tenant: "acme", name: DefaultFeed}))
+}
+
+func TestProcessMessageTenant(t *testing.T) {
+	metrics := newRecordingMetrics()
+	processor, mock, done := newTestProcessor(t, WithMetrics(metrics))
+	defer done()
+
+	acme := feedRef{tenant: "acme", name: DefaultFeed}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`select pg_advisory_xact_lock`).WithArgs(processor.lockKeyFor(acme)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("select feedid from t_aefd_feed").WithArgs("acme", DefaultFeed).
+		WillReturnRows(sqlmock.NewRows([]string{"feedid"}).AddRow("XXX"))
+	mock.ExpectExec("insert into t_aeae_atom_event").WithArgs("agg1", 1, "foo", []byte("ok"), ts, DefaultFeed, "acme").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(`select count`).WithArgs("acme", DefaultFeed).
+		WillReturnRows(sqlmock.NewRows([]string{"count(*)"}).AddRow(1))
+	mock.ExpectCommit()
+
+	ctx := ContextWithTenant(context.Background(), "acme")
+	_, err := processor.ProcessMessageOutcome(ctx, batchMessage("agg1"))
+	assert.Nil(t, err)
+	assert.Equal(t, acme, metrics.recentFeed)
+	assert.Equal(t, 1, metrics.recentSize)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestProcessMessageInvalidTenant(t *testing.T) {
+	processor, mock, done := newTestProcessor(t, WithTenantResolver(PayloadTenant("tenantId")))
+	defer done()
+
+	msg := pgpublish.EncodePGEvent("agg1", 1, []byte(`{"tenantId":"../globex"}`), "foo", ts)
+	err := processor.ProcessMessage(msg)
+	assert.True(t, errors.Is(err, ErrDecode))
+
+	//The batch skips the event and writes nothing
+	results := processor.ProcessMessages([]string{msg})
+	assert.True(t, errors.Is(results[0].Err, ErrDecode))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestTenantStoreSetsTenant(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`select set_config\('app.tenant', \$1, true\)`).WithArgs("acme").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("select event_time").WithArgs("acme", "agg1", 3).WillReturnRows(
+		sqlmock.NewRows([]string{"event_time", "typecode", "payload"}).AddRow(time.Now(), "foo", []byte("ok")),
+	)
+	mock.ExpectCommit()
+
+	event, err := NewPGStore(db).Tenant("acme").RetrieveEvent(context.Background(), "agg1", 3)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "foo", event.TypeCode)
+	}
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestTenantStoreIterator(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`select set_config`).WithArgs("acme").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("select event_time").WithArgs("acme", "customers").WillReturnRows(
+		sqlmock.NewRows([]string{"event_time", "aggregate_id", "version", "typecode", "payload"}).
+			AddRow(time.Now(), "agg1", 1, "foo", []byte("ok")),
+	)
+	mock.ExpectCommit()
+
+	store := NewPGStore(db).Tenant("acme").Feed("customers")
+	it, err := store.IterateRecent(context.Background())
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	assert.True(t, it.Next())
+	assert.Equal(t, "agg1", it.Event().Source)
+	assert.False(t, it.Next())
+	assert.Nil(t, it.Close())
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestCloseExpiredPageOfTenant(t *testing.T) {
+	processor, mock, done := newRolloverTestProcessor(t)
+	defer done()
+
+	acme := feedRef{tenant: "acme", name: DefaultFeed}
+	expectRecentPages(mock, acme)
+	mock.ExpectBegin()
+	mock.ExpectExec(`select pg_advisory_xact_lock`).WithArgs(processor.lockKeyFor(acme)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`select count\(\*\), min\(write_time\)`).WithArgs("acme", DefaultFeed).
+		WillReturnRows(sqlmock.NewRows([]string{"count", "min"}).AddRow(3, rolloverNow.Add(-time.Hour)))
+	mock.ExpectQuery("select feedid from t_aefd_feed").WithArgs("acme", DefaultFeed).
+		WillReturnRows(sqlmock.NewRows([]string{"feedid"}).AddRow("XXX"))
+	mock.ExpectExec("update t_aeae_atom_event set feedid").WithArgs(sqlmock.AnyArg(), "acme", DefaultFeed).
+		WillReturnResult(sqlmock.NewResult(1, 3))
+	mock.ExpectExec("insert into t_aefd_feed").WithArgs(sqlmock.AnyArg(), "XXX", DefaultFeed, "acme").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	closed, err := processor.CloseExpiredPage(context.Background())
+	assert.Nil(t, err)
+	assert.True(t, closed)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,68 @@
+package esatomdatapg
+
+import (
+	"context"
+	"time"
+
+	"github.com/xtracdev/goes"
+	"github.com/xtracdev/pgpublish"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/xtracdev/es-atom-data-pg"
+
+// tracer creates the spans for the steps of writing an event. It uses the global
+// tracer provider, so no spans are recorded unless the application has set one.
+var tracer trace.Tracer = otel.Tracer(tracerName)
+
+// recordSpanError marks span as failed with err, if err is not nil
+func recordSpanError(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
+
+// endSpan records err, if any, on span and ends it
+func endSpan(span trace.Span, err error) {
+	recordSpanError(span, err)
+	span.End()
+}
+
+func eventAttributes(event *goes.Event) trace.SpanStartOption {
+	return trace.WithAttributes(
+		attribute.String("event.aggregate_id", event.Source),
+		attribute.Int("event.version", event.Version),
+		attribute.String("event.typecode", event.TypeCode),
+	)
+}
+
+// decodeEvent decodes a pgpublish encoded message, returning the event and the
+// time it was published.
+func decodeEvent(ctx context.Context, msg string) (goes.Event, time.Time, error) {
+	_, span := tracer.Start(ctx, "DecodePGEvent")
+
+	aggId, version, payload, typecode, timestamp, err := pgpublish.DecodePGEvent(msg)
+	if err != nil {
+		endSpan(span, err)
+		return goes.Event{}, timestamp, wrapError(ErrDecode, err)
+	}
+
+	event := goes.Event{
+		Source:   aggId,
+		Version:  version,
+		Payload:  payload,
+		TypeCode: typecode,
+	}
+
+	span.SetAttributes(
+		attribute.String("event.aggregate_id", aggId),
+		attribute.Int("event.version", version),
+	)
+	span.End()
+
+	return event, timestamp, nil
+}
@@ -0,0 +1,108 @@
+package esatomdatapg
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xtracdev/envinject"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+)
+
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	saved := tracer
+	tracer = provider.Tracer(tracerName)
+	t.Cleanup(func() { tracer = saved })
+
+	return recorder
+}
+
+func spansByName(recorder *tracetest.SpanRecorder) map[string][]sdktrace.ReadOnlySpan {
+	spans := make(map[string][]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = append(spans[span.Name()], span)
+	}
+	return spans
+}
+
+func TestProcessMessagesSpans(t *testing.T) {
+	recorder := recordSpans(t)
+
+	processor, mock, done := newTestProcessor(t, WithFeedThreshold(2))
+	defer done()
+
+	expectBatchStart(mock, 1)
+	expectBatchInsert(mock, "agg1", nil)
+	expectBatchRollover(mock, "XXX")
+	mock.ExpectCommit()
+
+	results := processor.ProcessMessages([]string{batchMessage("agg1"), "bad"})
+	assert.Nil(t, results[0].Err)
+	assert.NotNil(t, results[1].Err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	spans := spansByName(recorder)
+	if !assert.Equal(t, 1, len(spans["ProcessMessages"])) {
+		return
+	}
+	root := spans["ProcessMessages"][0]
+
+	for name, count := range map[string]int{
+		"DecodePGEvent":              2,
+		"getRecentFeedCount":         1,
+		"writeEventToAtomEventTable": 1,
+		"createNewFeed":              1,
+	} {
+		if assert.Equal(t, count, len(spans[name]), name) {
+			for _, span := range spans[name] {
+				assert.Equal(t, root.SpanContext().SpanID(), span.Parent().SpanID(), name)
+			}
+		}
+	}
+
+	decodeErrors := 0
+	for _, span := range spans["DecodePGEvent"] {
+		if span.Status().Code == codes.Error {
+			decodeErrors++
+		}
+	}
+	assert.Equal(t, 1, decodeErrors)
+}
+
+func TestProcessMessageSpans(t *testing.T) {
+	recorder := recordSpans(t)
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`select pg_advisory_xact_lock`).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("select feedid from t_aefd_feed").WillReturnRows(sqlmock.NewRows([]string{"feedid"}).AddRow("XXX"))
+	mock.ExpectExec("insert into t_aeae_atom_event").WillReturnError(errors.New("BAM!"))
+	mock.ExpectRollback()
+
+	env, _ := envinject.NewInjectedEnv()
+	processor, _ := NewAtomDataProcessor(db, env)
+	assert.NotNil(t, processor.ProcessMessage(batchMessage("agg1")))
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	spans := spansByName(recorder)
+	if assert.Equal(t, 1, len(spans["ProcessMessage"])) {
+		assert.Equal(t, codes.Error, spans["ProcessMessage"][0].Status().Code)
+	}
+	if assert.Equal(t, 1, len(spans["writeEventToAtomEventTable"])) {
+		write := spans["writeEventToAtomEventTable"][0]
+		assert.Equal(t, codes.Error, write.Status().Code)
+		assert.Equal(t, spans["ProcessMessage"][0].SpanContext().SpanID(), write.Parent().SpanID())
+	}
+	assert.Equal(t, 1, len(spans["DecodePGEvent"]))
+}